@@ -9,9 +9,13 @@ import (
 
 var DB *sql.DB
 
+// Databases are opened in WAL mode, so exports read a consistent snapshot without blocking the
+// services writing to them.
+const walMode = "?_journal_mode=WAL"
+
 func InitLocationDB() {
 	var err error
-	DB, err = sql.Open("sqlite3", "./locations.db")
+	DB, err = sql.Open("sqlite3", "./locations.db"+walMode)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -20,18 +24,148 @@ func InitLocationDB() {
 	CREATE TABLE IF NOT EXISTS user_locations (
 		username TEXT PRIMARY KEY,
 		latitude REAL,
-		longitude REAL
+		longitude REAL,
+		accuracy REAL DEFAULT 0,
+		updated_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS geofences (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		latitude REAL,
+		longitude REAL,
+		radius REAL,
+		polygon TEXT,
+		usernames TEXT,
+		active_from TEXT,
+		active_until TEXT,
+		dwell_seconds INTEGER DEFAULT 0,
+		created_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS geofence_states (
+		geofence_id INTEGER,
+		username TEXT,
+		entered_at DATETIME,
+		dwell_reported INTEGER DEFAULT 0,
+		PRIMARY KEY (geofence_id, username)
+	);
+
+	CREATE TABLE IF NOT EXISTS geofence_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		geofence_id INTEGER,
+		username TEXT,
+		event TEXT,
+		latitude REAL,
+		longitude REAL,
+		timestamp DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS proximity_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		usernames TEXT,
+		distance REAL,
+		hysteresis REAL,
+		created_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS proximity_states (
+		rule_id INTEGER,
+		user_a TEXT,
+		user_b TEXT,
+		PRIMARY KEY (rule_id, user_a, user_b)
+	);
+
+	CREATE TABLE IF NOT EXISTS proximity_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rule_id INTEGER,
+		user_a TEXT,
+		user_b TEXT,
+		event TEXT,
+		distance REAL,
+		timestamp DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS devices (
+		device_id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		token_hash TEXT,
+		created_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS owntracks_friends (
+		username TEXT NOT NULL,
+		friend TEXT NOT NULL,
+		PRIMARY KEY (username, friend)
+	);
+
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		event_types TEXT,
+		usernames TEXT,
+		created_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER,
+		event_type TEXT,
+		payload TEXT,
+		attempts INTEGER DEFAULT 0,
+		next_attempt_at DATETIME,
+		last_error TEXT,
+		created_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER,
+		event_type TEXT,
+		payload TEXT,
+		attempts INTEGER,
+		last_error TEXT,
+		failed_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_cursors (
+		name TEXT PRIMARY KEY,
+		position INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS pois (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		category TEXT NOT NULL,
+		latitude REAL NOT NULL,
+		longitude REAL NOT NULL,
+		tags TEXT,
+		description TEXT,
+		created_at DATETIME,
+		updated_at DATETIME
+	);
+
+	CREATE VIRTUAL TABLE IF NOT EXISTS poi_index USING rtree (
+		id,
+		min_latitude, max_latitude,
+		min_longitude, max_longitude
 	);
 	`
 	_, err = DB.Exec(createTableQuery)
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+		log.Fatalf("Failed to create tables: %v", err)
 	}
+	addColumn("user_locations", "accuracy", "REAL DEFAULT 0")
+	addColumn("user_locations", "updated_at", "DATETIME")
+	addColumn("devices", "token_hash", "TEXT")
 }
 
 func InitLocationHistoryDB() {
 	var err error
-	DB, err = sql.Open("sqlite3", "./location_history.db")
+	DB, err = sql.Open("sqlite3", "./location_history.db"+walMode)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -42,12 +176,55 @@ func InitLocationHistoryDB() {
 		username TEXT,
 		latitude REAL,
 		longitude REAL,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		accuracy REAL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS location_history_username_timestamp ON location_history (username, timestamp);
+
+	CREATE TABLE IF NOT EXISTS alert_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		username TEXT,
+		max_speed REAL,
+		inactivity_minutes INTEGER,
+		curfew_start TEXT,
+		curfew_end TEXT,
+		created_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rule_id INTEGER,
+		username TEXT,
+		fix_id INTEGER,
+		latitude REAL,
+		longitude REAL,
+		fix_time DATETIME,
+		created_at DATETIME,
+		message TEXT
 	);
 	`
 	_, err = DB.Exec(createTableQuery)
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+		log.Fatalf("Failed to create tables: %v", err)
+	}
+	addColumn("location_history", "accuracy", "REAL DEFAULT 0")
+}
+
+// addColumn adds a column to a table created by an older version of the service.
+func addColumn(table, column, definition string) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	if err != nil {
+		log.Fatalf("Failed to inspect table %s: %v", table, err)
+	}
+	if exists {
+		return
+	}
+	if _, err := DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		log.Fatalf("Failed to add column %s.%s: %v", table, column, err)
 	}
 }
 
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Export writes every row of rows to w as NDJSON, one object per row with the column names as
+// keys, or as CSV with a header row. Times are written in RFC 3339 and NULLs as null or an empty
+// field. With compress set the output is gzipped. It returns the number of rows written.
+func Export(w io.Writer, rows *sql.Rows, format string, compress bool) (int64, error) {
+	if format != "ndjson" && format != "csv" {
+		return 0, fmt.Errorf("unsupported export format %q, expected ndjson or csv", format)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	buf := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		csvWriter = csv.NewWriter(buf)
+		csvWriter.Write(columns)
+	}
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return n, err
+		}
+		if csvWriter != nil {
+			for i, value := range values {
+				record[i] = formatExportValue(value)
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return n, err
+			}
+		} else {
+			buf.WriteByte('{')
+			for i, value := range values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				key, _ := json.Marshal(columns[i])
+				buf.Write(key)
+				buf.WriteByte(':')
+				if err := writeJSONValue(buf, value); err != nil {
+					return n, err
+				}
+			}
+			buf.WriteString("}\n")
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return n, err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return n, err
+	}
+	if gz != nil {
+		return n, gz.Close()
+	}
+	return n, nil
+}
+
+func formatExportValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+func writeJSONValue(w io.Writer, value any) error {
+	switch v := value.(type) {
+	case time.Time:
+		value = v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		value = string(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const (
+	speedRule      = "speed"
+	inactivityRule = "inactivity"
+	curfewRule     = "curfew"
+)
+
+const (
+	inactivityCheckInterval = time.Minute
+	// A fix during curfew counts as movement once it is this many kilometers from the previous fix.
+	curfewMovement = 0.1
+	curfewLayout   = "15:04"
+)
+
+func validateAlertRule(rule *pb.AlertRule) error {
+	if rule.Name == "" {
+		return status.Errorf(codes.InvalidArgument, "name is required")
+	}
+	switch rule.Kind {
+	case speedRule:
+		if rule.MaxSpeed <= 0 {
+			return status.Errorf(codes.InvalidArgument, "speed rules need a positive max_speed")
+		}
+	case inactivityRule:
+		if rule.InactivityMinutes <= 0 {
+			return status.Errorf(codes.InvalidArgument, "inactivity rules need a positive inactivity_minutes")
+		}
+	case curfewRule:
+		if _, err := time.Parse(curfewLayout, rule.CurfewStart); err != nil {
+			return status.Errorf(codes.InvalidArgument, "curfew_start must be a HH:MM time")
+		}
+		if _, err := time.Parse(curfewLayout, rule.CurfewEnd); err != nil {
+			return status.Errorf(codes.InvalidArgument, "curfew_end must be a HH:MM time")
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "kind must be one of speed, inactivity or curfew")
+	}
+	return nil
+}
+
+// curfewStart returns when the curfew window containing t began, or false if t is outside the window.
+func curfewStart(rule *pb.AlertRule, t time.Time) (time.Time, bool) {
+	from, _ := time.Parse(curfewLayout, rule.CurfewStart)
+	until, _ := time.Parse(curfewLayout, rule.CurfewEnd)
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), t.Day(), from.Hour(), from.Minute(), 0, 0, time.UTC)
+	if start.After(t) {
+		start = start.AddDate(0, 0, -1)
+	}
+	length := until.Sub(from)
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	return start, t.Before(start.Add(length))
+}
+
+func (s *server) CreateAlertRule(ctx context.Context, req *pb.AlertRule) (*pb.AlertRule, error) {
+	if err := validateAlertRule(req); err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx, `INSERT INTO alert_rules (name, kind, username, max_speed, inactivity_minutes, curfew_start, curfew_end, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.Name, req.Kind, req.Username, req.MaxSpeed, req.InactivityMinutes, req.CurfewStart, req.CurfewEnd, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.AlertRule{
+		Id:                id,
+		Name:              req.Name,
+		Kind:              req.Kind,
+		Username:          req.Username,
+		MaxSpeed:          req.MaxSpeed,
+		InactivityMinutes: req.InactivityMinutes,
+		CurfewStart:       req.CurfewStart,
+		CurfewEnd:         req.CurfewEnd,
+		CreatedAt:         timestamppb.New(createdAt),
+	}, nil
+}
+
+func (s *server) ListAlertRules(ctx context.Context, req *emptypb.Empty) (*pb.AlertRules, error) {
+	rules, err := s.listAlertRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AlertRules{Rules: rules}, nil
+}
+
+func (s *server) DeleteAlertRule(ctx context.Context, req *pb.AlertRuleId) (*emptypb.Empty, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM alert_rules WHERE id = ?", req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, status.Errorf(codes.NotFound, "alert rule not found")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) ListAlerts(ctx context.Context, req *pb.AlertsRequest) (*pb.Alerts, error) {
+	end := time.Now()
+	if req.EndTime != nil {
+		end = req.EndTime.AsTime()
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, rule_id, username, fix_id, latitude, longitude, fix_time, created_at, message FROM alerts
+		WHERE (? = 0 OR rule_id = ?) AND (? = '' OR username = ?) AND created_at BETWEEN ? AND ? AND id > ?
+		ORDER BY id`,
+		req.RuleId, req.RuleId, req.Username, req.Username, req.StartTime.AsTime().UTC(), end.UTC(), req.AfterId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := &pb.Alerts{}
+	for rows.Next() {
+		var alert pb.Alert
+		var fixTime, createdAt time.Time
+		if err := rows.Scan(&alert.Id, &alert.RuleId, &alert.Username, &alert.FixId, &alert.Latitude, &alert.Longitude,
+			&fixTime, &createdAt, &alert.Message); err != nil {
+			return nil, err
+		}
+		alert.FixTime = timestamppb.New(fixTime)
+		alert.CreatedAt = timestamppb.New(createdAt)
+		alerts.Alerts = append(alerts.Alerts, &alert)
+	}
+	return alerts, rows.Err()
+}
+
+// LastAlertId returns the id of the newest alert, so a follower can start after it without
+// reading the alerts raised before.
+func (s *server) LastAlertId(ctx context.Context, req *emptypb.Empty) (*pb.AlertId, error) {
+	var id pb.AlertId
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM alerts").Scan(&id.Id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func (s *server) listAlertRules(ctx context.Context) ([]*pb.AlertRule, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, kind, username, max_speed, inactivity_minutes, curfew_start, curfew_end, created_at FROM alert_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*pb.AlertRule
+	for rows.Next() {
+		var rule pb.AlertRule
+		var createdAt time.Time
+		if err := rows.Scan(&rule.Id, &rule.Name, &rule.Kind, &rule.Username, &rule.MaxSpeed, &rule.InactivityMinutes,
+			&rule.CurfewStart, &rule.CurfewEnd, &createdAt); err != nil {
+			return nil, err
+		}
+		rule.CreatedAt = timestamppb.New(createdAt)
+		rules = append(rules, &rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *server) insertAlert(ctx context.Context, rule *pb.AlertRule, username string, fix trackPoint, message string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO alerts (rule_id, username, fix_id, latitude, longitude, fix_time, created_at, message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.Id, username, fix.id, fix.latitude, fix.longitude, fix.timestamp.UTC(), time.Now().UTC(), message)
+	if err == nil {
+		log.Printf("Alert for %s from rule %d: %s", username, rule.Id, message)
+	}
+	return err
+}
+
+// evaluateFix runs the speed and curfew rules against the location_history row that was just stored.
+func (s *server) evaluateFix(ctx context.Context, username string, id int64) error {
+	rules, err := s.listAlertRules(ctx)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	var current, previous trackPoint
+	err = s.db.QueryRowContext(ctx, "SELECT id, latitude, longitude, timestamp FROM location_history WHERE id = ?", id).
+		Scan(&current.id, &current.latitude, &current.longitude, &current.timestamp)
+	if err != nil {
+		return err
+	}
+	err = s.db.QueryRowContext(ctx, `SELECT id, latitude, longitude, timestamp FROM location_history
+		WHERE username = ? AND (timestamp, id) < (SELECT timestamp, id FROM location_history WHERE id = ?)
+		ORDER BY timestamp DESC, id DESC LIMIT 1`, username, id).
+		Scan(&previous.id, &previous.latitude, &previous.longitude, &previous.timestamp)
+	if err == sql.ErrNoRows {
+		// The first fix of a user has nothing to compare against.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	moved := distance(previous.latitude, previous.longitude, current.latitude, current.longitude)
+
+	for _, rule := range rules {
+		if rule.Username != "" && rule.Username != username {
+			continue
+		}
+		switch rule.Kind {
+		case speedRule:
+			hours := current.timestamp.Sub(previous.timestamp).Hours()
+			if hours <= 0 {
+				continue
+			}
+			if speed := moved / hours; speed > rule.MaxSpeed {
+				message := fmt.Sprintf("speed %.1f km/h is above %.1f km/h", speed, rule.MaxSpeed)
+				if err := s.insertAlert(ctx, rule, username, current, message); err != nil {
+					return err
+				}
+			}
+		case curfewRule:
+			start, inCurfew := curfewStart(rule, current.timestamp)
+			if !inCurfew || moved < curfewMovement {
+				continue
+			}
+			// Alert once per user for each night the curfew is broken.
+			var alerted bool
+			err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM alerts WHERE rule_id = ? AND username = ? AND fix_time >= ?)",
+				rule.Id, username, start).Scan(&alerted)
+			if err != nil {
+				return err
+			}
+			if !alerted {
+				message := fmt.Sprintf("moved %.2f km during curfew %s-%s", moved, rule.CurfewStart, rule.CurfewEnd)
+				if err := s.insertAlert(ctx, rule, username, current, message); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// evaluateInactivity raises an alert for every user whose latest fix is older than an inactivity
+// rule allows. Each latest fix alerts at most once per rule.
+func (s *server) evaluateInactivity(ctx context.Context, now time.Time) error {
+	rules, err := s.listAlertRules(ctx)
+	if err != nil {
+		return err
+	}
+	var inactivityRules []*pb.AlertRule
+	for _, rule := range rules {
+		if rule.Kind == inactivityRule {
+			inactivityRules = append(inactivityRules, rule)
+		}
+	}
+	if len(inactivityRules) == 0 {
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT h.id, h.username, h.latitude, h.longitude, h.timestamp FROM location_history h
+		JOIN (SELECT username, MAX(timestamp) AS latest FROM location_history GROUP BY username) l
+		ON h.username = l.username AND h.timestamp = l.latest
+		ORDER BY h.id`)
+	if err != nil {
+		return err
+	}
+	latest := map[string]trackPoint{}
+	for rows.Next() {
+		var username string
+		var fix trackPoint
+		if err := rows.Scan(&fix.id, &username, &fix.latitude, &fix.longitude, &fix.timestamp); err != nil {
+			rows.Close()
+			return err
+		}
+		latest[username] = fix
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rule := range inactivityRules {
+		limit := time.Duration(rule.InactivityMinutes) * time.Minute
+		for username, fix := range latest {
+			if rule.Username != "" && rule.Username != username {
+				continue
+			}
+			if now.Sub(fix.timestamp) < limit {
+				continue
+			}
+			var alerted bool
+			err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM alerts WHERE rule_id = ? AND fix_id = ?)", rule.Id, fix.id).Scan(&alerted)
+			if err != nil {
+				return err
+			}
+			if !alerted {
+				message := fmt.Sprintf("no update for %d minutes", rule.InactivityMinutes)
+				if err := s.insertAlert(ctx, rule, username, fix, message); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *server) checkInactivity() {
+	ticker := time.NewTicker(inactivityCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.evaluateInactivity(context.Background(), time.Now()); err != nil {
+			log.Printf("Failed to evaluate inactivity rules: %v", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func insertFix(t *testing.T, username string, latitude, longitude float64, timestamp string) int64 {
+	res, err := testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+		username, latitude, longitude, timestamp)
+	assert.NoError(t, err)
+	id, err := res.LastInsertId()
+	assert.NoError(t, err)
+	return id
+}
+
+func TestAlertRules(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	s := &server{db: testDB}
+	ctx := context.Background()
+
+	_, err := s.CreateAlertRule(ctx, &pb.AlertRule{Name: "Broken", Kind: speedRule})
+	assert.Error(t, err)
+
+	speed, err := s.CreateAlertRule(ctx, &pb.AlertRule{Name: "Highway", Kind: speedRule, MaxSpeed: 130})
+	assert.NoError(t, err)
+	curfew, err := s.CreateAlertRule(ctx, &pb.AlertRule{Name: "Night", Kind: curfewRule, Username: "testuser", CurfewStart: "23:00", CurfewEnd: "05:00"})
+	assert.NoError(t, err)
+	inactivity, err := s.CreateAlertRule(ctx, &pb.AlertRule{Name: "Silent", Kind: inactivityRule, InactivityMinutes: 30})
+	assert.NoError(t, err)
+
+	rules, err := s.ListAlertRules(ctx, &emptypb.Empty{})
+	assert.NoError(t, err)
+	assert.Len(t, rules.Rules, 3)
+
+	// Novi Sad to Belgrade (about 72 km) in 20 minutes is well above 130 km/h
+	insertFix(t, "testuser", 45.2671, 19.8335, "2024-07-01 12:00:00")
+	fast := insertFix(t, "testuser", 44.7866, 20.4489, "2024-07-01 12:20:00")
+	assert.NoError(t, s.evaluateFix(ctx, "testuser", fast))
+
+	// Two moves during the same curfew night alert once
+	night := insertFix(t, "testuser", 44.8000, 20.4489, "2024-07-01 23:30:00")
+	assert.NoError(t, s.evaluateFix(ctx, "testuser", night))
+	later := insertFix(t, "testuser", 44.8100, 20.4489, "2024-07-02 01:30:00")
+	assert.NoError(t, s.evaluateFix(ctx, "testuser", later))
+
+	now := time.Date(2024, time.July, 2, 3, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.evaluateInactivity(ctx, now))
+	assert.NoError(t, s.evaluateInactivity(ctx, now.Add(time.Hour)))
+
+	alerts, err := s.ListAlerts(ctx, &pb.AlertsRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, alerts.Alerts, 3) {
+		assert.Equal(t, speed.Id, alerts.Alerts[0].RuleId)
+		assert.Equal(t, fast, alerts.Alerts[0].FixId)
+		assert.Equal(t, curfew.Id, alerts.Alerts[1].RuleId)
+		assert.Equal(t, night, alerts.Alerts[1].FixId)
+		assert.Equal(t, inactivity.Id, alerts.Alerts[2].RuleId)
+		assert.Equal(t, later, alerts.Alerts[2].FixId)
+
+		// Followers read the alerts raised after the last one they saw.
+		newer, err := s.ListAlerts(ctx, &pb.AlertsRequest{AfterId: alerts.Alerts[0].Id})
+		assert.NoError(t, err)
+		assert.Len(t, newer.Alerts, 2)
+
+		last, err := s.LastAlertId(ctx, &emptypb.Empty{})
+		assert.NoError(t, err)
+		assert.Equal(t, alerts.Alerts[2].Id, last.Id)
+	}
+
+	_, err = s.DeleteAlertRule(ctx, &pb.AlertRuleId{Id: speed.Id})
+	assert.NoError(t, err)
+	_, err = s.DeleteAlertRule(ctx, &pb.AlertRuleId{Id: speed.Id})
+	assert.Error(t, err)
+}
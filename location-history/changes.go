@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const (
+	changeBatchSize = 500
+	// Rows written by other processes do not notify the feed, so tailing
+	// streams also re-check the table on this interval.
+	changePollInterval = time.Second
+)
+
+// changeFeed wakes up ReadChanges streams when a new row is written to location_history.
+type changeFeed struct {
+	mu     sync.Mutex
+	notify chan struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{notify: make(chan struct{})}
+}
+
+// wait returns a channel that is closed by the next call to publish.
+func (f *changeFeed) wait() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.notify
+}
+
+func (f *changeFeed) publish() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	close(f.notify)
+	f.notify = make(chan struct{})
+	f.mu.Unlock()
+}
+
+// ReadChanges replays location_history rows with an id greater than FromOffset in id order
+// and then keeps the stream open, sending new rows as they are inserted. The offset of every
+// change is its row id, so a consumer can persist the last offset it handled and resume from it.
+func (s *server) ReadChanges(req *pb.ChangesRequest, stream pb.LocationService_ReadChangesServer) error {
+	if req.FromOffset < 0 {
+		return status.Errorf(codes.InvalidArgument, "from_offset must not be negative")
+	}
+
+	ticker := time.NewTicker(changePollInterval)
+	defer ticker.Stop()
+
+	offset := req.FromOffset
+	for {
+		// Subscribe before reading so an insert between the query and the wait is not missed.
+		wake := s.changes.wait()
+
+		changes, err := s.readChanges(stream, offset)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err := stream.Send(change); err != nil {
+				return err
+			}
+			offset = change.Offset
+		}
+		if len(changes) == changeBatchSize {
+			continue
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) readChanges(stream pb.LocationService_ReadChangesServer, offset int64) ([]*pb.LocationChange, error) {
+	rows, err := s.db.QueryContext(stream.Context(), "SELECT id, username, latitude, longitude, timestamp FROM location_history WHERE id > ? ORDER BY id LIMIT ?",
+		offset, changeBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*pb.LocationChange
+	for rows.Next() {
+		var change pb.LocationChange
+		var timestamp time.Time
+		if err := rows.Scan(&change.Offset, &change.Username, &change.Latitude, &change.Longitude, &timestamp); err != nil {
+			return nil, err
+		}
+		change.Timestamp = timestamppb.New(timestamp)
+		changes = append(changes, &change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/vzivanovic/GOLANG_FOR_STUDENTS/db"
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// exportChunkSize is the size of the messages an export is streamed in.
+const exportChunkSize = 64 << 10
+
+// exportStream sends everything written to it as export chunks.
+type exportStream struct {
+	stream pb.LocationService_ExportHistoryServer
+}
+
+func (w exportStream) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&pb.ExportChunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// historyExportQuery selects the rows of location_history an export request asks for, in id order.
+func historyExportQuery(req *pb.ExportRequest) (string, []any) {
+	conditions := []string{"id > ?"}
+	args := []any{req.AfterId}
+	if req.StartTime != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, formatTimestamp(req.StartTime.AsTime()))
+	}
+	if req.EndTime != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, formatTimestamp(req.EndTime.AsTime()))
+	}
+	return "SELECT id, username, latitude, longitude, timestamp, accuracy FROM location_history WHERE " +
+		strings.Join(conditions, " AND ") + " ORDER BY id", args
+}
+
+// ExportHistory streams the rows of location_history as NDJSON or CSV. The rows are read in one
+// transaction, so the export is a snapshot of the table even while updates keep arriving.
+func (s *server) ExportHistory(req *pb.ExportRequest, stream pb.LocationService_ExportHistoryServer) error {
+	format := req.Format
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		return status.Errorf(codes.InvalidArgument, "format must be ndjson or csv")
+	}
+
+	ctx := stream.Context()
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query, args := historyExportQuery(req)
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriterSize(exportStream{stream}, exportChunkSize)
+	n, err := db.Export(w, rows, format, req.Gzip)
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d rows of location history", n)
+	return nil
+}
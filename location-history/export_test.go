@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+type exportTestStream struct {
+	grpc.ServerStream
+	data bytes.Buffer
+}
+
+func (s *exportTestStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *exportTestStream) Send(chunk *pb.ExportChunk) error {
+	s.data.Write(chunk.Data)
+	return nil
+}
+
+func TestExportHistory(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	for i, username := range []string{"first", "second", "third"} {
+		_, err := testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp, accuracy) VALUES (?, ?, ?, ?, ?)",
+			username, 45.2671, 19.8335, formatTimestamp(time.Date(2024, time.July, 1, 12, i, 0, 0, time.UTC)), 5)
+		assert.NoError(t, err)
+	}
+	s := &server{db: testDB}
+
+	stream := &exportTestStream{}
+	assert.NoError(t, s.ExportHistory(&pb.ExportRequest{}, stream))
+	lines := strings.Split(strings.TrimSpace(stream.data.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		var row map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &row))
+		assert.Equal(t, map[string]any{
+			"id":        2.0,
+			"username":  "second",
+			"latitude":  45.2671,
+			"longitude": 19.8335,
+			"timestamp": "2024-07-01T12:01:00Z",
+			"accuracy":  5.0,
+		}, row)
+	}
+
+	// Rows after an id watermark and before a time, as gzipped CSV
+	stream = &exportTestStream{}
+	assert.NoError(t, s.ExportHistory(&pb.ExportRequest{
+		Format:  "csv",
+		Gzip:    true,
+		AfterId: 1,
+		EndTime: timestamppb.New(time.Date(2024, time.July, 1, 12, 1, 30, 0, time.UTC)),
+	}, stream))
+	r, err := gzip.NewReader(&stream.data)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "username", "latitude", "longitude", "timestamp", "accuracy"},
+		{"2", "second", "45.2671", "19.8335", "2024-07-01T12:01:00Z", "5"},
+	}, records)
+
+	assert.Error(t, s.ExportHistory(&pb.ExportRequest{Format: "xml"}, &exportTestStream{}))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const (
+	maxHeatmapPrecision = 8
+	// maxHeatmapCells bounds the grid of a heatmap, so a large box at a fine precision is refused
+	// instead of aggregating the whole table into millions of cells.
+	maxHeatmapCells = 1 << 18
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashGrid is the grid of geohash cells at a precision: a geohash of p characters holds
+// ceil(5p/2) longitude bits and floor(5p/2) latitude bits, so its cells are a regular grid.
+type geohashGrid struct {
+	precision             int
+	lonBits, latBits      int
+	cellWidth, cellHeight float64
+	minColumn, minRow     int64
+	maxColumn, maxRow     int64
+}
+
+func newGeohashGrid(precision int, minLat, minLon, maxLat, maxLon float64) geohashGrid {
+	g := geohashGrid{precision: precision, lonBits: (5*precision + 1) / 2, latBits: 5 * precision / 2}
+	g.cellWidth = 360 / math.Exp2(float64(g.lonBits))
+	g.cellHeight = 180 / math.Exp2(float64(g.latBits))
+	g.minColumn, g.minRow = g.cell(minLat, minLon)
+	g.maxColumn, g.maxRow = g.cell(maxLat, maxLon)
+	return g
+}
+
+// cell returns the column and row of the cell containing a position, counted from (-90, -180).
+func (g geohashGrid) cell(latitude, longitude float64) (int64, int64) {
+	column := min(int64(math.Floor((longitude+180)/g.cellWidth)), 1<<g.lonBits-1)
+	row := min(int64(math.Floor((latitude+90)/g.cellHeight)), 1<<g.latBits-1)
+	return column, row
+}
+
+func (g geohashGrid) columns() int64 { return g.maxColumn - g.minColumn + 1 }
+func (g geohashGrid) rows() int64    { return g.maxRow - g.minRow + 1 }
+
+// geohash names a cell by interleaving the bits of its column and row, longitude first.
+func (g geohashGrid) geohash(column, row int64) string {
+	var hash strings.Builder
+	lonBit, latBit := g.lonBits, g.latBits
+	var char int
+	for i := 0; i < 5*g.precision; i++ {
+		char <<= 1
+		if i%2 == 0 {
+			lonBit--
+			char |= int(column>>lonBit) & 1
+		} else {
+			latBit--
+			char |= int(row>>latBit) & 1
+		}
+		if i%5 == 4 {
+			hash.WriteByte(geohashAlphabet[char])
+			char = 0
+		}
+	}
+	return hash.String()
+}
+
+// GetHeatmap counts the fixes and distinct users in the geohash cells covering a box. Cells with
+// fewer than min_users users are left out, so no cell describes a handful of individuals. The box
+// is widened to whole cells, so overlapping requests cannot be subtracted to count a part of one.
+func (s *server) GetHeatmap(ctx context.Context, req *pb.HeatmapRequest) (*pb.Heatmap, error) {
+	if req.Precision < 1 || req.Precision > maxHeatmapPrecision {
+		return nil, status.Errorf(codes.InvalidArgument, "precision must be between 1 and %d", maxHeatmapPrecision)
+	}
+	if req.MinLatitude < -90 || req.MaxLatitude > 90 || req.MinLatitude > req.MaxLatitude ||
+		req.MinLongitude < -180 || req.MaxLongitude > 180 || req.MinLongitude > req.MaxLongitude {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid bounding box")
+	}
+	if req.MinUsers < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "min_users must not be negative")
+	}
+	minUsers := max(req.MinUsers, int32(s.heatmapMinUsers))
+
+	g := newGeohashGrid(int(req.Precision), req.MinLatitude, req.MinLongitude, req.MaxLatitude, req.MaxLongitude)
+	if g.columns()*g.rows() > maxHeatmapCells {
+		return nil, status.Errorf(codes.InvalidArgument, "the box covers more than %d cells at precision %d", maxHeatmapCells, req.Precision)
+	}
+	south := float64(g.minRow)*g.cellHeight - 90
+	west := float64(g.minColumn)*g.cellWidth - 180
+
+	conditions := []string{"latitude BETWEEN ? AND ?", "longitude BETWEEN ? AND ?"}
+	args := []any{g.cellWidth, int64(1)<<g.lonBits - 1, g.cellHeight, int64(1)<<g.latBits - 1,
+		south, float64(g.maxRow+1)*g.cellHeight - 90, west, float64(g.maxColumn+1)*g.cellWidth - 180}
+	if req.StartTime != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, formatTimestamp(req.StartTime.AsTime()))
+	}
+	if req.EndTime != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, formatTimestamp(req.EndTime.AsTime()))
+	}
+	args = append(args, minUsers)
+	rows, err := s.db.QueryContext(ctx, `SELECT MIN(CAST((longitude + 180) / ? AS INTEGER), ?) AS column_index,
+		MIN(CAST((latitude + 90) / ? AS INTEGER), ?) AS row_index, COUNT(*), COUNT(DISTINCT username)
+		FROM location_history WHERE `+strings.Join(conditions, " AND ")+`
+		GROUP BY column_index, row_index HAVING COUNT(DISTINCT username) >= ?
+		ORDER BY row_index, column_index`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	heatmap := &pb.Heatmap{
+		Precision:    req.Precision,
+		MinUsers:     minUsers,
+		MinLatitude:  south,
+		MinLongitude: west,
+		CellHeight:   g.cellHeight,
+		CellWidth:    g.cellWidth,
+		Rows:         int32(g.rows()),
+		Columns:      int32(g.columns()),
+	}
+	for rows.Next() {
+		var column, row, points, users int64
+		if err := rows.Scan(&column, &row, &points, &users); err != nil {
+			return nil, err
+		}
+		// Fixes on the north or east edge of the grid fall in the next cell, outside the grid.
+		if column > g.maxColumn || row > g.maxRow {
+			continue
+		}
+		heatmap.Cells = append(heatmap.Cells, &pb.HeatmapCell{
+			Geohash: g.geohash(column, row),
+			Row:     int32(row - g.minRow),
+			Column:  int32(column - g.minColumn),
+			Points:  points,
+			Users:   users,
+		})
+	}
+	return heatmap, rows.Err()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+func TestGeohashGrid(t *testing.T) {
+	g := newGeohashGrid(8, 57.64911, 10.40744, 57.64911, 10.40744)
+	assert.Equal(t, "u4pruydq", g.geohash(g.minColumn, g.minRow))
+	assert.Equal(t, int64(1), g.columns())
+	assert.Equal(t, int64(1), g.rows())
+
+	g = newGeohashGrid(1, -90, -180, 90, 180)
+	assert.Equal(t, int64(8), g.columns())
+	assert.Equal(t, int64(4), g.rows())
+	assert.Equal(t, "0", g.geohash(0, 0))
+	assert.Equal(t, "z", g.geohash(7, 3))
+}
+
+func TestGetHeatmap(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	insert := func(username string, latitude, longitude float64, timestamp time.Time) {
+		_, err := testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+			username, latitude, longitude, formatTimestamp(timestamp))
+		assert.NoError(t, err)
+	}
+	// Three users in the centre of Novi Sad, one of them twice, and a single user in Belgrade.
+	for i := 0; i < 3; i++ {
+		insert(fmt.Sprintf("user%d", i), 45.2551, 19.8452, start.Add(time.Duration(i)*time.Minute))
+	}
+	insert("user0", 45.2552, 19.8453, start.Add(time.Hour))
+	insert("loner", 44.8125, 20.4612, start)
+
+	s := &server{db: testDB, heatmapMinUsers: 2}
+	req := &pb.HeatmapRequest{MinLatitude: 44, MinLongitude: 19, MaxLatitude: 46, MaxLongitude: 21, Precision: 5}
+	heatmap, err := s.GetHeatmap(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), heatmap.MinUsers)
+	if assert.Len(t, heatmap.Cells, 1) {
+		cell := heatmap.Cells[0]
+		assert.Equal(t, "u2n17", cell.Geohash)
+		assert.Equal(t, int64(4), cell.Points)
+		assert.Equal(t, int64(3), cell.Users)
+		// The cell lies in the grid at its row and column.
+		south := heatmap.MinLatitude + float64(cell.Row)*heatmap.CellHeight
+		west := heatmap.MinLongitude + float64(cell.Column)*heatmap.CellWidth
+		assert.True(t, south <= 45.2551 && 45.2551 < south+heatmap.CellHeight)
+		assert.True(t, west <= 19.8452 && 19.8452 < west+heatmap.CellWidth)
+	}
+	// The grid is widened to whole cells.
+	assert.LessOrEqual(t, heatmap.MinLatitude, 44.0)
+	assert.LessOrEqual(t, heatmap.MinLongitude, 19.0)
+	assert.GreaterOrEqual(t, heatmap.MinLatitude+float64(heatmap.Rows)*heatmap.CellHeight, 46.0)
+
+	// Asking for fewer users than the server minimum does not reveal the single user.
+	req.MinUsers = 1
+	heatmap, err = s.GetHeatmap(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Len(t, heatmap.Cells, 1)
+
+	req.MinUsers = 4
+	heatmap, err = s.GetHeatmap(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, heatmap.Cells)
+
+	req.MinUsers = 0
+	req.EndTime = timestamppb.New(start.Add(30 * time.Second))
+	heatmap, err = s.GetHeatmap(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, heatmap.Cells)
+
+	for _, bad := range []*pb.HeatmapRequest{
+		{MinLatitude: 44, MinLongitude: 19, MaxLatitude: 46, MaxLongitude: 21, Precision: 9},
+		{MinLatitude: 46, MinLongitude: 19, MaxLatitude: 44, MaxLongitude: 21, Precision: 5},
+		{MinLatitude: -90, MinLongitude: -180, MaxLatitude: 90, MaxLongitude: 180, Precision: 6},
+	} {
+		_, err := s.GetHeatmap(context.Background(), bad)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
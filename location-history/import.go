@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/vzivanovic/GOLANG_FOR_STUDENTS/db"
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// maxImportSize limits uploaded track files, which arrive in a single gRPC message.
+const maxImportSize = 64 << 20
+
+// importPoint is a position read from an export of another app. Points without a timestamp are
+// counted but not imported.
+type importPoint struct {
+	latitude  float64
+	longitude float64
+	timestamp time.Time
+	accuracy  float64
+}
+
+type gpxPoint struct {
+	Latitude  float64 `xml:"lat,attr"`
+	Longitude float64 `xml:"lon,attr"`
+	Time      string  `xml:"time"`
+}
+
+type kmlTrack struct {
+	When   []string `xml:"when"`
+	Coords []string `xml:"coord"`
+}
+
+// kmlPlacemark collects the geometries of a placemark, whether or not they are wrapped in a
+// MultiGeometry. gx:Track and gx:MultiTrack match by their local names.
+type kmlPlacemark struct {
+	When        string     `xml:"TimeStamp>when"`
+	Begin       string     `xml:"TimeSpan>begin"`
+	End         string     `xml:"TimeSpan>end"`
+	Points      []string   `xml:"Point>coordinates"`
+	LineStrings []string   `xml:"LineString>coordinates"`
+	Tracks      []kmlTrack `xml:"Track"`
+	MultiTracks []kmlTrack `xml:"MultiTrack>Track"`
+	Multi       struct {
+		Points      []string   `xml:"Point>coordinates"`
+		LineStrings []string   `xml:"LineString>coordinates"`
+		Tracks      []kmlTrack `xml:"Track"`
+	} `xml:"MultiGeometry"`
+}
+
+// parseImportTime accepts the XML Schema dateTime used by GPX and KML, with or without a zone,
+// and plain dates. Times without a zone are UTC.
+func parseImportTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+func validCoordinate(latitude, longitude float64) error {
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return fmt.Errorf("coordinate %v,%v is out of range", latitude, longitude)
+	}
+	return nil
+}
+
+// parseGPX reads track, route and waypoints.
+func parseGPX(r io.Reader) ([]importPoint, error) {
+	d := xml.NewDecoder(r)
+	var points []importPoint
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return points, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "trkpt" && start.Name.Local != "rtept" && start.Name.Local != "wpt") {
+			continue
+		}
+
+		var p gpxPoint
+		if err := d.DecodeElement(&p, &start); err != nil {
+			return nil, err
+		}
+		if err := validCoordinate(p.Latitude, p.Longitude); err != nil {
+			return nil, err
+		}
+		point := importPoint{latitude: p.Latitude, longitude: p.Longitude}
+		if p.Time != "" {
+			if point.timestamp, err = parseImportTime(p.Time); err != nil {
+				return nil, err
+			}
+		}
+		points = append(points, point)
+	}
+}
+
+// parseKMLCoordinates reads "lon,lat[,alt]" tuples separated by whitespace.
+func parseKMLCoordinates(value string) ([]importPoint, error) {
+	var points []importPoint
+	for _, tuple := range strings.Fields(value) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid coordinates %q", tuple)
+		}
+		longitude, err1 := strconv.ParseFloat(parts[0], 64)
+		latitude, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid coordinates %q", tuple)
+		}
+		if err := validCoordinate(latitude, longitude); err != nil {
+			return nil, err
+		}
+		points = append(points, importPoint{latitude: latitude, longitude: longitude})
+	}
+	return points, nil
+}
+
+// parseKMLTrack pairs the when and gx:coord ("lon lat alt") elements of a gx:Track.
+func parseKMLTrack(track kmlTrack) ([]importPoint, error) {
+	if len(track.When) != len(track.Coords) {
+		return nil, fmt.Errorf("track has %d times for %d coordinates", len(track.When), len(track.Coords))
+	}
+	points := make([]importPoint, 0, len(track.Coords))
+	for i, coord := range track.Coords {
+		parsed, err := parseKMLCoordinates(strings.Join(strings.Fields(coord), ","))
+		if err != nil {
+			return nil, err
+		}
+		if len(parsed) != 1 {
+			return nil, fmt.Errorf("invalid coordinates %q", coord)
+		}
+		point := parsed[0]
+		if point.timestamp, err = parseImportTime(track.When[i]); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// parseKML reads points, line strings and gx:Tracks of every placemark. Points take the time of the
+// placemark's TimeStamp or the begin of its TimeSpan. Line strings carry no times of their own, so
+// their vertices are spread evenly over the placemark's TimeSpan and skipped without one.
+func parseKML(r io.Reader) ([]importPoint, error) {
+	d := xml.NewDecoder(r)
+	var points []importPoint
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return points, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Placemark" {
+			continue
+		}
+
+		var p kmlPlacemark
+		if err := d.DecodeElement(&p, &start); err != nil {
+			return nil, err
+		}
+		var begin, end time.Time
+		if p.When != "" {
+			if begin, err = parseImportTime(p.When); err != nil {
+				return nil, err
+			}
+		} else if p.Begin != "" {
+			if begin, err = parseImportTime(p.Begin); err != nil {
+				return nil, err
+			}
+			if p.End != "" {
+				if end, err = parseImportTime(p.End); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, coordinates := range append(p.Points, p.Multi.Points...) {
+			parsed, err := parseKMLCoordinates(coordinates)
+			if err != nil {
+				return nil, err
+			}
+			for _, point := range parsed {
+				point.timestamp = begin
+				points = append(points, point)
+			}
+		}
+		for _, coordinates := range append(p.LineStrings, p.Multi.LineStrings...) {
+			parsed, err := parseKMLCoordinates(coordinates)
+			if err != nil {
+				return nil, err
+			}
+			for i := range parsed {
+				if !begin.IsZero() && end.After(begin) && len(parsed) > 1 {
+					step := float64(end.Sub(begin)) / float64(len(parsed)-1)
+					parsed[i].timestamp = begin.Add(time.Duration(step * float64(i)))
+				}
+			}
+			points = append(points, parsed...)
+		}
+		for _, track := range append(append(p.Tracks, p.MultiTracks...), p.Multi.Tracks...) {
+			parsed, err := parseKMLTrack(track)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, parsed...)
+		}
+	}
+}
+
+func parseTrackFile(format string, data []byte) ([]importPoint, error) {
+	switch strings.ToLower(format) {
+	case "gpx":
+		return parseGPX(bytes.NewReader(data))
+	case "kml":
+		return parseKML(bytes.NewReader(data))
+	case "takeout", "json":
+		return nil, errors.New("takeout files are only imported with the location-history import command")
+	}
+	return nil, fmt.Errorf("unsupported format %q, expected gpx or kml", format)
+}
+
+// importBatchSize is how many points a batched import stores per transaction.
+const importBatchSize = 5000
+
+const importInsert = `INSERT INTO location_history (username, latitude, longitude, timestamp, accuracy)
+	SELECT ?1, ?2, ?3, ?4, ?5 WHERE NOT EXISTS (
+		SELECT 1 FROM location_history WHERE username = ?1 AND timestamp = ?4 AND latitude = ?2 AND longitude = ?3)`
+
+// importPreviewInsert collects the points of a batched dry run in a temporary table, which takes no
+// lock on the history, so that points repeated anywhere in the file are counted as duplicates.
+const importPreviewInsert = `INSERT INTO import_preview (username, latitude, longitude, timestamp, accuracy)
+	SELECT ?1, ?2, ?3, ?4, ?5 WHERE NOT EXISTS (
+		SELECT 1 FROM location_history WHERE username = ?1 AND timestamp = ?4 AND latitude = ?2 AND longitude = ?3)
+	AND NOT EXISTS (
+		SELECT 1 FROM import_preview WHERE username = ?1 AND timestamp = ?4 AND latitude = ?2 AND longitude = ?3)`
+
+// trackImporter inserts points into the history of one user, leaving out points that are already
+// stored. It either uses a single transaction or, for long imports, commits every batchSize points.
+// A dry run reports the same summary without storing anything. Imported points are history and do
+// not trigger alert rules.
+type trackImporter struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	insert  *sql.Stmt
+	dryRun  bool
+	summary *pb.ImportSummary
+
+	// conn, batchSize and pending are only used by batched imports.
+	conn      *sql.Conn
+	batchSize int
+	pending   int
+	batchNew  int64
+	// committed counts the new points of the batches committed so far.
+	committed int64
+
+	username    string
+	first, last time.Time
+}
+
+func newTrackImporter(ctx context.Context, db *sql.DB, username string, dryRun bool) (*trackImporter, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	insert, err := tx.PrepareContext(ctx, importInsert)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &trackImporter{ctx: ctx, tx: tx, insert: insert, dryRun: dryRun, summary: &pb.ImportSummary{}, username: username}, nil
+}
+
+// newBatchedTrackImporter is newTrackImporter for imports of many points. Holding the write lock
+// for all of them would make the live service's updates fail, so the points are committed in
+// batches and a failed import keeps the batches before it.
+func newBatchedTrackImporter(ctx context.Context, db *sql.DB, username string, dryRun bool) (*trackImporter, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		if _, err := conn.ExecContext(ctx, `CREATE TEMP TABLE import_preview (username TEXT, latitude REAL, longitude REAL, timestamp DATETIME, accuracy REAL);
+			CREATE INDEX temp.import_preview_key ON import_preview (username, timestamp)`); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	i := &trackImporter{ctx: ctx, conn: conn, batchSize: importBatchSize, dryRun: dryRun, summary: &pb.ImportSummary{}, username: username}
+	if err := i.begin(); err != nil {
+		i.closeConn()
+		return nil, err
+	}
+	return i, nil
+}
+
+// begin starts the next batch.
+func (i *trackImporter) begin() error {
+	tx, err := i.conn.BeginTx(i.ctx, nil)
+	if err != nil {
+		return err
+	}
+	query := importInsert
+	if i.dryRun {
+		query = importPreviewInsert
+	}
+	insert, err := tx.PrepareContext(i.ctx, query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	i.tx, i.insert, i.pending, i.batchNew = tx, insert, 0, 0
+	return nil
+}
+
+// commit ends the current batch.
+func (i *trackImporter) commit() error {
+	i.insert.Close()
+	if err := i.tx.Commit(); err != nil {
+		return err
+	}
+	i.committed += i.batchNew
+	return nil
+}
+
+// closeConn drops the dry run's table and returns the connection of a batched import to the pool.
+func (i *trackImporter) closeConn() {
+	if i.dryRun {
+		i.conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS temp.import_preview")
+	}
+	i.conn.Close()
+}
+
+// add inserts one point unless it has no timestamp or is already stored.
+func (i *trackImporter) add(point importPoint) error {
+	return i.addFor(i.username, point)
+}
+
+// addFor is add for imports that mix the positions of several users.
+func (i *trackImporter) addFor(username string, point importPoint) error {
+	if point.timestamp.IsZero() {
+		i.summary.Skipped++
+		return nil
+	}
+	i.summary.Points++
+	if i.first.IsZero() || point.timestamp.Before(i.first) {
+		i.first = point.timestamp
+	}
+	if point.timestamp.After(i.last) {
+		i.last = point.timestamp
+	}
+
+	res, err := i.insert.ExecContext(i.ctx, username, point.latitude, point.longitude, formatTimestamp(point.timestamp), point.accuracy)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		i.summary.Duplicates++
+	} else {
+		i.batchNew++
+	}
+
+	if i.pending++; i.batchSize > 0 && i.pending >= i.batchSize {
+		if err := i.commit(); err != nil {
+			return err
+		}
+		return i.begin()
+	}
+	return nil
+}
+
+// finish commits the points, unless this is a dry run, and returns the summary.
+func (i *trackImporter) finish() (*pb.ImportSummary, error) {
+	if i.summary.Points > 0 {
+		i.summary.First = timestamppb.New(i.first)
+		i.summary.Last = timestamppb.New(i.last)
+	}
+	if i.conn != nil {
+		defer i.closeConn()
+		return i.summary, i.commit()
+	}
+	i.insert.Close()
+	if i.dryRun {
+		return i.summary, i.tx.Rollback()
+	}
+	return i.summary, i.tx.Commit()
+}
+
+// abort rolls back the points added since the last commit.
+func (i *trackImporter) abort() {
+	i.insert.Close()
+	i.tx.Rollback()
+	if i.conn != nil {
+		i.closeConn()
+	}
+}
+
+func importPoints(ctx context.Context, db *sql.DB, username string, points []importPoint, dryRun bool) (*pb.ImportSummary, error) {
+	importer, err := newTrackImporter(ctx, db, username, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	for _, point := range points {
+		if err := importer.add(point); err != nil {
+			importer.abort()
+			return nil, err
+		}
+	}
+	return importer.finish()
+}
+
+func (s *server) ImportTrack(ctx context.Context, req *pb.ImportRequest) (*pb.ImportSummary, error) {
+	if req.Username == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "username is required")
+	}
+	points, err := parseTrackFile(req.Format, req.Data)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	summary, err := importPoints(ctx, s.db, req.Username, points, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !req.DryRun && summary.Points > summary.Duplicates {
+		s.changes.publish()
+	}
+	return summary, nil
+}
+
+// ImportLocations stores positions validated by the caller, such as the rows of a CSV import, with
+// the same duplicate handling as ImportTrack.
+func (s *server) ImportLocations(ctx context.Context, req *pb.ImportLocationsRequest) (*pb.ImportSummary, error) {
+	for _, location := range req.Locations {
+		if location.Username == "" || location.Timestamp == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "every location needs a username and a timestamp")
+		}
+		if err := validCoordinate(location.Latitude, location.Longitude); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	importer, err := newTrackImporter(ctx, s.db, "", req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range req.Locations {
+		point := importPoint{
+			latitude:  location.Latitude,
+			longitude: location.Longitude,
+			timestamp: location.Timestamp.AsTime(),
+			accuracy:  location.Accuracy,
+		}
+		if err := importer.addFor(location.Username, point); err != nil {
+			importer.abort()
+			return nil, err
+		}
+	}
+	summary, err := importer.finish()
+	if err != nil {
+		return nil, err
+	}
+	if !req.DryRun && summary.Points > summary.Duplicates {
+		s.changes.publish()
+	}
+	return summary, nil
+}
+
+func printImportSummary(summary *pb.ImportSummary, dryRun bool) {
+	action := "Imported"
+	if dryRun {
+		action = "Would import"
+	}
+	fmt.Printf("%s %d points (%d already stored, %d skipped)\n",
+		action, summary.Points-summary.Duplicates, summary.Duplicates, summary.Skipped)
+	if summary.Points > 0 {
+		fmt.Printf("From %s to %s\n", summary.First.AsTime().Format(time.RFC3339), summary.Last.AsTime().Format(time.RFC3339))
+	}
+}
+
+// importTakeoutFile streams a Google Takeout file into the importer, printing progress to stderr
+// since such files can hold years of history.
+func importTakeoutFile(path string, importer *trackImporter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := &progressReader{r: file, size: info.Size(), interval: 2 * time.Second, next: time.Now().Add(2 * time.Second),
+		report: func(read, size int64) {
+			fmt.Fprintf(os.Stderr, "Read %d of %d MB (%d%%), %d points\n",
+				read>>20, size>>20, read*100/max(size, 1), importer.summary.Points)
+		},
+	}
+	return readTakeout(bufio.NewReader(r), importer)
+}
+
+// importCommand imports a GPX, KML or Google Takeout file straight into the database in the working
+// directory:
+//
+//	location-history import -username alice [-format gpx] [-dry-run] track.gpx
+//
+// Takeout files (Records.json or Timeline.json) are streamed rather than read into memory. Points
+// are committed in batches, so a running service keeps storing positions during the import.
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("username", "", "User the track belongs to")
+	format := flags.String("format", "", "gpx, kml or takeout (default from the file extension, takeout for .json)")
+	dryRun := flags.Bool("dry-run", false, "Only report what would be imported")
+	flags.Parse(args)
+	if *username == "" || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: location-history import -username <username> [-format gpx|kml|takeout] [-dry-run] <file>")
+		os.Exit(2)
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	}
+	if *format == "json" {
+		*format = "takeout"
+	}
+	var points []importPoint
+	if *format != "takeout" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+		if points, err = parseTrackFile(*format, data); err != nil {
+			log.Fatalf("Failed to parse %s: %v", path, err)
+		}
+	}
+
+	db.InitLocationHistoryDB()
+	defer db.CloseDB()
+	importer, err := newBatchedTrackImporter(context.Background(), db.DB, *username, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", path, err)
+	}
+	if *format == "takeout" {
+		err = importTakeoutFile(path, importer)
+	} else {
+		for _, point := range points {
+			if err = importer.add(point); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		importer.abort()
+		if !*dryRun && importer.committed > 0 {
+			log.Fatalf("Failed to import %s after storing %d new points: %v", path, importer.committed, err)
+		}
+		log.Fatalf("Failed to import %s: %v", path, err)
+	}
+	summary, err := importer.finish()
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", path, err)
+	}
+	printImportSummary(summary, *dryRun)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <wpt lat="45.2550" lon="19.8450"><name>Start</name></wpt>
+  <trk><name>Morning ride</name><trkseg>
+    <trkpt lat="45.2671" lon="19.8335"><ele>80</ele><time>2024-07-01T12:00:00Z</time></trkpt>
+    <trkpt lat="45.2600" lon="19.8400"><time>2024-07-01T12:05:00.500Z</time></trkpt>
+    <trkpt lat="45.2550" lon="19.8450"><time>2024-07-01T14:10:00+02:00</time></trkpt>
+  </trkseg></trk>
+</gpx>`
+
+const testKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+  <Document><Folder>
+    <Placemark>
+      <TimeStamp><when>2024-07-01T08:00:00Z</when></TimeStamp>
+      <Point><coordinates>20.4489,44.7866,0</coordinates></Point>
+    </Placemark>
+    <Placemark>
+      <TimeSpan><begin>2024-07-01T09:00:00Z</begin><end>2024-07-01T10:00:00Z</end></TimeSpan>
+      <LineString><coordinates>20.40,44.80,0 20.41,44.81,0
+        20.42,44.82,0</coordinates></LineString>
+    </Placemark>
+    <Placemark>
+      <LineString><coordinates>20.50,44.90 20.51,44.91</coordinates></LineString>
+    </Placemark>
+    <Placemark>
+      <gx:Track>
+        <when>2024-07-01T11:00:00Z</when>
+        <when>2024-07-01T11:01:00Z</when>
+        <gx:coord>20.45 44.79 100</gx:coord>
+        <gx:coord>20.46 44.80 101</gx:coord>
+      </gx:Track>
+    </Placemark>
+  </Folder></Document>
+</kml>`
+
+func TestParseTrackFiles(t *testing.T) {
+	points, err := parseTrackFile("gpx", []byte(testGPX))
+	assert.NoError(t, err)
+	if assert.Len(t, points, 4) {
+		assert.True(t, points[0].timestamp.IsZero())
+		assert.Equal(t, importPoint{latitude: 45.2671, longitude: 19.8335, timestamp: time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)}, points[1])
+		assert.True(t, time.Date(2024, time.July, 1, 12, 10, 0, 0, time.UTC).Equal(points[3].timestamp))
+	}
+
+	points, err = parseTrackFile("KML", []byte(testKML))
+	assert.NoError(t, err)
+	if assert.Len(t, points, 8) {
+		assert.Equal(t, importPoint{latitude: 44.7866, longitude: 20.4489, timestamp: time.Date(2024, time.July, 1, 8, 0, 0, 0, time.UTC)}, points[0])
+		assert.Equal(t, time.Date(2024, time.July, 1, 9, 30, 0, 0, time.UTC), points[2].timestamp)
+		assert.Equal(t, time.Date(2024, time.July, 1, 10, 0, 0, 0, time.UTC), points[3].timestamp)
+		assert.True(t, points[4].timestamp.IsZero())
+		assert.Equal(t, importPoint{latitude: 44.80, longitude: 20.46, timestamp: time.Date(2024, time.July, 1, 11, 1, 0, 0, time.UTC)}, points[7])
+	}
+
+	_, err = parseTrackFile("gpx", []byte(`<gpx><trkpt lat="95" lon="19"/></gpx>`))
+	assert.Error(t, err)
+	_, err = parseTrackFile("csv", []byte(testGPX))
+	assert.Error(t, err)
+	_, err = parseTrackFile("takeout", []byte(testRecords))
+	assert.ErrorContains(t, err, "location-history import command")
+}
+
+func TestImportTrack(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	s := &server{db: testDB}
+	req := &pb.ImportRequest{Username: "testuser", Format: "gpx", Data: []byte(testGPX), DryRun: true}
+
+	summary, err := s.ImportTrack(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Points)
+	assert.Equal(t, int64(1), summary.Skipped)
+	assert.Equal(t, int64(0), summary.Duplicates)
+	assert.Equal(t, time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC), summary.First.AsTime())
+	assert.Equal(t, time.Date(2024, time.July, 1, 12, 10, 0, 0, time.UTC), summary.Last.AsTime())
+
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history").Scan(&count)
+	assert.Equal(t, 0, count)
+
+	req.DryRun = false
+	_, err = s.ImportTrack(context.Background(), req)
+	assert.NoError(t, err)
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history WHERE username = ?", "testuser").Scan(&count)
+	assert.Equal(t, 3, count)
+
+	// Importing the same file again only finds duplicates
+	summary, err = s.ImportTrack(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Duplicates)
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history WHERE username = ?", "testuser").Scan(&count)
+	assert.Equal(t, 3, count)
+
+	resp, err := s.GetDistance(context.Background(), &pb.DistanceRequest{
+		Username:  "testuser",
+		StartTime: summary.First,
+		EndTime:   summary.Last,
+	})
+	assert.NoError(t, err)
+	assert.Greater(t, resp.Distance, 0.0)
+
+	_, err = s.ImportTrack(context.Background(), &pb.ImportRequest{Username: "testuser", Format: "gpx", Data: []byte("<gpx><trkpt")})
+	assert.Error(t, err)
+}
+
+func TestImportLocations(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	s := &server{db: testDB}
+	at := func(minute int) *timestamppb.Timestamp {
+		return timestamppb.New(time.Date(2024, time.July, 1, 12, minute, 0, 0, time.UTC))
+	}
+	req := &pb.ImportLocationsRequest{Locations: []*pb.LocationUpdate{
+		{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Timestamp: at(0), Accuracy: 5},
+		{Username: "otheruser", Latitude: 44.7866, Longitude: 20.4489, Timestamp: at(1)},
+		{Username: "testuser", Latitude: 45.2600, Longitude: 19.8400, Timestamp: at(2)},
+	}}
+	summary, err := s.ImportLocations(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Points)
+	assert.Equal(t, int64(0), summary.Duplicates)
+
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history WHERE username = ?", "testuser").Scan(&count)
+	assert.Equal(t, 2, count)
+
+	summary, err = s.ImportLocations(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Duplicates)
+
+	_, err = s.ImportLocations(context.Background(), &pb.ImportLocationsRequest{Locations: []*pb.LocationUpdate{
+		{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"log"
 	"math"
 	"net"
+	"os"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -17,15 +20,31 @@ import (
 
 type server struct {
 	pb.UnimplementedLocationServiceServer
-	db *sql.DB
+	db      *sql.DB
+	changes *changeFeed
+	// heatmapMinUsers is the least number of users a heatmap cell needs to be reported.
+	heatmapMinUsers int
 }
 
 func (s *server) UpdateLocation(ctx context.Context, req *pb.LocationUpdate) (*emptypb.Empty, error) {
-	_, err := s.db.Exec("INSERT INTO location_history (username, latitude, longitude) VALUES (?, ?, ?)",
-		req.Username, req.Latitude, req.Longitude)
+	timestamp := time.Now()
+	if req.Timestamp != nil {
+		timestamp = req.Timestamp.AsTime()
+	}
+	res, err := s.db.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp, accuracy) VALUES (?, ?, ?, ?, ?)",
+		req.Username, req.Latitude, req.Longitude, formatTimestamp(timestamp), req.Accuracy)
+	if err != nil {
+		return nil, err
+	}
+	s.changes.publish()
+
+	id, err := res.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
+	if err := s.evaluateFix(ctx, req.Username, id); err != nil {
+		log.Printf("Failed to evaluate alert rules: %v", err)
+	}
 	log.Printf("Received location update: %v", req)
 	return &emptypb.Empty{}, nil
 }
@@ -73,6 +92,14 @@ func distance(lat1, lon1, lat2, lon2 float64) float64 {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importCommand(os.Args[2:])
+		return
+	}
+
+	heatmapMinUsers := flag.Int("heatmap-min-users", 5, "Leave heatmap cells with fewer distinct users out, whatever the request asks")
+	flag.Parse()
+
 	db.InitLocationHistoryDB()
 	defer db.CloseDB()
 
@@ -81,8 +108,11 @@ func main() {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	pb.RegisterLocationServiceServer(s, &server{db: db.DB})
+	srv := &server{db: db.DB, changes: newChangeFeed(), heatmapMinUsers: *heatmapMinUsers}
+	go srv.checkInactivity()
+
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(maxImportSize))
+	pb.RegisterLocationServiceServer(s, srv)
 	reflection.Register(s)
 
 	log.Println("Starting location history microservice on :50051")
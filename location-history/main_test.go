@@ -9,6 +9,9 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -20,13 +23,40 @@ func setupTestDB() {
 	if err != nil {
 		panic(err)
 	}
+	// Every connection to :memory: opens a separate database, so keep a single one.
+	testDB.SetMaxOpenConns(1)
 	createTableQuery := `
     CREATE TABLE IF NOT EXISTS location_history (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         username TEXT,
         latitude REAL,
         longitude REAL,
-        timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+        timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+        accuracy REAL DEFAULT 0
+    );
+
+    CREATE TABLE IF NOT EXISTS alert_rules (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        username TEXT,
+        max_speed REAL,
+        inactivity_minutes INTEGER,
+        curfew_start TEXT,
+        curfew_end TEXT,
+        created_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS alerts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        rule_id INTEGER,
+        username TEXT,
+        fix_id INTEGER,
+        latitude REAL,
+        longitude REAL,
+        fix_time DATETIME,
+        created_at DATETIME,
+        message TEXT
     );
     `
 	testDB.Exec(createTableQuery)
@@ -57,6 +87,23 @@ func TestUpdateLocation(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, 1, count)
+
+	// A fix taken earlier by the device keeps its own timestamp and accuracy
+	_, err = s.UpdateLocation(context.Background(), &pb.LocationUpdate{
+		Username:  "otheruser",
+		Latitude:  45.2671,
+		Longitude: 19.8335,
+		Timestamp: timestamppb.New(time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)),
+		Accuracy:  12.5,
+	})
+	assert.NoError(t, err)
+
+	var timestamp time.Time
+	var accuracy float64
+	err = testDB.QueryRow("SELECT timestamp, accuracy FROM location_history WHERE username = ?", "otheruser").Scan(&timestamp, &accuracy)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC), timestamp)
+	assert.Equal(t, 12.5, accuracy)
 }
 
 func TestGetDistance(t *testing.T) {
@@ -80,3 +127,131 @@ func TestGetDistance(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, resp.Distance, 0.0)
 }
+
+type changesStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	changes chan *pb.LocationChange
+}
+
+func (s *changesStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *changesStream) Send(change *pb.LocationChange) error {
+	s.changes <- change
+	return nil
+}
+
+func TestReadChanges(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	s := &server{db: testDB, changes: newChangeFeed()}
+	for _, username := range []string{"first", "second"} {
+		_, err := s.UpdateLocation(context.Background(), &pb.LocationUpdate{Username: username, Latitude: 45.2671, Longitude: 19.8335})
+		assert.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &changesStream{ctx: ctx, changes: make(chan *pb.LocationChange, 10)}
+	done := make(chan error)
+	go func() {
+		done <- s.ReadChanges(&pb.ChangesRequest{FromOffset: 1}, stream)
+	}()
+
+	// Replays everything after the offset...
+	change := <-stream.changes
+	assert.Equal(t, int64(2), change.Offset)
+	assert.Equal(t, "second", change.Username)
+
+	// ...and then tails new inserts.
+	_, err := s.UpdateLocation(context.Background(), &pb.LocationUpdate{Username: "third", Latitude: 45.2671, Longitude: 19.8335})
+	assert.NoError(t, err)
+	change = <-stream.changes
+	assert.Equal(t, int64(3), change.Offset)
+	assert.Equal(t, "third", change.Username)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Empty(t, stream.changes)
+}
+
+type trackStream struct {
+	grpc.ServerStream
+	points []*pb.TrackPoint
+}
+
+func (s *trackStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *trackStream) Send(point *pb.TrackPoint) error {
+	s.points = append(s.points, point)
+	return nil
+}
+
+func TestGetTrack(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+		"testuser", 45.2671, 19.8335, "2023-01-01 01:00:00")
+	testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+		"testuser", 45.2500, 19.8400, "2023-01-01 00:00:00")
+	testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+		"otheruser", 44.7866, 20.4489, "2023-01-01 00:30:00")
+	testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+		"testuser", 44.7866, 20.4489, "2023-01-01 03:00:00")
+
+	s := &server{db: testDB}
+	stream := &trackStream{}
+	err := s.GetTrack(&pb.TrackRequest{
+		Username:  "testuser",
+		StartTime: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+		EndTime:   timestamppb.New(time.Date(2023, time.January, 1, 2, 0, 0, 0, time.UTC)),
+	}, stream)
+
+	assert.NoError(t, err)
+	assert.Len(t, stream.points, 2)
+	assert.Equal(t, 45.2500, stream.points[0].Latitude)
+	assert.Equal(t, time.Date(2023, time.January, 1, 1, 0, 0, 0, time.UTC), stream.points[1].Timestamp.AsTime())
+
+	// Pages continue after the last row of the previous page.
+	start := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2023, time.January, 2, 0, 0, 0, 0, time.UTC)
+	page, err := s.queryTrack(context.Background(), "testuser", start, end, 0, 2)
+	assert.NoError(t, err)
+	assert.Len(t, page, 2)
+	page, err = s.queryTrack(context.Background(), "testuser", start, end, page[1].id, 2)
+	assert.NoError(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, 20.4489, page[0].longitude)
+
+	// Points of the same second resume by id.
+	testDB.Exec("INSERT INTO location_history (username, latitude, longitude, timestamp) VALUES (?, ?, ?, ?)",
+		"testuser", 44.7870, 20.4490, "2023-01-01 03:00:00")
+	stream = &trackStream{}
+	err = s.GetTrack(&pb.TrackRequest{
+		Username:  "testuser",
+		StartTime: timestamppb.New(start),
+		EndTime:   timestamppb.New(end),
+		AfterId:   page[0].id,
+	}, stream)
+	assert.NoError(t, err)
+	if assert.Len(t, stream.points, 1) {
+		assert.Equal(t, 44.7870, stream.points[0].Latitude)
+		assert.Greater(t, stream.points[0].Id, page[0].id)
+	}
+
+	// An id of another user or of no point cannot be resumed after.
+	for _, afterID := range []int64{3, 100} {
+		err = s.GetTrack(&pb.TrackRequest{
+			Username:  "testuser",
+			StartTime: timestamppb.New(start),
+			EndTime:   timestamppb.New(end),
+			AfterId:   afterID,
+		}, &trackStream{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), afterID)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeoutRecord is an entry of "locations" in Records.json. Older exports carry timestampMs
+// instead of timestamp.
+type takeoutRecord struct {
+	LatitudeE7  int64   `json:"latitudeE7"`
+	LongitudeE7 int64   `json:"longitudeE7"`
+	Accuracy    float64 `json:"accuracy"`
+	Timestamp   string  `json:"timestamp"`
+	TimestampMs string  `json:"timestampMs"`
+}
+
+type timelineLatLng struct {
+	LatLng string `json:"latLng"`
+}
+
+// timelineSegment is an entry of "semanticSegments" in Timeline.json: a visit, an activity or a
+// path of timed points.
+type timelineSegment struct {
+	StartTime    string `json:"startTime"`
+	EndTime      string `json:"endTime"`
+	TimelinePath []struct {
+		Point string `json:"point"`
+		Time  string `json:"time"`
+	} `json:"timelinePath"`
+	Visit *struct {
+		TopCandidate struct {
+			PlaceLocation timelineLatLng `json:"placeLocation"`
+		} `json:"topCandidate"`
+	} `json:"visit"`
+	Activity *struct {
+		Start timelineLatLng `json:"start"`
+		End   timelineLatLng `json:"end"`
+	} `json:"activity"`
+}
+
+// timelineSignal is an entry of "rawSignals" in Timeline.json. Only positions are imported.
+type timelineSignal struct {
+	Position *struct {
+		LatLng         string  `json:"LatLng"`
+		AccuracyMeters float64 `json:"accuracyMeters"`
+		Timestamp      string  `json:"timestamp"`
+	} `json:"position"`
+}
+
+// fromE7 converts a coordinate in degrees times 10^7. Some exports store coordinates past the
+// range of an int32 without wrapping them around.
+func fromE7(value int64, limit float64) float64 {
+	degrees := float64(value) / 1e7
+	if degrees > limit {
+		degrees = float64(value-1<<32) / 1e7
+	}
+	return degrees
+}
+
+func (r takeoutRecord) point() (importPoint, error) {
+	point := importPoint{
+		latitude:  fromE7(r.LatitudeE7, 90),
+		longitude: fromE7(r.LongitudeE7, 180),
+		accuracy:  r.Accuracy,
+	}
+	if err := validCoordinate(point.latitude, point.longitude); err != nil {
+		return point, err
+	}
+	switch {
+	case r.Timestamp != "":
+		t, err := parseImportTime(r.Timestamp)
+		if err != nil {
+			return point, err
+		}
+		point.timestamp = t
+	case r.TimestampMs != "":
+		ms, err := strconv.ParseInt(r.TimestampMs, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("invalid timestampMs %q", r.TimestampMs)
+		}
+		point.timestamp = time.UnixMilli(ms).UTC()
+	}
+	return point, nil
+}
+
+// parseLatLng reads the "45.2671°, 19.8335°" positions of Timeline.json, also written as
+// "geo:45.2671,19.8335" by some versions of the app.
+func parseLatLng(value string) (float64, float64, error) {
+	parts := strings.Split(strings.TrimPrefix(value, "geo:"), ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid position %q", value)
+	}
+	latitude, err1 := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(parts[0]), "°"), 64)
+	longitude, err2 := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(parts[1]), "°"), 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid position %q", value)
+	}
+	return latitude, longitude, validCoordinate(latitude, longitude)
+}
+
+func timelinePoint(latLng, timestamp string, accuracy float64) (importPoint, error) {
+	var point importPoint
+	var err error
+	if point.latitude, point.longitude, err = parseLatLng(latLng); err != nil {
+		return point, err
+	}
+	if timestamp != "" {
+		if point.timestamp, err = parseImportTime(timestamp); err != nil {
+			return point, err
+		}
+	}
+	point.accuracy = accuracy
+	return point, nil
+}
+
+// points returns the readable positions of the segment and how many it had to leave out.
+func (s timelineSegment) points() ([]importPoint, int) {
+	type position struct{ latLng, time string }
+	var positions []position
+	for _, p := range s.TimelinePath {
+		positions = append(positions, position{p.Point, p.Time})
+	}
+	if s.Visit != nil && s.Visit.TopCandidate.PlaceLocation.LatLng != "" {
+		positions = append(positions, position{s.Visit.TopCandidate.PlaceLocation.LatLng, s.StartTime})
+	}
+	if s.Activity != nil {
+		if s.Activity.Start.LatLng != "" {
+			positions = append(positions, position{s.Activity.Start.LatLng, s.StartTime})
+		}
+		if s.Activity.End.LatLng != "" {
+			positions = append(positions, position{s.Activity.End.LatLng, s.EndTime})
+		}
+	}
+
+	points := make([]importPoint, 0, len(positions))
+	skipped := 0
+	for _, p := range positions {
+		point, err := timelinePoint(p.latLng, p.time, 0)
+		if err != nil {
+			skipped++
+			continue
+		}
+		points = append(points, point)
+	}
+	return points, skipped
+}
+
+// decodeArray calls each once for every element of the JSON array that d is positioned at. each
+// decodes the element itself, so only one element is held in memory at a time.
+func decodeArray(d *json.Decoder, each func() error) error {
+	if token, err := d.Token(); err != nil {
+		return err
+	} else if token != json.Delim('[') {
+		return fmt.Errorf("expected an array, got %v", token)
+	}
+	for d.More() {
+		if err := each(); err != nil {
+			return err
+		}
+	}
+	_, err := d.Token()
+	return err
+}
+
+// readTakeout streams the positions of a Google Takeout Records.json or Timeline.json into the
+// importer. Positions that cannot be read are counted as skipped instead of failing a file of many
+// years; broken JSON fails the import.
+func readTakeout(r io.Reader, importer *trackImporter) error {
+	d := json.NewDecoder(r)
+	if token, err := d.Token(); err != nil {
+		return err
+	} else if token != json.Delim('{') {
+		return errors.New("file is not a Google Takeout location history")
+	}
+
+	addPoints := func(points []importPoint, skipped int) error {
+		importer.summary.Skipped += int64(skipped)
+		for _, point := range points {
+			if err := importer.add(point); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	addPoint := func(point importPoint, err error) error {
+		if err != nil {
+			return addPoints(nil, 1)
+		}
+		return addPoints([]importPoint{point}, 0)
+	}
+
+	found := false
+	for d.More() {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case "locations":
+			err = decodeArray(d, func() error {
+				var record takeoutRecord
+				if err := d.Decode(&record); err != nil {
+					return err
+				}
+				return addPoint(record.point())
+			})
+		case "semanticSegments":
+			err = decodeArray(d, func() error {
+				var segment timelineSegment
+				if err := d.Decode(&segment); err != nil {
+					return err
+				}
+				return addPoints(segment.points())
+			})
+		case "rawSignals":
+			err = decodeArray(d, func() error {
+				var signal timelineSignal
+				if err := d.Decode(&signal); err != nil {
+					return err
+				}
+				if signal.Position == nil {
+					return nil
+				}
+				return addPoint(timelinePoint(signal.Position.LatLng, signal.Position.Timestamp, signal.Position.AccuracyMeters))
+			})
+		default:
+			var skip json.RawMessage
+			if err := d.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return errors.New("file has no locations, semanticSegments or rawSignals")
+	}
+	return nil
+}
+
+// progressReader reports how much of a file has been read at most once per interval.
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	size     int64
+	interval time.Duration
+	next     time.Time
+	report   func(read, size int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if now := time.Now(); now.After(p.next) {
+		p.next = now.Add(p.interval)
+		p.report(p.read, p.size)
+	}
+	return n, err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRecords = `{
+  "locations": [{
+    "latitudeE7": 452671000,
+    "longitudeE7": 198335000,
+    "accuracy": 12,
+    "source": "WIFI",
+    "timestamp": "2024-07-01T12:00:00.123Z"
+  }, {
+    "latitudeE7": 452600000,
+    "longitudeE7": 198400000,
+    "accuracy": 30,
+    "timestampMs": "1719835500000",
+    "activity": [{"timestamp": "2024-07-01T12:05:00Z", "activity": [{"type": "STILL", "confidence": 100}]}]
+  }, {
+    "latitudeE7": 4294000000,
+    "longitudeE7": 198400000,
+    "timestamp": "2024-07-01T12:06:00Z"
+  }, {
+    "latitudeE7": 452600000,
+    "longitudeE7": 198400000
+  }]
+}`
+
+const testTimeline = `{
+  "semanticSegments": [{
+    "startTime": "2024-07-01T10:00:00.000+02:00",
+    "endTime": "2024-07-01T11:00:00.000+02:00",
+    "timelinePath": [
+      {"point": "45.2671°, 19.8335°", "time": "2024-07-01T10:00:00.000+02:00"},
+      {"point": "45.2600°, 19.8400°", "time": "2024-07-01T10:30:00.000+02:00"}
+    ]
+  }, {
+    "startTime": "2024-07-01T11:00:00.000+02:00",
+    "endTime": "2024-07-01T12:00:00.000+02:00",
+    "visit": {"hierarchyLevel": 0, "topCandidate": {"placeId": "abc", "placeLocation": {"latLng": "45.2550°, 19.8450°"}}}
+  }, {
+    "startTime": "2024-07-01T12:00:00.000+02:00",
+    "endTime": "2024-07-01T12:30:00.000+02:00",
+    "activity": {"start": {"latLng": "geo:45.2550,19.8450"}, "end": {"latLng": "north, east"}}
+  }, {
+    "startTime": "2024-07-01T12:30:00.000+02:00",
+    "endTime": "2024-07-01T12:40:00.000+02:00",
+    "timelinePath": [
+      {"point": "95.0000°, 19.8400°", "time": "2024-07-01T12:30:00.000+02:00"},
+      {"point": "45.2500°, 19.8500°", "time": "noon"}
+    ]
+  }],
+  "rawSignals": [
+    {"position": {"LatLng": "45.2500°, 19.8500°", "accuracyMeters": 8, "timestamp": "2024-07-01T12:45:00.000+02:00"}},
+    {"wifiScan": {"deliveryTime": "2024-07-01T12:45:00.000+02:00"}}
+  ],
+  "userLocationProfile": {"frequentPlaces": [{"placeLocation": "45.2550°, 19.8450°"}]}
+}`
+
+func TestReadTakeout(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	importer, err := newTrackImporter(context.Background(), testDB, "testuser", false)
+	assert.NoError(t, err)
+	assert.NoError(t, readTakeout(strings.NewReader(testRecords), importer))
+	summary, err := importer.finish()
+	assert.NoError(t, err)
+	// The wrapped latitude of the third record is -0.0967296 and it is imported; the last record
+	// has no time.
+	assert.Equal(t, int64(3), summary.Points)
+	assert.Equal(t, int64(1), summary.Skipped)
+	assert.Equal(t, time.Date(2024, time.July, 1, 12, 0, 0, 123000000, time.UTC), summary.First.AsTime())
+
+	var latitude, longitude, accuracy float64
+	testDB.QueryRow("SELECT latitude, longitude, accuracy FROM location_history WHERE timestamp = ?", "2024-07-01 12:05:00").
+		Scan(&latitude, &longitude, &accuracy)
+	assert.Equal(t, []float64{45.26, 19.84, 30}, []float64{latitude, longitude, accuracy})
+
+	importer, err = newTrackImporter(context.Background(), testDB, "testuser", true)
+	assert.NoError(t, err)
+	assert.NoError(t, readTakeout(strings.NewReader(testTimeline), importer))
+	summary, err = importer.finish()
+	assert.NoError(t, err)
+	// The unreadable end of the activity and both points of the last path are skipped; the start
+	// of the activity is imported.
+	assert.Equal(t, int64(5), summary.Points)
+	assert.Equal(t, int64(3), summary.Skipped)
+	assert.Equal(t, time.Date(2024, time.July, 1, 8, 0, 0, 0, time.UTC), summary.First.AsTime())
+	assert.Equal(t, time.Date(2024, time.July, 1, 10, 45, 0, 0, time.UTC), summary.Last.AsTime())
+
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history").Scan(&count)
+	assert.Equal(t, 3, count)
+
+	for _, data := range []string{`[]`, `{"userLocationProfile": {}}`, `{"locations": [{"latitudeE7": 1,`} {
+		importer, err = newTrackImporter(context.Background(), testDB, "testuser", true)
+		assert.NoError(t, err)
+		assert.Error(t, readTakeout(strings.NewReader(data), importer), data)
+		importer.abort()
+	}
+}
+
+func TestBatchedTrackImporter(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	point := func(minute int) importPoint {
+		return importPoint{latitude: 45.2671, longitude: 19.8335, timestamp: start.Add(time.Duration(minute) * time.Minute)}
+	}
+	// The last point repeats the first one, two batches earlier.
+	points := []importPoint{point(0), point(1), point(2), point(3), point(0)}
+
+	// A dry run counts duplicates across batches and stores nothing.
+	importer, err := newBatchedTrackImporter(context.Background(), testDB, "testuser", true)
+	assert.NoError(t, err)
+	importer.batchSize = 2
+	for _, p := range points {
+		assert.NoError(t, importer.add(p))
+	}
+	summary, err := importer.finish()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), summary.Points)
+	assert.Equal(t, int64(1), summary.Duplicates)
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history").Scan(&count)
+	assert.Equal(t, 0, count)
+
+	// A failed import keeps the batches committed before the failure.
+	importer, err = newBatchedTrackImporter(context.Background(), testDB, "testuser", false)
+	assert.NoError(t, err)
+	importer.batchSize = 2
+	for _, p := range points[:3] {
+		assert.NoError(t, importer.add(p))
+	}
+	importer.abort()
+	assert.Equal(t, int64(2), importer.committed)
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history").Scan(&count)
+	assert.Equal(t, 2, count)
+
+	importer, err = newBatchedTrackImporter(context.Background(), testDB, "testuser", false)
+	assert.NoError(t, err)
+	importer.batchSize = 2
+	for _, p := range points {
+		assert.NoError(t, importer.add(p))
+	}
+	summary, err = importer.finish()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Duplicates)
+	assert.Equal(t, start.Add(3*time.Minute), summary.Last.AsTime())
+	testDB.QueryRow("SELECT COUNT(*) FROM location_history").Scan(&count)
+	assert.Equal(t, 4, count)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// Tracks are read in pages so a slow consumer does not keep a read open on the table.
+const trackPageSize = 500
+
+// timestampLayout matches the format SQLite's CURRENT_TIMESTAMP writes into location_history,
+// so bound times compare correctly against stored ones.
+const timestampLayout = "2006-01-02 15:04:05"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+type trackPoint struct {
+	id        int64
+	latitude  float64
+	longitude float64
+	timestamp time.Time
+}
+
+// GetTrack streams the points a user reported between start_time and end_time, oldest first,
+// resuming after the point after_id when it is set. An after_id that is not a point of the user
+// is rejected, as there is nothing to resume after.
+func (s *server) GetTrack(req *pb.TrackRequest, stream pb.LocationService_GetTrackServer) error {
+	afterID := req.AfterId
+	if afterID != 0 {
+		var found bool
+		err := s.db.QueryRowContext(stream.Context(), "SELECT EXISTS (SELECT 1 FROM location_history WHERE id = ? AND username = ?)",
+			afterID, req.Username).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return status.Errorf(codes.InvalidArgument, "point %d is not part of the track of %s", afterID, req.Username)
+		}
+	}
+	for {
+		points, err := s.queryTrack(stream.Context(), req.Username, req.StartTime.AsTime(), req.EndTime.AsTime(), afterID, trackPageSize)
+		if err != nil {
+			return err
+		}
+		for _, point := range points {
+			if err := stream.Send(&pb.TrackPoint{
+				Latitude:  point.latitude,
+				Longitude: point.longitude,
+				Timestamp: timestamppb.New(point.timestamp),
+				Id:        point.id,
+			}); err != nil {
+				return err
+			}
+			afterID = point.id
+		}
+		if len(points) < trackPageSize {
+			return nil
+		}
+	}
+}
+
+// queryTrack returns up to limit points ordered by (timestamp, id) that come after the row afterID.
+func (s *server) queryTrack(ctx context.Context, username string, start, end time.Time, afterID int64, limit int) ([]trackPoint, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, latitude, longitude, timestamp FROM location_history
+		WHERE username = ? AND timestamp BETWEEN ? AND ?
+		AND (? = 0 OR (timestamp, id) > (SELECT timestamp, id FROM location_history WHERE id = ?))
+		ORDER BY timestamp, id LIMIT ?`,
+		username, formatTimestamp(start), formatTimestamp(end), afterID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []trackPoint
+	for rows.Next() {
+		var point trackPoint
+		if err := rows.Scan(&point.id, &point.latitude, &point.longitude, &point.timestamp); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+type AlertRuleRequest struct {
+	Name              string  `json:"name" binding:"required,max=64"`
+	Kind              string  `json:"kind" binding:"required,oneof=speed inactivity curfew"`
+	Username          string  `json:"username,omitempty" binding:"omitempty,min=4,max=16,alphanum"`
+	MaxSpeed          float64 `json:"max_speed,omitempty" binding:"gte=0"`
+	InactivityMinutes int64   `json:"inactivity_minutes,omitempty" binding:"gte=0"`
+	CurfewStart       string  `json:"curfew_start,omitempty"`
+	CurfewEnd         string  `json:"curfew_end,omitempty"`
+}
+
+type AlertRule struct {
+	ID int64 `json:"id"`
+	AlertRuleRequest
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AlertsRequest struct {
+	RuleID    int64     `form:"rule_id" binding:"gte=0"`
+	Username  string    `form:"username" binding:"omitempty,min=4,max=16,alphanum"`
+	StartTime time.Time `form:"start_time"`
+	EndTime   time.Time `form:"end_time"`
+}
+
+type Alert struct {
+	ID        int64     `json:"id"`
+	RuleID    int64     `json:"rule_id"`
+	Username  string    `json:"username"`
+	FixID     int64     `json:"fix_id"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	FixTime   time.Time `json:"fix_time"`
+	CreatedAt time.Time `json:"created_at"`
+	Message   string    `json:"message"`
+}
+
+func alertRuleFromProto(rule *pb.AlertRule) AlertRule {
+	return AlertRule{
+		ID: rule.Id,
+		AlertRuleRequest: AlertRuleRequest{
+			Name:              rule.Name,
+			Kind:              rule.Kind,
+			Username:          rule.Username,
+			MaxSpeed:          rule.MaxSpeed,
+			InactivityMinutes: rule.InactivityMinutes,
+			CurfewStart:       rule.CurfewStart,
+			CurfewEnd:         rule.CurfewEnd,
+		},
+		CreatedAt: rule.CreatedAt.AsTime(),
+	}
+}
+
+func alertFromProto(alert *pb.Alert) Alert {
+	return Alert{
+		ID:        alert.Id,
+		RuleID:    alert.RuleId,
+		Username:  alert.Username,
+		FixID:     alert.FixId,
+		Latitude:  alert.Latitude,
+		Longitude: alert.Longitude,
+		FixTime:   alert.FixTime.AsTime(),
+		CreatedAt: alert.CreatedAt.AsTime(),
+		Message:   alert.Message,
+	}
+}
+
+// respondHistoryError passes validation and lookup failures from the location history
+// microservice through to the client and reports anything else as an internal error.
+func respondHistoryError(c *gin.Context, err error, action string) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		c.JSON(http.StatusBadRequest, gin.H{"error": status.Convert(err).Message()})
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	default:
+		log.Printf("Failed to %s in microservice: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action + " in microservice"})
+	}
+}
+
+// withLocationHistory connects to the location history microservice for the duration of fn.
+func withLocationHistory(c *gin.Context, grpcHostname string, fn func(client pb.LocationServiceClient)) {
+	conn, err := dialLocationHistory(grpcHostname)
+	if err != nil {
+		log.Printf("Failed to connect to location history microservice: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to location history microservice"})
+		return
+	}
+	defer conn.Close()
+
+	fn(pb.NewLocationServiceClient(conn))
+}
+
+func CreateAlertRuleHandler(c *gin.Context, grpcHostname string) {
+	var req AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		rule, err := client.CreateAlertRule(context.Background(), &pb.AlertRule{
+			Name:              req.Name,
+			Kind:              req.Kind,
+			Username:          req.Username,
+			MaxSpeed:          req.MaxSpeed,
+			InactivityMinutes: req.InactivityMinutes,
+			CurfewStart:       req.CurfewStart,
+			CurfewEnd:         req.CurfewEnd,
+		})
+		if err != nil {
+			respondHistoryError(c, err, "create alert rule")
+			return
+		}
+		c.JSON(http.StatusCreated, alertRuleFromProto(rule))
+	})
+}
+
+func ListAlertRulesHandler(c *gin.Context, grpcHostname string) {
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		res, err := client.ListAlertRules(context.Background(), &emptypb.Empty{})
+		if err != nil {
+			respondHistoryError(c, err, "list alert rules")
+			return
+		}
+		rules := []AlertRule{}
+		for _, rule := range res.Rules {
+			rules = append(rules, alertRuleFromProto(rule))
+		}
+		c.JSON(http.StatusOK, gin.H{"rules": rules})
+	})
+}
+
+func DeleteAlertRuleHandler(c *gin.Context, grpcHostname string) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		if _, err := client.DeleteAlertRule(context.Background(), &pb.AlertRuleId{Id: uri.ID}); err != nil {
+			respondHistoryError(c, err, "delete alert rule")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "alert rule deleted"})
+	})
+}
+
+func ListAlertsHandler(c *gin.Context, grpcHostname string) {
+	var req AlertsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Set EndTime to current time if not provided
+	if req.EndTime.IsZero() {
+		req.EndTime = time.Now()
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		res, err := client.ListAlerts(context.Background(), &pb.AlertsRequest{
+			RuleId:    req.RuleID,
+			Username:  req.Username,
+			StartTime: timestamppb.New(req.StartTime),
+			EndTime:   timestamppb.New(req.EndTime),
+		})
+		if err != nil {
+			respondHistoryError(c, err, "list alerts")
+			return
+		}
+		alerts := []Alert{}
+		for _, alert := range res.Alerts {
+			alerts = append(alerts, alertFromProto(alert))
+		}
+		c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+	})
+}
+
+// alertPollInterval is how often new alerts are read from the location history microservice
+// for the webhooks.
+const alertPollInterval = 5 * time.Second
+
+// alertsCursor names the webhook_cursors row holding the id of the last alert forwarded.
+const alertsCursor = "alerts"
+
+// forwardAlerts queues the alerts the location history microservice raises for the webhooks.
+func forwardAlerts(grpcHostname string, db *sql.DB) {
+	ticker := time.NewTicker(alertPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := forwardNewAlerts(grpcHostname, db, time.Now()); err != nil {
+			log.Printf("Failed to forward alerts to webhooks: %v", err)
+		}
+	}
+}
+
+// forwardNewAlerts queues the alerts raised after the last one forwarded as alert.triggered
+// events. The cursor is stored with the deliveries, so a restart neither repeats nor misses
+// alerts; the first run starts after the newest alert and skips the ones raised before.
+func forwardNewAlerts(grpcHostname string, db *sql.DB, now time.Time) error {
+	var cursor int64
+	err := db.QueryRow("SELECT position FROM webhook_cursors WHERE name = ?", alertsCursor).Scan(&cursor)
+	firstRun := err == sql.ErrNoRows
+	if err != nil && !firstRun {
+		return err
+	}
+
+	conn, err := dialLocationHistory(grpcHostname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := pb.NewLocationServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	if firstRun {
+		last, err := client.LastAlertId(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO webhook_cursors (name, position) VALUES (?, ?)", alertsCursor, last.Id)
+		return err
+	}
+
+	res, err := client.ListAlerts(ctx, &pb.AlertsRequest{AfterId: cursor})
+	if err != nil {
+		return err
+	}
+	if len(res.Alerts) == 0 {
+		return nil
+	}
+
+	last := cursor
+	var events []webhookEvent
+	for _, alert := range res.Alerts {
+		events = append(events, webhookEvent{Type: EventAlertTriggered, Usernames: []string{alert.Username}, Data: alertFromProto(alert)})
+		last = max(last, alert.Id)
+	}
+	subscriptions, err := listWebhooks(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := queueWebhookEvents(tx, subscriptions, events, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE webhook_cursors SET position = ? WHERE name = ?", last, alertsCursor); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	webhooks.notify()
+	return nil
+}
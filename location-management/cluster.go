@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// Users are clustered within clusterRadius pixels of each other, on 512 pixel tiles as in
+	// supercluster, at zoom levels up to clusterMaxZoom; above it every user is shown on its own.
+	clusterRadius  = 40
+	clusterExtent  = 512
+	clusterMaxZoom = 16
+)
+
+// SearchCluster is a group of users close together at the requested zoom level. ExpansionZoom is
+// the zoom level at which the cluster splits into smaller clusters or users.
+type SearchCluster struct {
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	Count         int     `json:"count"`
+	ExpansionZoom int     `json:"expansion_zoom"`
+}
+
+// clusterNode is a user or a cluster at one zoom level, positioned in Mercator radians.
+type clusterNode struct {
+	x, y  float64
+	count int
+	// user is set for nodes of a single user.
+	user *UserLocation
+	// zoom is the level the cluster was formed at.
+	zoom int
+}
+
+// clusterUsers groups users that are close together at the zoom level, building the levels from
+// clusterMaxZoom down so that clusters nest across zoom levels. It returns the clusters and the
+// users that are not part of one, both in the order of users.
+func clusterUsers(users []UserLocation, zoom int) ([]SearchCluster, []UserLocation) {
+	if zoom > clusterMaxZoom {
+		return nil, users
+	}
+	nodes := make([]*clusterNode, len(users))
+	for i := range users {
+		p := mercator(users[i].Latitude, users[i].Longitude)
+		nodes[i] = &clusterNode{x: p.x, y: p.y, count: 1, user: &users[i]}
+	}
+	for z := clusterMaxZoom; z >= zoom; z-- {
+		nodes = clusterLevel(nodes, z)
+	}
+
+	var clusters []SearchCluster
+	var single []UserLocation
+	for _, node := range nodes {
+		if node.user != nil {
+			single = append(single, *node.user)
+			continue
+		}
+		clusters = append(clusters, SearchCluster{
+			Latitude:      (2*math.Atan(math.Exp(node.y)) - math.Pi/2) * 180 / math.Pi,
+			Longitude:     node.x * 180 / math.Pi,
+			Count:         node.count,
+			ExpansionZoom: node.zoom + 1,
+		})
+	}
+	return clusters, single
+}
+
+// clusterLevel merges every node with the unvisited nodes within the cluster radius at zoom z,
+// into one at their weighted centroid. Nodes are bucketed in a grid of the radius, so only the
+// neighbouring cells have to be searched.
+func clusterLevel(nodes []*clusterNode, z int) []*clusterNode {
+	radius := clusterRadius / (clusterExtent * math.Exp2(float64(z))) * 2 * math.Pi
+	type cellKey struct{ x, y int64 }
+	cellOf := func(n *clusterNode) cellKey {
+		return cellKey{int64(math.Floor(n.x / radius)), int64(math.Floor(n.y / radius))}
+	}
+	grid := map[cellKey][]int{}
+	for i, n := range nodes {
+		k := cellOf(n)
+		grid[k] = append(grid[k], i)
+	}
+
+	visited := make([]bool, len(nodes))
+	next := make([]*clusterNode, 0, len(nodes))
+	for i, n := range nodes {
+		if visited[i] {
+			continue
+		}
+		visited[i] = true
+		merged := &clusterNode{x: n.x * float64(n.count), y: n.y * float64(n.count), count: n.count, zoom: z}
+		k := cellOf(n)
+		for dx := int64(-1); dx <= 1; dx++ {
+			for dy := int64(-1); dy <= 1; dy++ {
+				for _, j := range grid[cellKey{k.x + dx, k.y + dy}] {
+					other := nodes[j]
+					if visited[j] || math.Hypot(other.x-n.x, other.y-n.y) > radius {
+						continue
+					}
+					visited[j] = true
+					merged.x += other.x * float64(other.count)
+					merged.y += other.y * float64(other.count)
+					merged.count += other.count
+				}
+			}
+		}
+		if merged.count == n.count {
+			next = append(next, n)
+			continue
+		}
+		merged.x /= float64(merged.count)
+		merged.y /= float64(merged.count)
+		next = append(next, merged)
+	}
+	return next
+}
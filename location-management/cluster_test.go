@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func clusterTestUsers() []UserLocation {
+	var users []UserLocation
+	// A group of users in the centre of Novi Sad, about 100 m apart, and one in Belgrade.
+	for i := 0; i < 5; i++ {
+		users = append(users, UserLocation{Username: fmt.Sprintf("user%d", i), Latitude: 45.2551 + float64(i)*0.001, Longitude: 19.8452})
+	}
+	return append(users, UserLocation{Username: "belgrade", Latitude: 44.8125, Longitude: 20.4612})
+}
+
+func TestClusterUsers(t *testing.T) {
+	users := clusterTestUsers()
+
+	clusters, single := clusterUsers(users, 8)
+	if assert.Len(t, clusters, 1) {
+		assert.Equal(t, 5, clusters[0].Count)
+		assert.InDelta(t, 45.2571, clusters[0].Latitude, 1e-4)
+		assert.InDelta(t, 19.8452, clusters[0].Longitude, 1e-9)
+		assert.Greater(t, clusters[0].ExpansionZoom, 8)
+
+		// At the expansion zoom the cluster splits.
+		expanded, expandedSingle := clusterUsers(users, clusters[0].ExpansionZoom)
+		assert.Greater(t, len(expanded)+len(expandedSingle), 2)
+	}
+	assert.Equal(t, []UserLocation{users[5]}, single)
+
+	// Everything is one cluster when zoomed out to the world.
+	clusters, single = clusterUsers(users, 0)
+	assert.Len(t, clusters, 1)
+	assert.Empty(t, single)
+	assert.Equal(t, 6, clusters[0].Count)
+
+	// Users are never clustered above clusterMaxZoom.
+	clusters, single = clusterUsers(users, clusterMaxZoom+1)
+	assert.Empty(t, clusters)
+	assert.Equal(t, users, single)
+}
+
+func TestSearchUsersCluster(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	for _, user := range clusterTestUsers() {
+		_, err := testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)",
+			user.Username, user.Latitude, user.Longitude)
+		assert.NoError(t, err)
+	}
+
+	r := gin.Default()
+	r.GET("/api/v1/location/search", func(c *gin.Context) {
+		SearchUsersHandler(c, testDB)
+	})
+	search := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/location/search?latitude=45.2551&longitude=19.8452&radius=100&"+query, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := search("page=1&size=10&cluster=true&zoom=8")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, 1, res.TotalUsers)
+	assert.Equal(t, 5, res.ClusteredUsers)
+	assert.Equal(t, 1, res.TotalPages)
+	assert.Len(t, res.Clusters, 1)
+	if assert.Len(t, res.Users, 1) {
+		assert.Equal(t, "belgrade", res.Users[0].Username)
+	}
+
+	// Pages past the users outside clusters are empty, and clusters only come with page 1.
+	w = search("page=2&size=5&cluster=true&zoom=0")
+	assert.Equal(t, http.StatusOK, w.Code)
+	res = SearchResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Empty(t, res.Users)
+	assert.Empty(t, res.Clusters)
+	assert.Equal(t, 0, res.TotalUsers)
+	assert.Equal(t, 6, res.ClusteredUsers)
+
+	res = SearchResponse{}
+	assert.NoError(t, json.Unmarshal(search("page=1&size=10&cluster=true&zoom=18").Body.Bytes(), &res))
+	assert.Empty(t, res.Clusters)
+	assert.Len(t, res.Users, 6)
+
+	assert.Equal(t, http.StatusBadRequest, search("page=1&size=10&cluster=true").Code)
+	assert.Equal(t, http.StatusBadRequest, search("page=1&size=10&cluster=true&zoom=23").Code)
+}
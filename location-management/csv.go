@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/vzivanovic/GOLANG_FOR_STUDENTS/db"
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const (
+	// csvBatchSize bounds the rows sent to the location history microservice in one message.
+	csvBatchSize = 5000
+	// maxCSVErrors bounds the row errors listed in a report; the rest are only counted.
+	maxCSVErrors = 1000
+)
+
+// csvFields are the fields a CSV column can be mapped to.
+var csvFields = []string{"username", "latitude", "longitude", "timestamp", "accuracy"}
+
+// CSVImportRequest describes the layout of a CSV file. Columns maps fields to columns as
+// "latitude:lat,longitude:lng", by header name or by 1-based position; unmapped fields use the
+// column named after them. Username sets the user of every row of a file without a username column.
+type CSVImportRequest struct {
+	Delimiter  string `form:"delimiter" binding:"omitempty,max=3"`
+	TimeFormat string `form:"time_format"`
+	Columns    string `form:"columns"`
+	Header     bool   `form:"header,default=true"`
+	Username   string `form:"username" binding:"omitempty,min=4,max=16,alphanum"`
+	DryRun     bool   `form:"dry_run"`
+}
+
+type CSVRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type CSVImportReport struct {
+	Rows       int `json:"rows"`
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	// CurrentLocations counts the users whose current position was set to their newest row.
+	CurrentLocations int           `json:"current_locations"`
+	ErrorCount       int           `json:"error_count"`
+	Errors           []CSVRowError `json:"errors"`
+	DryRun           bool          `json:"dry_run"`
+	// CommittedRows and CommittedLine are set when an import fails part way: the first
+	// CommittedRows valid rows, up to line CommittedLine of the file, are stored in the history.
+	CommittedRows int `json:"committed_rows,omitempty"`
+	CommittedLine int `json:"committed_line,omitempty"`
+
+	// lines holds the file line of every row returned by parseCSVImport.
+	lines []int
+}
+
+func (r *CSVImportReport) addError(line int, err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxCSVErrors {
+		r.Errors = append(r.Errors, CSVRowError{Line: line, Error: err.Error()})
+	}
+}
+
+// csvLayout is a CSVImportRequest resolved against the header of a file.
+type csvLayout struct {
+	columns    map[string]int
+	timeFormat string
+	username   string
+}
+
+func parseCSVDelimiter(value string) (rune, error) {
+	switch value {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	runes := []rune(value)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q", value)
+	}
+	return runes[0], nil
+}
+
+// newCSVLayout resolves the column of every field. header is nil for files without a header row.
+func newCSVLayout(req CSVImportRequest, header []string) (csvLayout, error) {
+	layout := csvLayout{columns: map[string]int{}, timeFormat: req.TimeFormat, username: req.Username}
+	mapping := map[string]string{}
+	for _, entry := range strings.Split(req.Columns, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		field, column, ok := strings.Cut(entry, ":")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || !containsString(csvFields, field) {
+			return layout, fmt.Errorf("invalid column mapping %q, expected field:column with a field of %s", entry, strings.Join(csvFields, ", "))
+		}
+		mapping[field] = strings.TrimSpace(column)
+	}
+
+	for _, field := range csvFields {
+		column, mapped := mapping[field]
+		if !mapped {
+			column = field
+		}
+		if n, err := strconv.Atoi(column); err == nil {
+			if n < 1 {
+				return layout, fmt.Errorf("invalid column %d for %s", n, field)
+			}
+			layout.columns[field] = n - 1
+			continue
+		}
+		index := -1
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			if mapped {
+				return layout, fmt.Errorf("column %q for %s not found", column, field)
+			}
+			continue
+		}
+		layout.columns[field] = index
+	}
+
+	if _, ok := layout.columns["username"]; ok && layout.username != "" {
+		return layout, errors.New("username is given both as a parameter and as a column")
+	}
+	if _, ok := layout.columns["username"]; !ok && layout.username == "" {
+		return layout, errors.New("the file has no username column and no username was given")
+	}
+	for _, field := range []string{"latitude", "longitude", "timestamp"} {
+		if _, ok := layout.columns[field]; !ok {
+			return layout, fmt.Errorf("the file has no %s column", field)
+		}
+	}
+	return layout, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCSVTime reads a timestamp in format: "rfc3339" (the default), "unix", "unix_ms" or a Go
+// time layout such as "2006-01-02 15:04:05". Times without a zone are UTC.
+func parseCSVTime(value, format string) (time.Time, error) {
+	switch format {
+	case "", "rfc3339":
+		return time.Parse(time.RFC3339, value)
+	case "unix", "unix_ms":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s time %q", format, value)
+		}
+		if format == "unix" {
+			return time.Unix(n, 0).UTC(), nil
+		}
+		return time.UnixMilli(n).UTC(), nil
+	}
+	return time.Parse(format, value)
+}
+
+// row turns a record into a validated update.
+func (l csvLayout) row(record []string, now time.Time) (LocationUpdateRequest, error) {
+	req := LocationUpdateRequest{Username: l.username}
+	field := func(name string) (string, bool, error) {
+		index, ok := l.columns[name]
+		if !ok {
+			return "", false, nil
+		}
+		if index >= len(record) {
+			return "", false, fmt.Errorf("row has no column %d for %s", index+1, name)
+		}
+		value := strings.TrimSpace(record[index])
+		return value, value != "", nil
+	}
+
+	if value, ok, err := field("username"); err != nil {
+		return req, err
+	} else if ok {
+		req.Username = value
+	}
+	for _, f := range []struct {
+		name  string
+		value *float64
+	}{{"latitude", &req.Latitude}, {"longitude", &req.Longitude}, {"accuracy", &req.Accuracy}} {
+		value, ok, err := field(f.name)
+		if err != nil {
+			return req, err
+		}
+		if !ok {
+			continue
+		}
+		if *f.value, err = strconv.ParseFloat(value, 64); err != nil {
+			return req, fmt.Errorf("invalid %s %q", f.name, value)
+		}
+	}
+	value, ok, err := field("timestamp")
+	if err != nil {
+		return req, err
+	}
+	if !ok {
+		return req, errors.New("timestamp is required")
+	}
+	if req.Timestamp, err = parseCSVTime(value, l.timeFormat); err != nil {
+		return req, fmt.Errorf("invalid timestamp %q", value)
+	}
+	if req.Timestamp.After(now) {
+		return req, errors.New("timestamp is in the future")
+	}
+
+	return req, binding.Validator.ValidateStruct(req)
+}
+
+// parseCSVImport reads every row of a CSV file. Rows that cannot be read or fail the validation of
+// a location update are reported with their line number and left out.
+func parseCSVImport(r io.Reader, req CSVImportRequest, now time.Time) ([]LocationUpdateRequest, *CSVImportReport, error) {
+	delimiter, err := parseCSVDelimiter(req.Delimiter)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+
+	var header []string
+	if req.Header {
+		if header, err = reader.Read(); err != nil {
+			return nil, nil, fmt.Errorf("failed to read the header: %w", err)
+		}
+		// Spreadsheet exports often start with a byte order mark.
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	layout, err := newCSVLayout(req, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := &CSVImportReport{Errors: []CSVRowError{}, DryRun: req.DryRun}
+	var rows []LocationUpdateRequest
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		report.Rows++
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.addError(parseErr.StartLine, parseErr.Err)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		row, err := layout.row(record, now)
+		if err != nil {
+			report.addError(line, err)
+			continue
+		}
+		rows = append(rows, row)
+		report.lines = append(report.lines, line)
+	}
+	return rows, report, nil
+}
+
+// csvRowKey identifies the rows the location history treats as the same position.
+type csvRowKey struct {
+	username            string
+	latitude, longitude float64
+	timestamp           int64
+}
+
+// dropRepeatedRows leaves out the rows that repeat an earlier row of the file and counts them as
+// duplicates. The history finds duplicates within a batch itself, but a dry run does not store
+// its batches, so a repeat in a later batch would otherwise be counted as imported.
+func dropRepeatedRows(rows []LocationUpdateRequest, report *CSVImportReport) []LocationUpdateRequest {
+	seen := map[csvRowKey]bool{}
+	var unique []LocationUpdateRequest
+	var lines []int
+	for i, row := range rows {
+		key := csvRowKey{row.Username, row.Latitude, row.Longitude, row.Timestamp.UnixNano()}
+		if seen[key] {
+			report.Duplicates++
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, row)
+		if i < len(report.lines) {
+			lines = append(lines, report.lines[i])
+		}
+	}
+	report.lines = lines
+	return unique
+}
+
+// storeCSVImport stores the rows in the location history and moves the current position of every
+// user to their newest row, unless a newer one is already stored. Imported rows are history: they
+// are not published and do not trigger geofences, proximity rules or webhooks.
+//
+// Every batch is committed on its own, so the live service keeps working during a long import.
+// When a batch fails, the report says which rows the batches before it stored; importing the file
+// again skips those as duplicates.
+func storeCSVImport(ctx context.Context, client pb.LocationServiceClient, db *sql.DB, rows []LocationUpdateRequest, report *CSVImportReport) error {
+	rows = dropRepeatedRows(rows, report)
+	for start := 0; start < len(rows); start += csvBatchSize {
+		end := min(start+csvBatchSize, len(rows))
+		batch := rows[start:end]
+		req := &pb.ImportLocationsRequest{DryRun: report.DryRun}
+		for _, row := range batch {
+			req.Locations = append(req.Locations, &pb.LocationUpdate{
+				Username:  row.Username,
+				Latitude:  row.Latitude,
+				Longitude: row.Longitude,
+				Timestamp: timestamppb.New(row.Timestamp),
+				Accuracy:  row.Accuracy,
+			})
+		}
+		summary, err := client.ImportLocations(ctx, req, grpc.MaxCallSendMsgSize(maxImportSize))
+		if err != nil {
+			if start > 0 && !report.DryRun {
+				report.CommittedRows = start
+				if start <= len(report.lines) {
+					report.CommittedLine = report.lines[start-1]
+				}
+			}
+			return err
+		}
+		report.Imported += int(summary.Points - summary.Duplicates)
+		report.Duplicates += int(summary.Duplicates)
+	}
+	if report.DryRun {
+		return nil
+	}
+
+	newest := map[string]LocationUpdateRequest{}
+	for _, row := range rows {
+		if current, ok := newest[row.Username]; !ok || row.Timestamp.After(current.Timestamp) {
+			newest[row.Username] = row
+		}
+	}
+	for _, row := range newest {
+		err := updateLocation(db, row)
+		if errors.Is(err, errStaleLocation) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		report.CurrentLocations++
+	}
+	return nil
+}
+
+func ImportCSVHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
+	var req CSVImportRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	data, _, err := readImportFile(c, "csv")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rows, report, err := parseCSVImport(bytes.NewReader(data), req, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		if err := storeCSVImport(context.Background(), client, db, rows, report); err != nil {
+			if report.CommittedRows == 0 {
+				respondHistoryError(c, err, "import CSV")
+				return
+			}
+			// Part of the file is stored; say which part along with the error.
+			log.Printf("Failed to import CSV in microservice: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import CSV in microservice", "report": report})
+			return
+		}
+		status := http.StatusCreated
+		if req.DryRun {
+			status = http.StatusOK
+		}
+		c.JSON(status, report)
+	})
+}
+
+// importCSVCommand imports a CSV file into the database in the working directory and the location
+// history microservice:
+//
+//	location-management import-csv [-delimiter ';'] [-columns latitude:lat,...] [-dry-run] positions.csv
+func importCSVCommand(args []string) {
+	flags := flag.NewFlagSet("import-csv", flag.ExitOnError)
+	grpcHostname := flags.String("grpc-hostname", "localhost", "gRPC server hostname")
+	var req CSVImportRequest
+	flags.StringVar(&req.Delimiter, "delimiter", ",", "Field delimiter, or 'tab'")
+	flags.StringVar(&req.TimeFormat, "time-format", "rfc3339", "rfc3339, unix, unix_ms or a Go time layout")
+	flags.StringVar(&req.Columns, "columns", "", "Column of each field as field:column, by header name or 1-based position")
+	flags.BoolVar(&req.Header, "header", true, "The first row names the columns")
+	flags.StringVar(&req.Username, "username", "", "User of every row, for files without a username column")
+	flags.BoolVar(&req.DryRun, "dry-run", false, "Only report what would be imported")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: location-management import-csv [flags] <file>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	if err := binding.Validator.ValidateStruct(req); err != nil {
+		log.Fatalf("Invalid options: %v", err)
+	}
+
+	path := flags.Arg(0)
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+	defer file.Close()
+	rows, report, err := parseCSVImport(file, req, time.Now())
+	if err != nil {
+		log.Fatalf("Failed to parse %s: %v", path, err)
+	}
+
+	conn, err := dialLocationHistory(*grpcHostname)
+	if err != nil {
+		log.Fatalf("Failed to connect to location history microservice: %v", err)
+	}
+	defer conn.Close()
+	db.InitLocationDB()
+	defer db.CloseDB()
+	if err := storeCSVImport(context.Background(), pb.NewLocationServiceClient(conn), db.DB, rows, report); err != nil {
+		if report.CommittedRows > 0 {
+			log.Printf("Stored the first %d rows, up to line %d", report.CommittedRows, report.CommittedLine)
+		}
+		log.Fatalf("Failed to import %s: %v", path, err)
+	}
+
+	for _, rowErr := range report.Errors {
+		fmt.Printf("Line %d: %s\n", rowErr.Line, rowErr.Error)
+	}
+	action := "Imported"
+	if req.DryRun {
+		action = "Would import"
+	}
+	fmt.Printf("%s %d of %d rows (%d already stored, %d with errors), %d current locations updated\n",
+		action, report.Imported, report.Rows, report.Duplicates, report.ErrorCount, report.CurrentLocations)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// importClient records the locations sent to the location history microservice. With failAfter
+// set, the calls after that many fail.
+type importClient struct {
+	pb.LocationServiceClient
+	locations []*pb.LocationUpdate
+	calls     int
+	failAfter int
+}
+
+func (c *importClient) ImportLocations(ctx context.Context, req *pb.ImportLocationsRequest, opts ...grpc.CallOption) (*pb.ImportSummary, error) {
+	if c.calls++; c.failAfter > 0 && c.calls > c.failAfter {
+		return nil, errors.New("location history is unavailable")
+	}
+	c.locations = append(c.locations, req.Locations...)
+	return &pb.ImportSummary{Points: int64(len(req.Locations)), Duplicates: 1}, nil
+}
+
+func TestParseCSVImport(t *testing.T) {
+	now := time.Date(2024, time.July, 2, 0, 0, 0, 0, time.UTC)
+	data := "\ufeffUser;Lat;Lng;When;Accuracy\n" +
+		"testuser;45,2671;19.8335;2024-07-01 12:00:00;5\n" +
+		"testuser;45.2671;19.8335;2024-07-01 12:00:00;5\n" +
+		"otheruser;95;19.8335;2024-07-01 12:00:00;\n" +
+		"test@user;45.2671;19.8335;2024-07-01 12:00:00;\n" +
+		"testuser;45.2600;19.8400;;\n" +
+		"testuser;45.2600;19.8400;2024-07-03 12:00:00;\n" +
+		"testuser;45.2600;\"19.8400;2024-07-01 12:10:00\n"
+	req := CSVImportRequest{
+		Delimiter:  ";",
+		TimeFormat: "2006-01-02 15:04:05",
+		Columns:    "username:user,latitude:LAT,longitude:lng,timestamp:when",
+		Header:     true,
+	}
+	rows, report, err := parseCSVImport(strings.NewReader(data), req, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, report.Rows)
+	assert.Equal(t, []LocationUpdateRequest{{
+		Username:  "testuser",
+		Latitude:  45.2671,
+		Longitude: 19.8335,
+		Timestamp: time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC),
+		Accuracy:  5,
+	}}, rows)
+	assert.Equal(t, 6, report.ErrorCount)
+	lines := []int{}
+	for _, rowErr := range report.Errors {
+		lines = append(lines, rowErr.Line)
+	}
+	assert.Equal(t, []int{2, 4, 5, 6, 7, 8}, lines)
+	assert.Equal(t, `invalid latitude "45,2671"`, report.Errors[0].Error)
+	assert.Contains(t, report.Errors[1].Error, "Latitude")
+	assert.Equal(t, "timestamp is required", report.Errors[3].Error)
+	assert.Equal(t, "timestamp is in the future", report.Errors[4].Error)
+
+	// Files without a header map columns by position
+	rows, report, err = parseCSVImport(strings.NewReader("45.2671\t19.8335\t1719835200\n"), CSVImportRequest{
+		Delimiter:  "tab",
+		TimeFormat: "unix",
+		Columns:    "latitude:1,longitude:2,timestamp:3",
+		Username:   "testuser",
+	}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.ErrorCount)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "testuser", rows[0].Username)
+		assert.Equal(t, time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC), rows[0].Timestamp)
+	}
+
+	for _, req := range []CSVImportRequest{
+		{Header: true},
+		{Header: true, Columns: "latitude:lat"},
+		{Header: true, Columns: "altitude:3"},
+		{Header: true, Username: "testuser"},
+		{Header: true, Delimiter: "||"},
+	} {
+		_, _, err := parseCSVImport(strings.NewReader("username,lat,longitude\n"), req, now)
+		assert.Error(t, err, req)
+	}
+}
+
+func TestStoreCSVImport(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	_, err := testDB.Exec("INSERT INTO user_locations (username, latitude, longitude, updated_at) VALUES (?, ?, ?, ?)",
+		"otheruser", 44.7866, 20.4489, time.Date(2024, time.July, 2, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+
+	at := func(minute int) time.Time {
+		return time.Date(2024, time.July, 1, 12, minute, 0, 0, time.UTC)
+	}
+	rows := []LocationUpdateRequest{
+		{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Timestamp: at(10)},
+		{Username: "testuser", Latitude: 45.2600, Longitude: 19.8400, Timestamp: at(0)},
+		{Username: "otheruser", Latitude: 45.2550, Longitude: 19.8450, Timestamp: at(5)},
+	}
+
+	client := &importClient{}
+	report := &CSVImportReport{DryRun: true}
+	assert.NoError(t, storeCSVImport(context.Background(), client, testDB, rows, report))
+	assert.Len(t, client.locations, 3)
+	assert.Equal(t, 0, report.CurrentLocations)
+
+	client = &importClient{}
+	report = &CSVImportReport{}
+	assert.NoError(t, storeCSVImport(context.Background(), client, testDB, rows, report))
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, "otheruser", client.locations[2].Username)
+	// The stored position of otheruser is newer than the imported row
+	assert.Equal(t, 1, report.CurrentLocations)
+
+	var latitude float64
+	testDB.QueryRow("SELECT latitude FROM user_locations WHERE username = ?", "testuser").Scan(&latitude)
+	assert.Equal(t, 45.2671, latitude)
+	testDB.QueryRow("SELECT latitude FROM user_locations WHERE username = ?", "otheruser").Scan(&latitude)
+	assert.Equal(t, 44.7866, latitude)
+}
+
+func TestStoreCSVImportBatches(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	// Two and a half batches, where the last row repeats the first.
+	var data strings.Builder
+	data.WriteString("username,latitude,longitude,timestamp\n")
+	start := time.Date(2024, time.July, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*csvBatchSize+csvBatchSize/2; i++ {
+		fmt.Fprintf(&data, "testuser,45.2671,19.8335,%s\n", start.Add(time.Duration(i)*time.Second).Format(time.RFC3339))
+	}
+	fmt.Fprintf(&data, "testuser,45.2671,19.8335,%s\n", start.Format(time.RFC3339))
+	now := start.Add(24 * time.Hour)
+
+	rows, report, err := parseCSVImport(strings.NewReader(data.String()), CSVImportRequest{Header: true, DryRun: true}, now)
+	assert.NoError(t, err)
+	client := &importClient{}
+	assert.NoError(t, storeCSVImport(context.Background(), client, testDB, rows, report))
+	assert.Len(t, client.locations, 2*csvBatchSize+csvBatchSize/2)
+	// One duplicate reported by each of the three batches and the repeated row
+	assert.Equal(t, 4, report.Duplicates)
+	assert.Zero(t, report.CommittedRows)
+
+	// The third batch fails after two were stored.
+	rows, report, err = parseCSVImport(strings.NewReader(data.String()), CSVImportRequest{Header: true}, now)
+	assert.NoError(t, err)
+	client = &importClient{failAfter: 2}
+	assert.Error(t, storeCSVImport(context.Background(), client, testDB, rows, report))
+	assert.Equal(t, 2*csvBatchSize, report.CommittedRows)
+	assert.Equal(t, 2*csvBatchSize+1, report.CommittedLine)
+	assert.Equal(t, 0, report.CurrentLocations)
+}
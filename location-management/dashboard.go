@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashboardFiles is the support dashboard, a single page that only calls the HTTP API and draws
+// its map as SVG, so it works without a CDN or tile server.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var errUserNotFound = fmt.Errorf("user %w", errNotFound)
+
+// CurrentLocation is the last position stored for a user.
+type CurrentLocation struct {
+	Username  string    `json:"username"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Accuracy  *float64  `json:"accuracy,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Place     *Place    `json:"place,omitempty"`
+}
+
+func getCurrentLocation(db *sql.DB, username string) (CurrentLocation, error) {
+	location := CurrentLocation{Username: username}
+	var accuracy sql.NullFloat64
+	var updatedAt sql.NullTime
+	err := db.QueryRow("SELECT latitude, longitude, accuracy, updated_at FROM user_locations WHERE username = ?", username).
+		Scan(&location.Latitude, &location.Longitude, &accuracy, &updatedAt)
+	if err == sql.ErrNoRows {
+		return location, errUserNotFound
+	}
+	if err != nil {
+		return location, err
+	}
+	if accuracy.Valid {
+		location.Accuracy = &accuracy.Float64
+	}
+	location.UpdatedAt = updatedAt.Time.UTC()
+	location.Place = reverseGeocode(location.Latitude, location.Longitude)
+	return location, nil
+}
+
+func GetUserLocationHandler(c *gin.Context, db *sql.DB) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	location, err := getCurrentLocation(db, uri.Username)
+	if err != nil {
+		respondError(c, err, "read location")
+		return
+	}
+	c.JSON(http.StatusOK, location)
+}
+
+// registerDashboard serves the dashboard at /dashboard/.
+func registerDashboard(r *gin.Engine) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	r.StaticFS("/dashboard", http.FS(files))
+}
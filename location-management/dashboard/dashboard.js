@@ -0,0 +1,357 @@
+"use strict";
+
+// The map is drawn in Web Mercator, fitted to whatever is shown, without tiles underneath.
+const WIDTH = 900;
+const HEIGHT = 600;
+const MARGIN = 30;
+const MIN_SPAN_METERS = 500;
+const EARTH_RADIUS = 6378137;
+const SVG = "http://www.w3.org/2000/svg";
+
+const state = {
+  location: null,
+  track: [],
+  search: null,
+};
+let view = null;
+
+const $ = (id) => document.getElementById(id);
+
+function setStatus(message, error) {
+  $("status").textContent = message;
+  $("status").classList.toggle("error", Boolean(error));
+}
+
+async function api(path) {
+  const response = await fetch(path);
+  const type = response.headers.get("Content-Type") || "";
+  const body = type.includes("json") ? await response.json() : null;
+  if (!response.ok) {
+    const error = new Error((body && body.error) || response.statusText);
+    error.status = response.status;
+    throw error;
+  }
+  return body;
+}
+
+function project([lon, lat]) {
+  const clamped = Math.max(-85, Math.min(85, lat)) * Math.PI / 180;
+  return [lon * Math.PI / 180, Math.log(Math.tan(Math.PI / 4 + clamped / 2))];
+}
+
+function unproject([x, y]) {
+  return [x * 180 / Math.PI, (2 * Math.atan(Math.exp(y)) - Math.PI / 2) * 180 / Math.PI];
+}
+
+// circle returns a polygon of [lon, lat] positions at radius meters around center.
+function circle([lon, lat], radius) {
+  const d = radius / EARTH_RADIUS;
+  const lat1 = lat * Math.PI / 180;
+  const lon1 = lon * Math.PI / 180;
+  const points = [];
+  for (let i = 0; i <= 64; i++) {
+    const bearing = i / 64 * 2 * Math.PI;
+    const lat2 = Math.asin(Math.sin(lat1) * Math.cos(d) + Math.cos(lat1) * Math.sin(d) * Math.cos(bearing));
+    const lon2 = lon1 + Math.atan2(Math.sin(bearing) * Math.sin(d) * Math.cos(lat1), Math.cos(d) - Math.sin(lat1) * Math.sin(lat2));
+    points.push([lon2 * 180 / Math.PI, lat2 * 180 / Math.PI]);
+  }
+  return points;
+}
+
+// fitView computes the projection that fits every position into the map.
+function fitView(positions) {
+  if (positions.length === 0) {
+    return null;
+  }
+  const projected = positions.map(project);
+  let [minX, minY] = projected[0];
+  let [maxX, maxY] = projected[0];
+  for (const [x, y] of projected) {
+    minX = Math.min(minX, x);
+    maxX = Math.max(maxX, x);
+    minY = Math.min(minY, y);
+    maxY = Math.max(maxY, y);
+  }
+  const centerX = (minX + maxX) / 2;
+  const centerY = (minY + maxY) / 2;
+  const centerLat = unproject([centerX, centerY])[1];
+  const minSpan = MIN_SPAN_METERS / EARTH_RADIUS / Math.cos(centerLat * Math.PI / 180);
+  const spanX = Math.max(maxX - minX, minSpan);
+  const spanY = Math.max(maxY - minY, minSpan);
+  const scale = Math.min((WIDTH - 2 * MARGIN) / spanX, (HEIGHT - 2 * MARGIN) / spanY);
+  return {
+    centerX,
+    centerY,
+    scale,
+    metersPerPixel: EARTH_RADIUS * Math.cos(centerLat * Math.PI / 180) / scale,
+    pixel(position) {
+      const [x, y] = project(position);
+      return [WIDTH / 2 + (x - centerX) * scale, HEIGHT / 2 - (y - centerY) * scale];
+    },
+    position([px, py]) {
+      return unproject([centerX + (px - WIDTH / 2) / scale, centerY - (py - HEIGHT / 2) / scale]);
+    },
+  };
+}
+
+function element(name, attributes, parent) {
+  const node = document.createElementNS(SVG, name);
+  for (const [key, value] of Object.entries(attributes)) {
+    node.setAttribute(key, value);
+  }
+  parent.appendChild(node);
+  return node;
+}
+
+function pathData(points) {
+  return points.map(([x, y], i) => (i === 0 ? "M" : "L") + x.toFixed(1) + " " + y.toFixed(1)).join(" ");
+}
+
+// roundStep returns the largest 1, 2 or 5 times a power of ten that is at most value.
+function roundStep(value) {
+  const power = Math.pow(10, Math.floor(Math.log10(value)));
+  for (const step of [5, 2, 1]) {
+    if (step * power <= value) {
+      return step * power;
+    }
+  }
+  return power;
+}
+
+function drawGraticule(svg) {
+  const [west, north] = view.position([0, 0]);
+  const [east, south] = view.position([WIDTH, HEIGHT]);
+  const step = roundStep((east - west) / 4);
+  const digits = Math.max(0, -Math.floor(Math.log10(step)));
+  for (let lon = Math.ceil(west / step) * step; lon <= east; lon += step) {
+    const [x] = view.pixel([lon, 0]);
+    element("line", { class: "graticule", x1: x, y1: 0, x2: x, y2: HEIGHT }, svg);
+    element("text", { class: "graticule-label", x: x + 3, y: 12 }, svg).textContent = lon.toFixed(digits) + "°";
+  }
+  for (let lat = Math.ceil(south / step) * step; lat <= north; lat += step) {
+    const [, y] = view.pixel([0, lat]);
+    element("line", { class: "graticule", x1: 0, y1: y, x2: WIDTH, y2: y }, svg);
+    element("text", { class: "graticule-label", x: 3, y: y - 3 }, svg).textContent = lat.toFixed(digits) + "°";
+  }
+}
+
+function drawScale(svg) {
+  const meters = roundStep(120 * view.metersPerPixel);
+  const length = meters / view.metersPerPixel;
+  const x = 15;
+  const y = HEIGHT - 15;
+  element("path", { class: "scale", d: `M${x} ${y - 6} L${x} ${y} L${x + length} ${y} L${x + length} ${y - 6}` }, svg);
+  element("text", { class: "scale-label", x: x, y: y - 10 }, svg).textContent =
+    meters >= 1000 ? meters / 1000 + " km" : meters + " m";
+}
+
+function draw() {
+  const svg = $("map");
+  svg.replaceChildren();
+
+  const positions = state.track.flat();
+  if (state.location) {
+    positions.push([state.location.longitude, state.location.latitude]);
+  }
+  let radiusCircle = null;
+  if (state.search) {
+    radiusCircle = circle(state.search.center, state.search.radius * 1000);
+    positions.push(...radiusCircle);
+  }
+  view = fitView(positions);
+  if (!view) {
+    element("text", { class: "empty", x: WIDTH / 2, y: HEIGHT / 2, "text-anchor": "middle" }, svg).textContent =
+      "Look up a user or run a search";
+    return;
+  }
+
+  drawGraticule(svg);
+  if (radiusCircle) {
+    element("path", { class: "radius", d: pathData(radiusCircle.map(view.pixel)) + " Z" }, svg);
+  }
+  for (const segment of state.track) {
+    if (segment.length > 1) {
+      element("path", { class: "track", d: pathData(segment.map(view.pixel)) }, svg);
+    } else {
+      const [x, y] = view.pixel(segment[0]);
+      element("circle", { class: "track", cx: x, cy: y, r: 2 }, svg);
+    }
+  }
+  if (state.search) {
+    for (const user of state.search.users) {
+      const [x, y] = view.pixel([user.longitude, user.latitude]);
+      const marker = element("circle", { class: "result", cx: x, cy: y, r: 5 }, svg);
+      element("title", {}, marker).textContent = user.username;
+      marker.addEventListener("click", (event) => {
+        event.stopPropagation();
+        lookUp(user.username);
+      });
+    }
+  }
+  if (state.location) {
+    const [x, y] = view.pixel([state.location.longitude, state.location.latitude]);
+    if (state.location.accuracy) {
+      element("circle", { class: "accuracy", cx: x, cy: y, r: state.location.accuracy / view.metersPerPixel }, svg);
+    }
+    const marker = element("circle", { class: "current", cx: x, cy: y, r: 7 }, svg);
+    element("title", {}, marker).textContent = state.location.username;
+  }
+  drawScale(svg);
+}
+
+// trackSegments turns the GeoJSON track export into lists of [lon, lat] positions.
+function trackSegments(collection) {
+  const segments = [];
+  for (const feature of collection.features) {
+    const geometry = feature.geometry;
+    segments.push(geometry.type === "Point" ? [geometry.coordinates] : geometry.coordinates);
+  }
+  return segments;
+}
+
+function formatPosition(latitude, longitude) {
+  return latitude.toFixed(5) + ", " + longitude.toFixed(5);
+}
+
+// formatPlace describes the place the server reverse geocoded a position to, if it did.
+function formatPlace(place) {
+  if (!place) {
+    return "unknown";
+  }
+  const parts = [];
+  if (place.name) {
+    parts.push(place.distance >= 1 ? place.distance.toFixed(1) + " km from " + place.name : place.name);
+  }
+  for (const part of [place.region, place.country]) {
+    if (part) {
+      parts.push(part);
+    }
+  }
+  return parts.join(", ");
+}
+
+function describePlace(place) {
+  return [place.name, place.region, place.country].filter(Boolean).join(", ");
+}
+
+// formatResolvedPlace shows which place a place search went with and what else the name matches.
+function formatResolvedPlace(resolved) {
+  let text = (resolved.exact ? "" : "Closest match: ") + describePlace(resolved);
+  if (resolved.alternatives) {
+    text += ". Also matches " + resolved.alternatives.map(describePlace).join("; ");
+  }
+  return text;
+}
+
+async function lookUp(username) {
+  const form = $("user-form");
+  form.elements.username.value = username;
+  const hours = Number(form.elements.window.value);
+  setStatus("Loading " + username + "…");
+  try {
+    const location = await api("/api/v1/users/" + encodeURIComponent(username) + "/location");
+    let track = [];
+    if (hours > 0) {
+      const start = new Date(Date.now() - hours * 3600 * 1000).toISOString();
+      const collection = await api("/api/v1/users/" + encodeURIComponent(username) + "/track.geojson?start_time=" + encodeURIComponent(start));
+      track = trackSegments(collection);
+    }
+    state.location = location;
+    state.track = track;
+
+    $("user-details").hidden = false;
+    $("user-position").textContent = formatPosition(location.latitude, location.longitude);
+    $("user-place").textContent = formatPlace(location.place);
+    $("user-accuracy").textContent = location.accuracy ? Math.round(location.accuracy) + " m" : "unknown";
+    $("user-updated").textContent = new Date(location.updated_at).toLocaleString();
+    const points = track.reduce((n, segment) => n + segment.length, 0);
+    $("user-track").textContent = hours > 0 ? points + " points in " + track.length + " segments" : "not shown";
+
+    const search = $("search-form").elements;
+    search.place.value = "";
+    search.latitude.value = location.latitude.toFixed(6);
+    search.longitude.value = location.longitude.toFixed(6);
+    setStatus("");
+  } catch (error) {
+    state.location = null;
+    state.track = [];
+    $("user-details").hidden = true;
+    setStatus(error.status === 404 ? "No position stored for " + username : "Failed to load " + username + ": " + error.message, true);
+  }
+  draw();
+}
+
+async function search() {
+  const form = $("search-form").elements;
+  const place = form.place.value.trim();
+  const radius = Number(form.radius.value);
+  const query = new URLSearchParams({ radius, page: 1, size: 100 });
+  if (place) {
+    query.set("place", place);
+  } else {
+    query.set("latitude", Number(form.latitude.value));
+    query.set("longitude", Number(form.longitude.value));
+  }
+  setStatus("Searching…");
+  try {
+    const result = await api("/api/v1/location/search?" + query);
+    const users = result.users || [];
+    let latitude = Number(form.latitude.value);
+    let longitude = Number(form.longitude.value);
+    $("search-place").textContent = "";
+    if (result.resolved_place) {
+      ({ latitude, longitude } = result.resolved_place);
+      form.latitude.value = latitude.toFixed(6);
+      form.longitude.value = longitude.toFixed(6);
+      $("search-place").textContent = formatResolvedPlace(result.resolved_place);
+    }
+    state.search = { center: [longitude, latitude], radius, users };
+    $("search-summary").textContent = result.total_users === users.length
+      ? result.total_users + " users"
+      : result.total_users + " users, showing the first " + users.length;
+    const list = $("search-results");
+    list.replaceChildren();
+    for (const user of users) {
+      const item = document.createElement("li");
+      const button = document.createElement("button");
+      button.type = "button";
+      button.textContent = user.username;
+      button.addEventListener("click", () => lookUp(user.username));
+      item.append(button, " " + formatPosition(user.latitude, user.longitude));
+      list.appendChild(item);
+    }
+    setStatus("");
+  } catch (error) {
+    setStatus("Search failed: " + error.message, true);
+  }
+  draw();
+}
+
+$("user-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  lookUp(event.target.elements.username.value.trim());
+});
+
+$("search-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  search();
+});
+
+$("map").addEventListener("click", (event) => {
+  if (!view) {
+    return;
+  }
+  const svg = $("map");
+  const point = svg.createSVGPoint();
+  point.x = event.clientX;
+  point.y = event.clientY;
+  const local = point.matrixTransform(svg.getScreenCTM().inverse());
+  const [lon, lat] = view.position([local.x, local.y]);
+  const form = $("search-form").elements;
+  form.place.value = "";
+  form.latitude.value = lat.toFixed(6);
+  form.longitude.value = lon.toFixed(6);
+  search();
+});
+
+draw();
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUserLocationHandler(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	updatedAt := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Timestamp: updatedAt, Accuracy: 8}))
+
+	r := gin.Default()
+	r.GET("/api/v1/users/:username/location", func(c *gin.Context) {
+		GetUserLocationHandler(c, testDB)
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/v1/users/testuser/location")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var location CurrentLocation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &location))
+	accuracy := 8.0
+	assert.Equal(t, CurrentLocation{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Accuracy: &accuracy, UpdatedAt: updatedAt}, location)
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/users/nobody/location").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/users/no@body/location").Code)
+}
+
+func TestDashboard(t *testing.T) {
+	r := gin.Default()
+	registerDashboard(r)
+
+	for path, contentType := range map[string]string{
+		"/dashboard/":              "text/html",
+		"/dashboard/dashboard.js":  "javascript",
+		"/dashboard/dashboard.css": "text/css",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Header().Get("Content-Type"), contentType, path)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceRequest registers a tracker that reports under its own id on behalf of a user. The token
+// authenticates connections of streaming protocols such as NMEA; only its hash is stored. Neither
+// may contain spaces, which separate the fields of an NMEA login.
+type DeviceRequest struct {
+	DeviceID string `json:"device_id" binding:"required,max=64,printascii,excludesall= "`
+	Username string `json:"username" binding:"required,min=4,max=16,alphanum"`
+	Token    string `json:"token,omitempty" binding:"omitempty,min=16,max=64,printascii,excludesall= "`
+}
+
+type Device struct {
+	DeviceRequest
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DeviceURI struct {
+	DeviceID string `uri:"device_id" binding:"required,max=64"`
+}
+
+var (
+	errDeviceNotFound     = fmt.Errorf("device %w", errNotFound)
+	errDeviceExists       = errors.New("device is already registered")
+	errInvalidDeviceToken = errors.New("invalid device token")
+)
+
+func listDevices(db *sql.DB) ([]Device, error) {
+	rows, err := db.Query("SELECT device_id, username, created_at FROM devices ORDER BY device_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.DeviceID, &d.Username, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func createDevice(db *sql.DB, req DeviceRequest, now time.Time) (Device, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Device{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM devices WHERE device_id = ?)", req.DeviceID).Scan(&exists); err != nil {
+		return Device{}, err
+	}
+	if exists {
+		return Device{}, errDeviceExists
+	}
+	if req.Token == "" {
+		if req.Token, err = randomHex(16); err != nil {
+			return Device{}, err
+		}
+	}
+	device := Device{DeviceRequest: req, CreatedAt: now.UTC()}
+	if _, err := tx.Exec("INSERT INTO devices (device_id, username, token_hash, created_at) VALUES (?, ?, ?, ?)",
+		req.DeviceID, req.Username, hashDeviceToken(req.Token), device.CreatedAt); err != nil {
+		return Device{}, err
+	}
+	return device, tx.Commit()
+}
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateDevice returns the user of a device if token is the one it was registered with.
+func authenticateDevice(db *sql.DB, deviceID, token string) (string, error) {
+	var username string
+	var tokenHash sql.NullString
+	err := db.QueryRow("SELECT username, token_hash FROM devices WHERE device_id = ?", deviceID).Scan(&username, &tokenHash)
+	if err == sql.ErrNoRows {
+		return "", errDeviceNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashDeviceToken(token)), []byte(tokenHash.String)) != 1 {
+		return "", errInvalidDeviceToken
+	}
+	return username, nil
+}
+
+func deleteDevice(db *sql.DB, deviceID string) error {
+	res, err := db.Exec("DELETE FROM devices WHERE device_id = ?", deviceID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+// deviceUsername returns the user a tracker reports for.
+func deviceUsername(db *sql.DB, deviceID string) (string, error) {
+	var username string
+	err := db.QueryRow("SELECT username FROM devices WHERE device_id = ?", deviceID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errDeviceNotFound
+	}
+	return username, err
+}
+
+func CreateDeviceHandler(c *gin.Context, db *sql.DB) {
+	var req DeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := createDevice(db, req, time.Now())
+	if errors.Is(err, errDeviceExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "create device")
+		return
+	}
+	c.JSON(http.StatusCreated, device)
+}
+
+func ListDevicesHandler(c *gin.Context, db *sql.DB) {
+	devices, err := listDevices(db)
+	if err != nil {
+		respondError(c, err, "list devices")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+func DeleteDeviceHandler(c *gin.Context, db *sql.DB) {
+	var uri DeviceURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleteDevice(db, uri.DeviceID); err != nil {
+		respondError(c, err, "delete device")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "device deleted"})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/vzivanovic/GOLANG_FOR_STUDENTS/db"
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// dumpOptions select the rows of a dataset export.
+type dumpOptions struct {
+	format    string
+	gzip      bool
+	startTime time.Time
+	endTime   time.Time
+	afterID   int64
+}
+
+// dumpUserLocations writes the current locations, optionally only those updated within the time
+// range, from one read transaction.
+func dumpUserLocations(ctx context.Context, sqlDB *sql.DB, w io.Writer, opts dumpOptions) (int64, error) {
+	if opts.afterID != 0 {
+		return 0, errors.New("user_locations has no id to continue after")
+	}
+	conditions := []string{"1 = 1"}
+	var args []any
+	if !opts.startTime.IsZero() {
+		conditions = append(conditions, "updated_at >= ?")
+		args = append(args, opts.startTime.UTC())
+	}
+	if !opts.endTime.IsZero() {
+		conditions = append(conditions, "updated_at <= ?")
+		args = append(args, opts.endTime.UTC())
+	}
+
+	tx, err := sqlDB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT username, latitude, longitude, accuracy, updated_at FROM user_locations WHERE "+
+		strings.Join(conditions, " AND ")+" ORDER BY username", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	return db.Export(w, rows, opts.format, opts.gzip)
+}
+
+// dumpLocationHistory copies the export stream of the location history microservice to w.
+func dumpLocationHistory(ctx context.Context, client pb.LocationServiceClient, w io.Writer, opts dumpOptions) error {
+	req := &pb.ExportRequest{Format: opts.format, Gzip: opts.gzip, AfterId: opts.afterID}
+	if !opts.startTime.IsZero() {
+		req.StartTime = timestamppb.New(opts.startTime)
+	}
+	if !opts.endTime.IsZero() {
+		req.EndTime = timestamppb.New(opts.endTime)
+	}
+	stream, err := client.ExportHistory(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// exportCommand dumps location_history, through the location history microservice, or
+// user_locations, from locations.db in the working directory, while the services keep running:
+//
+//	location-management export -table location_history [-format csv] [-gzip] [-after-id 1000] [-o history.csv.gz]
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	grpcHostname := flags.String("grpc-hostname", "localhost", "gRPC server hostname")
+	table := flags.String("table", "", "location_history or user_locations")
+	output := flags.String("o", "", "Output file (default standard output)")
+	startTime := flags.String("start-time", "", "Only rows at or after this RFC 3339 time")
+	endTime := flags.String("end-time", "", "Only rows at or before this RFC 3339 time")
+	var opts dumpOptions
+	flags.StringVar(&opts.format, "format", "ndjson", "ndjson or csv")
+	flags.BoolVar(&opts.gzip, "gzip", false, "Compress the output with gzip")
+	flags.Int64Var(&opts.afterID, "after-id", 0, "Only location_history rows with a greater id")
+	flags.Parse(args)
+	if (*table != "location_history" && *table != "user_locations") || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: location-management export -table location_history|user_locations [flags]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	if opts.format != "ndjson" && opts.format != "csv" {
+		log.Fatalf("Invalid format %q, expected ndjson or csv", opts.format)
+	}
+	for _, bound := range []struct {
+		value  string
+		target *time.Time
+	}{{*startTime, &opts.startTime}, {*endTime, &opts.endTime}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			log.Fatalf("Invalid time %q: %v", bound.value, err)
+		}
+		*bound.target = t
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	ctx := context.Background()
+	if *table == "user_locations" {
+		db.InitLocationDB()
+		defer db.CloseDB()
+		n, err := dumpUserLocations(ctx, db.DB, w, opts)
+		if err != nil {
+			log.Fatalf("Failed to export user_locations: %v", err)
+		}
+		log.Printf("Exported %d rows of user_locations", n)
+		return
+	}
+
+	conn, err := dialLocationHistory(*grpcHostname)
+	if err != nil {
+		log.Fatalf("Failed to connect to location history microservice: %v", err)
+	}
+	defer conn.Close()
+	if err := dumpLocationHistory(ctx, pb.NewLocationServiceClient(conn), w, opts); err != nil {
+		log.Fatalf("Failed to export location_history: %v", err)
+	}
+	log.Print("Exported location_history")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpUserLocations(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	for i, username := range []string{"second", "first"} {
+		_, err := testDB.Exec("INSERT INTO user_locations (username, latitude, longitude, accuracy, updated_at) VALUES (?, ?, ?, ?, ?)",
+			username, 45.2671, 19.8335, 5, time.Date(2024, time.July, 1, 12, i, 0, 0, time.UTC))
+		assert.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	n, err := dumpUserLocations(context.Background(), testDB, &buf, dumpOptions{format: "ndjson"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, `{"username":"first","latitude":45.2671,"longitude":19.8335,"accuracy":5,"updated_at":"2024-07-01T12:01:00Z"}`, lines[0])
+
+	buf.Reset()
+	n, err = dumpUserLocations(context.Background(), testDB, &buf, dumpOptions{
+		format:    "csv",
+		startTime: time.Date(2024, time.July, 1, 12, 0, 30, 0, time.UTC),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, "username,latitude,longitude,accuracy,updated_at\nfirst,45.2671,19.8335,5,2024-07-01T12:01:00Z\n", buf.String())
+
+	_, err = dumpUserLocations(context.Background(), testDB, &buf, dumpOptions{format: "csv", afterID: 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// trackChunkSize bounds the points of a segment held in memory. KML and GeoJSON need all times of
+// a line before or after its coordinates, so longer segments are written as several lines, each
+// starting at the last point of the one before.
+const trackChunkSize = 1000
+
+type TrackExportRequest struct {
+	StartTime time.Time     `form:"start_time"`
+	EndTime   time.Time     `form:"end_time"`
+	Gap       time.Duration `form:"gap,default=10m"`
+}
+
+type exportPoint struct {
+	latitude  float64
+	longitude float64
+	timestamp time.Time
+}
+
+// trackEncoder writes a track in one export format. chunk receives the points of a segment in
+// order; continued is set for the chunks of a segment after its first, which repeat the last
+// point of the chunk before.
+type trackEncoder interface {
+	contentType() string
+	begin(w *bufio.Writer, username string)
+	chunk(w *bufio.Writer, segment int, points []exportPoint, continued bool)
+	end(w *bufio.Writer)
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func formatExportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func escapeXML(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// gpxEncoder writes GPX 1.1 with one track segment per segment.
+type gpxEncoder struct {
+	open bool
+}
+
+func (e *gpxEncoder) contentType() string { return "application/gpx+xml" }
+
+func (e *gpxEncoder) begin(w *bufio.Writer, username string) {
+	w.WriteString(xml.Header)
+	w.WriteString(`<gpx version="1.1" creator="location-management" xmlns="http://www.topografix.com/GPX/1/1"` +
+		` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` +
+		` xsi:schemaLocation="http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd">` + "\n")
+	fmt.Fprintf(w, "<trk><name>%s</name>\n", escapeXML(username))
+}
+
+func (e *gpxEncoder) chunk(w *bufio.Writer, segment int, points []exportPoint, continued bool) {
+	if continued {
+		points = points[1:]
+	} else {
+		if e.open {
+			w.WriteString("</trkseg>\n")
+		}
+		w.WriteString("<trkseg>\n")
+		e.open = true
+	}
+	for _, p := range points {
+		fmt.Fprintf(w, "<trkpt lat=\"%s\" lon=\"%s\"><time>%s</time></trkpt>\n",
+			formatCoordinate(p.latitude), formatCoordinate(p.longitude), formatExportTime(p.timestamp))
+	}
+}
+
+func (e *gpxEncoder) end(w *bufio.Writer) {
+	if e.open {
+		w.WriteString("</trkseg>\n")
+	}
+	w.WriteString("</trk>\n</gpx>\n")
+}
+
+// kmlEncoder writes KML 2.2 with a gx:MultiTrack of one gx:Track per chunk, the form Google Earth
+// exports and reads timed tracks in.
+type kmlEncoder struct{}
+
+func (e *kmlEncoder) contentType() string { return "application/vnd.google-earth.kml+xml" }
+
+func (e *kmlEncoder) begin(w *bufio.Writer, username string) {
+	w.WriteString(xml.Header)
+	w.WriteString(`<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">` + "\n")
+	fmt.Fprintf(w, "<Document><name>%s</name>\n<Placemark><name>%[1]s</name>\n<gx:MultiTrack><gx:interpolate>0</gx:interpolate>\n", escapeXML(username))
+}
+
+func (e *kmlEncoder) chunk(w *bufio.Writer, segment int, points []exportPoint, continued bool) {
+	w.WriteString("<gx:Track>\n")
+	for _, p := range points {
+		fmt.Fprintf(w, "<when>%s</when>\n", formatExportTime(p.timestamp))
+	}
+	for _, p := range points {
+		fmt.Fprintf(w, "<gx:coord>%s %s 0</gx:coord>\n", formatCoordinate(p.longitude), formatCoordinate(p.latitude))
+	}
+	w.WriteString("</gx:Track>\n")
+}
+
+func (e *kmlEncoder) end(w *bufio.Writer) {
+	w.WriteString("</gx:MultiTrack>\n</Placemark>\n</Document>\n</kml>\n")
+}
+
+// geoJSONEncoder writes an RFC 7946 FeatureCollection with a LineString feature per chunk, or a
+// Point for a segment of a single point. The times of the positions are in the "times" property,
+// and with reverse geocoding the places of the first and last positions in "start_place" and
+// "end_place".
+type geoJSONEncoder struct {
+	username string
+	features int
+}
+
+func (e *geoJSONEncoder) contentType() string { return "application/geo+json" }
+
+func (e *geoJSONEncoder) begin(w *bufio.Writer, username string) {
+	e.username = username
+	w.WriteString(`{"type":"FeatureCollection","features":[`)
+}
+
+func (e *geoJSONEncoder) chunk(w *bufio.Writer, segment int, points []exportPoint, continued bool) {
+	if e.features > 0 {
+		w.WriteString(",")
+	}
+	e.features++
+
+	times := make([]string, len(points))
+	for i, p := range points {
+		times[i] = formatExportTime(p.timestamp)
+	}
+	props := gin.H{"username": e.username, "segment": segment, "times": times}
+	// The first and last points of a segment are where a trip started and ended.
+	if place := reverseGeocode(points[0].latitude, points[0].longitude); place != nil {
+		props["start_place"] = place
+	}
+	if place := reverseGeocode(points[len(points)-1].latitude, points[len(points)-1].longitude); place != nil {
+		props["end_place"] = place
+	}
+	properties, _ := json.Marshal(props)
+	fmt.Fprintf(w, "\n{\"type\":\"Feature\",\"properties\":%s,\"geometry\":", properties)
+
+	position := func(p exportPoint) string {
+		return "[" + formatCoordinate(p.longitude) + "," + formatCoordinate(p.latitude) + "]"
+	}
+	if len(points) == 1 {
+		fmt.Fprintf(w, `{"type":"Point","coordinates":%s}}`, position(points[0]))
+		return
+	}
+	w.WriteString(`{"type":"LineString","coordinates":[`)
+	for i, p := range points {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString(position(p))
+	}
+	w.WriteString("]}}")
+}
+
+func (e *geoJSONEncoder) end(w *bufio.Writer) {
+	w.WriteString("\n]}\n")
+}
+
+func newTrackEncoder(format string) trackEncoder {
+	switch format {
+	case "gpx":
+		return &gpxEncoder{}
+	case "kml":
+		return &kmlEncoder{}
+	case "geojson":
+		return &geoJSONEncoder{}
+	}
+	return nil
+}
+
+// trackSegmenter splits points into segments at gaps longer than gap and segments into chunks of
+// at most trackChunkSize points.
+type trackSegmenter struct {
+	encoder   trackEncoder
+	w         *bufio.Writer
+	gap       time.Duration
+	points    []exportPoint
+	segment   int
+	continued bool
+}
+
+func (s *trackSegmenter) add(p exportPoint) {
+	if n := len(s.points); n > 0 && p.timestamp.Sub(s.points[n-1].timestamp) > s.gap {
+		s.flush()
+		s.points = s.points[:0]
+		s.segment++
+		s.continued = false
+	}
+	s.points = append(s.points, p)
+	if len(s.points) == trackChunkSize {
+		s.flush()
+		last := s.points[len(s.points)-1]
+		s.points = append(s.points[:0], last)
+		s.continued = true
+	}
+}
+
+// flush writes the buffered points unless they only repeat the end of the previous chunk.
+func (s *trackSegmenter) flush() {
+	if len(s.points) == 0 || s.continued && len(s.points) == 1 {
+		return
+	}
+	s.encoder.chunk(s.w, s.segment, s.points, s.continued)
+	s.w.Flush()
+}
+
+// ExportTrackHandler streams the track of a user between start_time and end_time (default: all of
+// it) in format, split into segments where no point was reported for longer than gap.
+func ExportTrackHandler(c *gin.Context, grpcHostname, format string) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req TrackExportRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Gap <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "gap must be positive"})
+		return
+	}
+	if req.EndTime.IsZero() {
+		req.EndTime = time.Now()
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		stream, err := client.GetTrack(ctx, &pb.TrackRequest{
+			Username:  uri.Username,
+			StartTime: timestamppb.New(req.StartTime),
+			EndTime:   timestamppb.New(req.EndTime),
+		})
+		var first *pb.TrackPoint
+		if err == nil {
+			// Errors before the first point can still be reported with a status code.
+			first, err = stream.Recv()
+		}
+		if err != nil && err != io.EOF {
+			respondHistoryError(c, err, "read track")
+			return
+		}
+
+		encoder := newTrackEncoder(format)
+		c.Header("Content-Type", encoder.contentType())
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, uri.Username, format))
+		c.Status(http.StatusOK)
+		w := bufio.NewWriter(c.Writer)
+		encoder.begin(w, uri.Username)
+		segmenter := &trackSegmenter{encoder: encoder, w: w, gap: req.Gap}
+		for point := first; point != nil; {
+			segmenter.add(exportPoint{latitude: point.Latitude, longitude: point.Longitude, timestamp: point.Timestamp.AsTime()})
+			if point, err = stream.Recv(); err == io.EOF {
+				break
+			}
+			if err != nil {
+				// The status is sent already; an unterminated document tells the client it is incomplete.
+				log.Printf("Failed to read track from microservice: %v", err)
+				w.Flush()
+				return
+			}
+		}
+		segmenter.flush()
+		encoder.end(w)
+		if err := w.Flush(); err != nil {
+			log.Printf("Failed to write track export: %v", err)
+		}
+	})
+}
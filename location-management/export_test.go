@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// exportTestTrack writes a track of two segments: 2500 points a second apart, then, after an
+// hour, a single point.
+func exportTestTrack(format string) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	encoder := newTrackEncoder(format)
+	encoder.begin(w, "testuser")
+	segmenter := &trackSegmenter{encoder: encoder, w: w, gap: 10 * time.Minute}
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 2500; i++ {
+		segmenter.add(exportPoint{latitude: 45 + float64(i)/10000, longitude: 19.5, timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	segmenter.add(exportPoint{latitude: 44.7866, longitude: 20.4489, timestamp: start.Add(2 * time.Hour)})
+	segmenter.flush()
+	encoder.end(w)
+	w.Flush()
+	return buf.Bytes()
+}
+
+func TestExportGPX(t *testing.T) {
+	var gpx struct {
+		XMLName  xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+		Segments []struct {
+			Points []struct {
+				Latitude float64 `xml:"lat,attr"`
+				Time     string  `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trk>trkseg"`
+	}
+	assert.NoError(t, xml.Unmarshal(exportTestTrack("gpx"), &gpx))
+	if assert.Len(t, gpx.Segments, 2) {
+		assert.Len(t, gpx.Segments[0].Points, 2500)
+		assert.Equal(t, "2024-07-01T12:16:39Z", gpx.Segments[0].Points[999].Time)
+		assert.Equal(t, "2024-07-01T12:16:40Z", gpx.Segments[0].Points[1000].Time)
+		assert.Equal(t, 44.7866, gpx.Segments[1].Points[0].Latitude)
+	}
+}
+
+func TestExportKML(t *testing.T) {
+	var kml struct {
+		Tracks []struct {
+			When   []string `xml:"when"`
+			Coords []string `xml:"coord"`
+		} `xml:"Document>Placemark>MultiTrack>Track"`
+	}
+	assert.NoError(t, xml.Unmarshal(exportTestTrack("kml"), &kml))
+	if assert.Len(t, kml.Tracks, 4) {
+		assert.Len(t, kml.Tracks[0].When, 1000)
+		assert.Len(t, kml.Tracks[0].Coords, 1000)
+		// Chunks of a segment start where the one before ended
+		assert.Equal(t, kml.Tracks[0].When[999], kml.Tracks[1].When[0])
+		assert.Len(t, kml.Tracks[2].When, 502)
+		assert.Equal(t, []string{"20.4489 44.7866 0"}, kml.Tracks[3].Coords)
+	}
+}
+
+func TestExportGeoJSON(t *testing.T) {
+	var collection struct {
+		Type     string
+		Features []struct {
+			Type       string
+			Properties struct {
+				Username string
+				Segment  int
+				Times    []string
+			}
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+		}
+	}
+	assert.NoError(t, json.Unmarshal(exportTestTrack("geojson"), &collection))
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	if assert.Len(t, collection.Features, 4) {
+		first := collection.Features[0]
+		assert.Equal(t, "LineString", first.Geometry.Type)
+		assert.Equal(t, "testuser", first.Properties.Username)
+		assert.Len(t, first.Properties.Times, 1000)
+		last := collection.Features[3]
+		assert.Equal(t, 1, last.Properties.Segment)
+		assert.Equal(t, "Point", last.Geometry.Type)
+		assert.JSONEq(t, "[20.4489,44.7866]", string(last.Geometry.Coordinates))
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	encoder := newTrackEncoder("geojson")
+	encoder.begin(w, "testuser")
+	encoder.end(w)
+	w.Flush()
+	assert.JSONEq(t, `{"type":"FeatureCollection","features":[]}`, buf.String())
+}
+
+func TestExportTrackHandlerValidation(t *testing.T) {
+	r := gin.Default()
+	r.GET("/api/v1/users/:username/track.gpx", func(c *gin.Context) {
+		ExportTrackHandler(c, "localhost", "gpx")
+	})
+
+	for _, url := range []string{
+		"/api/v1/users/test@user/track.gpx",
+		"/api/v1/users/testuser/track.gpx?gap=0s",
+		"/api/v1/users/testuser/track.gpx?gap=ten",
+		"/api/v1/users/testuser/track.gpx?start_time=yesterday",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"), url)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// maxPlaceEdits is the most edits a misspelt place name may be away from a known name.
+	maxPlaceEdits = 2
+	// maxPlaceAlternatives is how many other matching places are returned with a resolved place.
+	maxPlaceAlternatives = 5
+)
+
+var errPlaceNotFound = fmt.Errorf("place %w", errNotFound)
+
+// GazetteerPlace is a place of the GeoNames file found by its name.
+type GazetteerPlace struct {
+	Name        string  `json:"name"`
+	Country     string  `json:"country,omitempty"`
+	CountryCode string  `json:"country_code,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Population  int64   `json:"population,omitempty"`
+}
+
+// ResolvedPlace is the place a place name was resolved to, with the other places it may have
+// meant so that ambiguous names are visible. Exact is false when the name was misspelt.
+type ResolvedPlace struct {
+	Query string `json:"query"`
+	GazetteerPlace
+	Exact        bool             `json:"exact"`
+	Alternatives []GazetteerPlace `json:"alternatives,omitempty"`
+}
+
+// foldLetters maps the letters that do not decompose into a base letter and accents.
+var foldLetters = map[rune]string{'đ': "d", 'ł': "l", 'ø': "o", 'æ': "ae", 'œ': "oe", 'ß': "ss", 'ı': "i", 'þ': "th"}
+
+// normalizePlaceName folds case and accents and turns punctuation into single spaces, so that
+// "Novi Sad", "novi-sad" and "NOVÍ SAD" are the same name.
+func normalizePlaceName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			// Decomposed, accents are marks of their own that are left out below.
+			name = norm.NFD.String(name)
+			break
+		}
+	}
+	var b strings.Builder
+	b.Grow(len(name))
+	space := false
+	for _, r := range name {
+		r = unicode.ToLower(r)
+		switch {
+		case r >= utf8.RuneSelf && unicode.Is(unicode.Mn, r):
+		case !unicode.IsLetter(r) && !unicode.IsNumber(r):
+			space = b.Len() > 0
+		default:
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			if r < utf8.RuneSelf || foldLetters[r] == "" {
+				b.WriteRune(r)
+			} else {
+				b.WriteString(foldLetters[r])
+			}
+		}
+	}
+	return b.String()
+}
+
+// indexPlaceName makes place i findable by name.
+func (g *reverseGeocoder) indexPlaceName(name string, i int) {
+	key := normalizePlaceName(name)
+	if key == "" {
+		return
+	}
+	indices, known := g.names[key]
+	if len(indices) > 0 && indices[len(indices)-1] == i {
+		return
+	}
+	g.names[key] = append(indices, i)
+	if !known {
+		length := utf8.RuneCountInString(key)
+		g.nameLengths[length] = append(g.nameLengths[length], key)
+	}
+}
+
+// editDistance is the Levenshtein distance between a and b, or limit+1 once it is more than limit.
+func editDistance(a, b []rune, limit int) int {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > limit {
+		return limit + 1
+	}
+	row := make([]int, len(a)+1)
+	for i := range row {
+		row[i] = i
+	}
+	for j := 1; j <= len(b); j++ {
+		previous := row[0]
+		row[0] = j
+		smallest := row[0]
+		for i := 1; i <= len(a); i++ {
+			substitution := previous
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+			previous = row[i]
+			row[i] = min(row[i]+1, row[i-1]+1, substitution)
+			smallest = min(smallest, row[i])
+		}
+		if smallest > limit {
+			return limit + 1
+		}
+	}
+	return row[len(a)]
+}
+
+// gazetteerPlace describes place i of the GeoNames file.
+func (g *reverseGeocoder) gazetteerPlace(i int) GazetteerPlace {
+	p := &g.places[i]
+	return GazetteerPlace{
+		Name:        p.name,
+		Country:     countryName(p.countryCode),
+		CountryCode: p.countryCode,
+		Region:      g.regions[p.countryCode+"."+p.admin1],
+		Latitude:    p.latitude,
+		Longitude:   p.longitude,
+		Population:  p.population,
+	}
+}
+
+// qualifies reports whether a place is in the country or region a query named after a comma,
+// given by its code or name.
+func (g *reverseGeocoder) qualifies(place GazetteerPlace, qualifier string) bool {
+	return qualifier == "" ||
+		qualifier == normalizePlaceName(place.CountryCode) ||
+		qualifier == normalizePlaceName(place.Country) ||
+		qualifier == normalizePlaceName(place.Region)
+}
+
+// resolvePlace finds the place a name means. Names match whatever their case and accents, or
+// misspelt by up to maxPlaceEdits letters when no name matches exactly; a longer name allows one
+// edit for every four letters. "Name, Country" or "Name, Region" narrows the matches down.
+// The closest match wins, then the most populous place.
+func (g *reverseGeocoder) resolvePlace(query string) (*ResolvedPlace, error) {
+	name, qualifier := query, ""
+	if i := strings.LastIndex(query, ","); i >= 0 {
+		name, qualifier = query[:i], normalizePlaceName(query[i+1:])
+	}
+	key := normalizePlaceName(name)
+	if key == "" {
+		return nil, errPlaceNotFound
+	}
+
+	type match struct {
+		edits int
+		place GazetteerPlace
+	}
+	var matches []match
+	seen := map[int]bool{}
+	add := func(edits int, indices []int) {
+		for _, i := range indices {
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			if place := g.gazetteerPlace(i); g.qualifies(place, qualifier) {
+				matches = append(matches, match{edits, place})
+			}
+		}
+	}
+	add(0, g.names[key])
+	if len(matches) == 0 {
+		target := []rune(key)
+		limit := min(maxPlaceEdits, len(target)/4)
+		for length := len(target) - limit; limit > 0 && length <= len(target)+limit; length++ {
+			for _, candidate := range g.nameLengths[length] {
+				if edits := editDistance(target, []rune(candidate), limit); edits <= limit {
+					add(edits, g.names[candidate])
+				}
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, errPlaceNotFound
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.edits != b.edits {
+			return a.edits < b.edits
+		}
+		if a.place.Population != b.place.Population {
+			return a.place.Population > b.place.Population
+		}
+		return a.place.Name < b.place.Name
+	})
+	resolved := &ResolvedPlace{Query: query, GazetteerPlace: matches[0].place, Exact: matches[0].edits == 0}
+	for _, m := range matches[1:min(len(matches), maxPlaceAlternatives+1)] {
+		resolved.Alternatives = append(resolved.Alternatives, m.place)
+	}
+	return resolved, nil
+}
+
+// resolveCenter resolves the place a center-based request gave instead of coordinates, answering
+// 503 when no gazetteer was loaded and 404 when nothing matches.
+func resolveCenter(c *gin.Context, place string) (*ResolvedPlace, bool) {
+	if geocoder == nil || len(geocoder.places) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No gazetteer is loaded to resolve places"})
+		return nil, false
+	}
+	resolved, err := geocoder.resolvePlace(place)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no place matches %q", place)})
+		return nil, false
+	}
+	return resolved, true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func gazetteerLine(name, ascii, alternates, latitude, longitude, country, admin1, population string) string {
+	return strings.Join([]string{"1", name, ascii, alternates, latitude, longitude, "P", "PPL", country, "", admin1,
+		"", "", "", population, "", "", "", "2024-01-01"}, "\t")
+}
+
+func testGazetteer(t *testing.T) *reverseGeocoder {
+	g := newReverseGeocoder()
+	cities := strings.Join([]string{
+		gazetteerLine("Novi Sad", "Novi Sad", "Neusatz,Novi Sad,Újvidék,Нови Сад", "45.25167", "19.83694", "RS", "VO", "380000"),
+		gazetteerLine("Belgrade", "Belgrade", "Beograd,Београд", "44.80401", "20.46513", "RS", "SE", "1273651"),
+		gazetteerLine("Paris", "Paris", "Lutetia,Parigi", "48.85341", "2.3488", "FR", "11", "2138551"),
+		gazetteerLine("Paris", "Paris", "", "33.66094", "-95.55551", "US", "TX", "24171"),
+		gazetteerLine("Đakovo", "Dakovo", "", "45.30833", "18.41028", "HR", "14", "19508"),
+		gazetteerLine("Zürich", "Zurich", "Zuerich", "47.36667", "8.55", "CH", "ZH", ""),
+	}, "\n")
+	assert.NoError(t, g.readGeoNames(strings.NewReader(cities)))
+	assert.NoError(t, g.readAdmin1Codes(strings.NewReader("RS.VO\tVojvodina\tVojvodina\t3194359\nUS.TX\tTexas\tTexas\t4736286\n")))
+	return g
+}
+
+func TestNormalizePlaceName(t *testing.T) {
+	assert.Equal(t, "novi sad", normalizePlaceName("  NOVÍ-sad "))
+	assert.Equal(t, "dakovo", normalizePlaceName("Đakovo"))
+	assert.Equal(t, "zurich", normalizePlaceName("Zürich"))
+	assert.Equal(t, "нови сад", normalizePlaceName("Нови Сад"))
+	assert.Equal(t, "", normalizePlaceName(" - "))
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 1, editDistance([]rune("belgrde"), []rune("belgrade"), 2))
+	assert.Equal(t, 2, editDistance([]rune("nvi sd"), []rune("novi sad"), 2))
+	assert.Equal(t, 2, editDistance([]rune("abc"), []rune("xyz"), 1))
+}
+
+func TestResolvePlace(t *testing.T) {
+	g := testGazetteer(t)
+
+	place, err := g.resolvePlace("novi sad")
+	if assert.NoError(t, err) {
+		assert.Equal(t, GazetteerPlace{Name: "Novi Sad", Country: "Serbia", CountryCode: "RS", Region: "Vojvodina",
+			Latitude: 45.25167, Longitude: 19.83694, Population: 380000}, place.GazetteerPlace)
+		assert.True(t, place.Exact)
+		assert.Empty(t, place.Alternatives)
+	}
+
+	// Alternate names match whatever their accents and script.
+	for _, query := range []string{"Ujvidek", "НОВИ САД", "neusatz"} {
+		place, err = g.resolvePlace(query)
+		if assert.NoError(t, err, query) {
+			assert.Equal(t, "Novi Sad", place.Name)
+		}
+	}
+	place, _ = g.resolvePlace("Dakovo")
+	assert.Equal(t, "Đakovo", place.Name)
+
+	// Ambiguous names go to the most populous place and list the others,
+	place, _ = g.resolvePlace("Paris")
+	assert.Equal(t, "FR", place.CountryCode)
+	if assert.Len(t, place.Alternatives, 1) {
+		assert.Equal(t, "Texas", place.Alternatives[0].Region)
+	}
+	// unless a country or region narrows them down.
+	for _, query := range []string{"Paris, Texas", "paris, us", "Paris,United States"} {
+		place, err = g.resolvePlace(query)
+		if assert.NoError(t, err, query) {
+			assert.Equal(t, "US", place.CountryCode, query)
+		}
+	}
+	_, err = g.resolvePlace("Paris, Serbia")
+	assert.ErrorIs(t, err, errNotFound)
+
+	// Misspelt names match when no name matches exactly.
+	place, err = g.resolvePlace("Belgrde")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Belgrade", place.Name)
+		assert.False(t, place.Exact)
+	}
+	place, _ = g.resolvePlace("Zurih")
+	assert.Equal(t, "Zürich", place.Name)
+	// Short names have to be spelt right, and long ones allow one edit for every four letters.
+	_, err = g.resolvePlace("Par")
+	assert.ErrorIs(t, err, errNotFound)
+	_, err = g.resolvePlace("Nvi Sd")
+	assert.ErrorIs(t, err, errNotFound)
+	_, err = g.resolvePlace("Gotham")
+	assert.ErrorIs(t, err, errNotFound)
+}
+
+func TestSearchUsersByPlace(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	defer func() { geocoder = nil }()
+	testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)", "testuser", 45.2551, 19.8452)
+	testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)", "otheruser", 44.8, 20.46)
+
+	r := gin.Default()
+	r.GET("/api/v1/location/search", func(c *gin.Context) {
+		SearchUsersHandler(c, testDB)
+	})
+	search := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/location/search?radius=5&page=1&size=10&"+query, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	geocoder = nil
+	assert.Equal(t, http.StatusServiceUnavailable, search("place=Novi+Sad").Code)
+
+	geocoder = testGazetteer(t)
+	w := search("place=novi-sad")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	if assert.Len(t, res.Users, 1) {
+		assert.Equal(t, "testuser", res.Users[0].Username)
+	}
+	if assert.NotNil(t, res.ResolvedPlace) {
+		assert.Equal(t, "novi-sad", res.ResolvedPlace.Query)
+		assert.Equal(t, "Novi Sad", res.ResolvedPlace.Name)
+	}
+
+	// Coordinates still work and are not annotated with a resolved place.
+	w = search("latitude=45.2551&longitude=19.8452")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "resolved_place")
+
+	assert.Equal(t, http.StatusNotFound, search("place=Gotham").Code)
+	assert.Equal(t, http.StatusBadRequest, search("place=Novi+Sad&latitude=45.2551&longitude=19.8452").Code)
+	assert.Equal(t, http.StatusBadRequest, search("").Code)
+}
+
+func TestGeofenceCenterPlace(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	defer func() { geocoder = nil }()
+	geocoder = testGazetteer(t)
+
+	r := gin.Default()
+	r.POST("/api/v1/geofences", func(c *gin.Context) {
+		CreateGeofenceHandler(c, testDB)
+	})
+	create := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/geofences", bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := create(`{"name":"Centre","type":"circle","place":"Novi Sad","radius":2}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var g Geofence
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &g))
+	assert.Equal(t, 45.25167, g.Latitude)
+	assert.Equal(t, 19.83694, g.Longitude)
+	assert.Empty(t, g.Place)
+	if assert.NotNil(t, g.ResolvedPlace) {
+		assert.Equal(t, "Vojvodina", g.ResolvedPlace.Region)
+	}
+
+	// Only the coordinates are stored.
+	stored, err := getGeofence(testDB, g.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 45.25167, stored.Latitude)
+	assert.Nil(t, stored.ResolvedPlace)
+
+	assert.Equal(t, http.StatusNotFound, create(`{"name":"Nowhere","type":"circle","place":"Gotham","radius":2}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"name":"Both","type":"circle","place":"Novi Sad","latitude":45,"radius":2}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"name":"Area","type":"polygon","place":"Novi Sad",
+		"polygon":[{"latitude":45,"longitude":19},{"latitude":45,"longitude":20},{"latitude":46,"longitude":20}]}`).Code)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// geocoder annotates positions with places when reverse geocoding data was loaded at startup.
+var geocoder *reverseGeocoder
+
+// Place describes where a position is: its country and region, and the nearest populated place
+// with its distance in kilometers.
+type Place struct {
+	Country     string  `json:"country,omitempty"`
+	CountryCode string  `json:"country_code,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	Distance    float64 `json:"distance,omitempty"`
+}
+
+type geoNamesPlace struct {
+	name        string
+	latitude    float64
+	longitude   float64
+	countryCode string
+	admin1      string
+	population  int64
+}
+
+const (
+	// placeCellSize is the size in degrees of the grid cells the places are indexed in.
+	placeCellSize = 1.0
+	// maxPlaceDistance is how far in kilometers the nearest place is looked for.
+	maxPlaceDistance = 200.0
+	kmPerDegree      = 111.19
+)
+
+type placeCell struct{ lat, lon int }
+
+type boundary struct {
+	country, countryCode, region string
+	// polygons are lists of rings of [longitude, latitude]; the first ring is the outline and the
+	// others are holes.
+	polygons                       [][][][2]float64
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// reverseGeocoder answers from memory: places from a GeoNames cities file are indexed in a grid
+// of placeCellSize degrees and by their normalized names, and boundaries are checked against their
+// bounding boxes first.
+type reverseGeocoder struct {
+	places []geoNamesPlace
+	cells  map[placeCell][]int
+	names  map[string][]int
+	// nameLengths lists the names by their length in runes for misspelt names.
+	nameLengths map[int][]string
+	regions     map[string]string
+	boundaries  []boundary
+}
+
+func newReverseGeocoder() *reverseGeocoder {
+	return &reverseGeocoder{cells: map[placeCell][]int{}, names: map[string][]int{}, nameLengths: map[int][]string{},
+		regions: map[string]string{}}
+}
+
+// loadReverseGeocoder reads the files given on the command line; any of them may be empty.
+func loadReverseGeocoder(citiesPath, admin1Path string, boundaryPaths []string) (*reverseGeocoder, error) {
+	g := newReverseGeocoder()
+	load := func(path string, read func(io.Reader) error) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := read(file); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+	if citiesPath != "" {
+		if err := load(citiesPath, g.readGeoNames); err != nil {
+			return nil, err
+		}
+	}
+	if admin1Path != "" {
+		if err := load(admin1Path, g.readAdmin1Codes); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range boundaryPaths {
+		if err := load(path, g.readBoundaries); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func placeCellOf(latitude, longitude float64) placeCell {
+	return placeCell{int(math.Floor(latitude / placeCellSize)), int(math.Floor(longitude / placeCellSize))}
+}
+
+// readGeoNames reads a GeoNames cities file such as cities15000.txt: tab-separated lines with the
+// name, ASCII name and comma-separated alternate names in columns 2 to 4, the position in columns 5
+// and 6, the country code in column 9, the admin1 code in column 11 and the population in column 15.
+func (g *reverseGeocoder) readGeoNames(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 11 {
+			return fmt.Errorf("line %d: expected at least 11 columns", line)
+		}
+		latitude, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid latitude", line)
+		}
+		longitude, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid longitude", line)
+		}
+		var population int64
+		if len(fields) > 14 && fields[14] != "" {
+			if population, err = strconv.ParseInt(fields[14], 10, 64); err != nil {
+				return fmt.Errorf("line %d: invalid population", line)
+			}
+		}
+		i := len(g.places)
+		cell := placeCellOf(latitude, longitude)
+		g.cells[cell] = append(g.cells[cell], i)
+		g.places = append(g.places, geoNamesPlace{
+			name:        fields[1],
+			latitude:    latitude,
+			longitude:   longitude,
+			countryCode: fields[8],
+			admin1:      fields[10],
+			population:  population,
+		})
+		g.indexPlaceName(fields[1], i)
+		g.indexPlaceName(fields[2], i)
+		for _, name := range strings.Split(fields[3], ",") {
+			g.indexPlaceName(name, i)
+		}
+	}
+	return scanner.Err()
+}
+
+// readAdmin1Codes reads GeoNames admin1CodesASCII.txt, which names regions by "country.admin1".
+func (g *reverseGeocoder) readAdmin1Codes(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) >= 2 {
+			g.regions[fields[0]] = fields[1]
+		}
+	}
+	return scanner.Err()
+}
+
+// firstProperty returns the first of the keys that is a non-empty string property.
+func firstProperty(properties map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := properties[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// readBoundaries reads Polygon and MultiPolygon features of a GeoJSON FeatureCollection. The
+// country comes from the "country", "ADMIN", "admin" or "NAME_0" property, its code from
+// "country_code", "ISO_A2" or "iso_a2", and the region from "region" or "NAME_1", or from "name"
+// in Natural Earth admin-1 files, whose features also have "admin".
+func (g *reverseGeocoder) readBoundaries(r io.Reader) error {
+	var collection struct {
+		Features []struct {
+			Properties map[string]any `json:"properties"`
+			Geometry   struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&collection); err != nil {
+		return err
+	}
+	for i, feature := range collection.Features {
+		b := boundary{
+			country:     firstProperty(feature.Properties, "country", "ADMIN", "admin", "NAME_0"),
+			countryCode: firstProperty(feature.Properties, "country_code", "ISO_A2", "iso_a2"),
+			region:      firstProperty(feature.Properties, "region", "NAME_1"),
+		}
+		if b.region == "" && firstProperty(feature.Properties, "admin") != "" {
+			b.region = firstProperty(feature.Properties, "name")
+		}
+		// Natural Earth marks missing codes as -99.
+		if len(b.countryCode) != 2 {
+			b.countryCode = ""
+		}
+		var err error
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+			b.polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &b.polygons)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("feature %d: %w", i, err)
+		}
+		if b.country == "" && b.region == "" {
+			continue
+		}
+		b.minLon, b.minLat, b.maxLon, b.maxLat = 180, 90, -180, -90
+		for _, polygon := range b.polygons {
+			if len(polygon) == 0 {
+				continue
+			}
+			for _, p := range polygon[0] {
+				b.minLon, b.maxLon = math.Min(b.minLon, p[0]), math.Max(b.maxLon, p[0])
+				b.minLat, b.maxLat = math.Min(b.minLat, p[1]), math.Max(b.maxLat, p[1])
+			}
+		}
+		g.boundaries = append(g.boundaries, b)
+	}
+	return nil
+}
+
+// inRing tests whether a position is inside a ring by counting the edges a ray to the east crosses.
+func inRing(ring [][2]float64, latitude, longitude float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > latitude) != (b[1] > latitude) &&
+			longitude < (b[0]-a[0])*(latitude-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (b *boundary) contains(latitude, longitude float64) bool {
+	if latitude < b.minLat || latitude > b.maxLat || longitude < b.minLon || longitude > b.maxLon {
+		return false
+	}
+	for _, polygon := range b.polygons {
+		if len(polygon) == 0 || !inRing(polygon[0], latitude, longitude) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if inRing(hole, latitude, longitude) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestPlace returns the nearest place within maxPlaceDistance kilometers. It searches the rows
+// of cells that close to the position, each as many cells to the east and west as that distance
+// spans at the row's latitude furthest from the equator.
+func (g *reverseGeocoder) nearestPlace(latitude, longitude float64) (*geoNamesPlace, float64) {
+	center := placeCellOf(latitude, longitude)
+	rows := int(math.Ceil(maxPlaceDistance / (placeCellSize * kmPerDegree)))
+	var nearest *geoNamesPlace
+	best := maxPlaceDistance
+	for row := center.lat - rows; row <= center.lat+rows; row++ {
+		edge := math.Max(math.Abs(float64(row)), math.Abs(float64(row+1))) * placeCellSize
+		columns := int(360 / placeCellSize / 2)
+		if cos := math.Cos(math.Min(edge, 90) * math.Pi / 180); cos > 0 {
+			columns = min(columns, int(math.Ceil(maxPlaceDistance/(placeCellSize*kmPerDegree*cos))))
+		}
+		for column := center.lon - columns; column <= center.lon+columns; column++ {
+			// Cells wrap around the antimeridian.
+			lon := ((column+180)%360+360)%360 - 180
+			for _, i := range g.cells[placeCell{row, lon}] {
+				place := &g.places[i]
+				if d := distance(latitude, longitude, place.latitude, place.longitude); d <= best {
+					nearest, best = place, d
+				}
+			}
+		}
+	}
+	return nearest, best
+}
+
+// lookup returns the place of a position. Boundaries decide the country and region where they
+// cover the position; otherwise they come from the nearest place.
+func (g *reverseGeocoder) lookup(latitude, longitude float64) *Place {
+	place := &Place{}
+	if nearest, d := g.nearestPlace(latitude, longitude); nearest != nil {
+		place.Name = nearest.name
+		place.Distance = math.Round(d*100) / 100
+		place.CountryCode = nearest.countryCode
+		place.Region = g.regions[nearest.countryCode+"."+nearest.admin1]
+	}
+	var country, region *boundary
+	for i := range g.boundaries {
+		b := &g.boundaries[i]
+		if (country == nil && b.country != "") || (region == nil && b.region != "") {
+			if !b.contains(latitude, longitude) {
+				continue
+			}
+			if country == nil && b.country != "" {
+				country = b
+			}
+			if region == nil && b.region != "" {
+				region = b
+			}
+		}
+	}
+	if country != nil {
+		place.Country, place.CountryCode = country.country, country.countryCode
+	}
+	if region != nil {
+		place.Region = region.region
+		if country == nil {
+			place.Country, place.CountryCode = region.country, region.countryCode
+		}
+	}
+	if place.Country == "" {
+		place.Country = countryName(place.CountryCode)
+	}
+	if *place == (Place{}) {
+		return nil
+	}
+	return place
+}
+
+// countryName returns the English name of a country code, or "" for an unknown code.
+func countryName(code string) string {
+	region, err := language.ParseRegion(code)
+	if err != nil {
+		return ""
+	}
+	return display.English.Regions().Name(region)
+}
+
+// reverseGeocode returns the place of a position, or nil without reverse geocoding data.
+func reverseGeocode(latitude, longitude float64) *Place {
+	if geocoder == nil {
+		return nil
+	}
+	return geocoder.lookup(latitude, longitude)
+}
+
+type ReverseGeocodeRequest struct {
+	Latitude  float64 `form:"latitude" binding:"required,gte=-90,lte=90"`
+	Longitude float64 `form:"longitude" binding:"required,gte=-180,lte=180"`
+}
+
+func ReverseGeocodeHandler(c *gin.Context) {
+	var req ReverseGeocodeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if geocoder == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Reverse geocoding data is not loaded"})
+		return
+	}
+	place := geocoder.lookup(req.Latitude, req.Longitude)
+	if place == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no place found"})
+		return
+	}
+	c.JSON(http.StatusOK, place)
+}
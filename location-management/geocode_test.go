@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func geoNamesLine(fields ...string) string {
+	// id, name, ascii name, alternate names, latitude, longitude, feature class and code,
+	// country code, cc2, admin1 code, and the remaining columns of the cities files.
+	return strings.Join(append(fields, "", "", "", "100000", "", "80", "Europe/Belgrade", "2024-01-01"), "\t")
+}
+
+const testBoundaries = `{"type":"FeatureCollection","features":[
+{"type":"Feature","properties":{"ADMIN":"Testland","ISO_A2":"TL"},"geometry":{"type":"Polygon","coordinates":[
+	[[19,45],[21,45],[21,46],[19,46],[19,45]],
+	[[20.4,45.4],[20.6,45.4],[20.6,45.6],[20.4,45.6],[20.4,45.4]]]}},
+{"type":"Feature","properties":{"admin":"Testland","name":"North Province","iso_a2":"-99"},"geometry":{"type":"MultiPolygon","coordinates":[
+	[[[19,45.5],[21,45.5],[21,46],[19,46],[19,45.5]]]]}},
+{"type":"Feature","properties":{"note":"unnamed"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}
+]}`
+
+func testGeocoder(t *testing.T) *reverseGeocoder {
+	g := newReverseGeocoder()
+	cities := strings.Join([]string{
+		geoNamesLine("3194360", "Novi Sad", "Novi Sad", "", "45.25167", "19.83694", "P", "PPLA", "RS", "", "VO"),
+		geoNamesLine("792680", "Belgrade", "Belgrade", "", "44.80401", "20.46513", "P", "PPLC", "RS", "", "SE"),
+		geoNamesLine("2193733", "Auckland", "Auckland", "", "-36.84853", "174.76349", "P", "PPLA", "NZ", "", "E7"),
+		geoNamesLine("2202064", "Waiyevo", "Waiyevo", "", "-16.79", "179.98", "P", "PPL", "FJ", "", "03"),
+	}, "\n")
+	assert.NoError(t, g.readGeoNames(strings.NewReader(cities)))
+	assert.NoError(t, g.readAdmin1Codes(strings.NewReader("RS.VO\tVojvodina\tVojvodina\t3194359\nRS.SE\tCentral Serbia\tCentral Serbia\t7581798\n")))
+	return g
+}
+
+func TestReverseGeocoderPlaces(t *testing.T) {
+	g := testGeocoder(t)
+	assert.Equal(t, &Place{Country: "Serbia", CountryCode: "RS", Region: "Vojvodina", Name: "Novi Sad", Distance: 1.74},
+		g.lookup(45.2671, 19.8335))
+
+	// The nearest place is found several cells away
+	place := g.lookup(44.0, 21.5)
+	assert.Equal(t, "Belgrade", place.Name)
+	assert.Equal(t, "Central Serbia", place.Region)
+
+	// and across the antimeridian.
+	assert.Equal(t, "Waiyevo", g.lookup(-16.8, -179.9).Name)
+
+	// Places further than maxPlaceDistance are not the nearest place.
+	place = g.lookup(40, -30)
+	assert.Nil(t, place)
+
+	assert.Nil(t, newReverseGeocoder().lookup(45, 19))
+}
+
+func TestReverseGeocoderBoundaries(t *testing.T) {
+	g := testGeocoder(t)
+	assert.NoError(t, g.readBoundaries(strings.NewReader(testBoundaries)))
+	assert.Len(t, g.boundaries, 2)
+
+	// Boundaries override the country and region of the nearest place.
+	place := g.lookup(45.7, 19.9)
+	assert.Equal(t, "Testland", place.Country)
+	assert.Equal(t, "TL", place.CountryCode)
+	assert.Equal(t, "North Province", place.Region)
+	assert.Equal(t, "Novi Sad", place.Name)
+
+	// South of the province the region of the nearest place is kept.
+	place = g.lookup(45.2, 19.9)
+	assert.Equal(t, "Testland", place.Country)
+	assert.Equal(t, "Vojvodina", place.Region)
+
+	// The hole in the country falls back to the nearest place.
+	assert.Equal(t, "Serbia", g.lookup(45.45, 20.5).Country)
+
+	assert.Error(t, g.readBoundaries(strings.NewReader(`{"features":[{"geometry":{"type":"Polygon","coordinates":[1]}}]}`)))
+}
+
+func TestReverseGeocodeHandler(t *testing.T) {
+	defer func() { geocoder = nil }()
+	r := gin.Default()
+	r.GET("/api/v1/geocode/reverse", ReverseGeocodeHandler)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/geocode/reverse?"+query, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	geocoder = nil
+	assert.Equal(t, http.StatusServiceUnavailable, get("latitude=45.2671&longitude=19.8335").Code)
+
+	geocoder = testGeocoder(t)
+	w := get("latitude=45.2671&longitude=19.8335")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var place Place
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &place))
+	assert.Equal(t, "Novi Sad", place.Name)
+	assert.Equal(t, http.StatusBadRequest, get("latitude=95&longitude=19.8335").Code)
+
+	// Search results are annotated too.
+	setupTestDB()
+	defer teardownTestDB()
+	testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)", "testuser", 45.2671, 19.8335)
+	res := searchUsers(testDB, SearchRequest{Latitude: 45.2671, Longitude: 19.8335, Radius: 1, Page: 1, Size: 10})
+	if assert.Len(t, res.Users, 1) {
+		assert.Equal(t, "Vojvodina", res.Users[0].Place.Region)
+	}
+}
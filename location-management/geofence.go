@@ -0,0 +1,667 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GeofenceEnter = "enter"
+	GeofenceExit  = "exit"
+	GeofenceDwell = "dwell"
+)
+
+// Geofence active windows are daily times of day in UTC.
+const activeTimeLayout = "15:04"
+
+type Coordinate struct {
+	Latitude  float64 `json:"latitude" binding:"gte=-90,lte=90"`
+	Longitude float64 `json:"longitude" binding:"gte=-180,lte=180"`
+}
+
+type GeofenceRequest struct {
+	Name      string  `json:"name" binding:"required,max=64"`
+	Type      string  `json:"type" binding:"required,oneof=circle polygon"`
+	Latitude  float64 `json:"latitude,omitempty" binding:"gte=-90,lte=90"`
+	Longitude float64 `json:"longitude,omitempty" binding:"gte=-180,lte=180"`
+	// Place is a place name resolved through the gazetteer in place of Latitude and Longitude;
+	// only the resolved coordinates are stored.
+	Place        string       `json:"place,omitempty" binding:"max=200"`
+	Radius       float64      `json:"radius,omitempty" binding:"gte=0"`
+	Polygon      []Coordinate `json:"polygon,omitempty" binding:"dive"`
+	Usernames    []string     `json:"usernames,omitempty" binding:"dive,min=4,max=16,alphanum"`
+	ActiveFrom   string       `json:"active_from,omitempty"`
+	ActiveUntil  string       `json:"active_until,omitempty"`
+	DwellSeconds int          `json:"dwell_seconds,omitempty" binding:"gte=0"`
+}
+
+type Geofence struct {
+	ID int64 `json:"id"`
+	GeofenceRequest
+	CreatedAt time.Time `json:"created_at"`
+	// ResolvedPlace is the center's place when a create or update request named one.
+	ResolvedPlace *ResolvedPlace `json:"resolved_place,omitempty"`
+}
+
+type GeofenceEvent struct {
+	ID         int64     `json:"id"`
+	GeofenceID int64     `json:"geofence_id"`
+	Username   string    `json:"username"`
+	Event      string    `json:"event"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type GeofenceEventsRequest struct {
+	StartTime time.Time `form:"start_time"`
+	EndTime   time.Time `form:"end_time"`
+}
+
+var errGeofenceNotFound = fmt.Errorf("geofence %w", errNotFound)
+
+// validate checks the rules that depend on the fence type, which binding tags cannot express.
+func (req GeofenceRequest) validate() error {
+	switch req.Type {
+	case "circle":
+		if req.Radius <= 0 {
+			return errors.New("circle geofences need a positive radius")
+		}
+		if len(req.Polygon) > 0 {
+			return errors.New("circle geofences cannot have a polygon")
+		}
+		if req.Place != "" && (req.Latitude != 0 || req.Longitude != 0) {
+			return errors.New("place cannot be combined with latitude and longitude")
+		}
+	case "polygon":
+		if len(req.Polygon) < 3 {
+			return errors.New("polygon geofences need at least 3 points")
+		}
+		if req.Place != "" {
+			return errors.New("polygon geofences cannot have a place")
+		}
+	}
+	if (req.ActiveFrom == "") != (req.ActiveUntil == "") {
+		return errors.New("active_from and active_until must be set together")
+	}
+	if req.ActiveFrom != "" {
+		if _, err := time.Parse(activeTimeLayout, req.ActiveFrom); err != nil {
+			return fmt.Errorf("active_from must be a HH:MM time: %v", err)
+		}
+		if _, err := time.Parse(activeTimeLayout, req.ActiveUntil); err != nil {
+			return fmt.Errorf("active_until must be a HH:MM time: %v", err)
+		}
+	}
+	return nil
+}
+
+func (g Geofence) contains(latitude, longitude float64) bool {
+	if g.Type == "circle" {
+		return distance(g.Latitude, g.Longitude, latitude, longitude) <= g.Radius
+	}
+	return pointInPolygon(g.Polygon, latitude, longitude)
+}
+
+// pointInPolygon casts a ray along the latitude and counts the polygon edges it crosses.
+func pointInPolygon(polygon []Coordinate, latitude, longitude float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Latitude > latitude) != (b.Latitude > latitude) &&
+			longitude < (b.Longitude-a.Longitude)*(latitude-a.Latitude)/(b.Latitude-a.Latitude)+a.Longitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (g Geofence) appliesTo(username string) bool {
+	if len(g.Usernames) == 0 {
+		return true
+	}
+	for _, u := range g.Usernames {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAt reports whether now falls in the fence's daily window; windows may wrap past midnight.
+func (g Geofence) activeAt(now time.Time) bool {
+	if g.ActiveFrom == "" {
+		return true
+	}
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	from, _ := time.Parse(activeTimeLayout, g.ActiveFrom)
+	until, _ := time.Parse(activeTimeLayout, g.ActiveUntil)
+	start := from.Hour()*60 + from.Minute()
+	end := until.Hour()*60 + until.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+func scanGeofence(scanner interface{ Scan(...interface{}) error }) (Geofence, error) {
+	var g Geofence
+	var polygon, usernames string
+	err := scanner.Scan(&g.ID, &g.Name, &g.Type, &g.Latitude, &g.Longitude, &g.Radius, &polygon, &usernames,
+		&g.ActiveFrom, &g.ActiveUntil, &g.DwellSeconds, &g.CreatedAt)
+	if err != nil {
+		return g, err
+	}
+	if err := json.Unmarshal([]byte(polygon), &g.Polygon); err != nil {
+		return g, err
+	}
+	if err := json.Unmarshal([]byte(usernames), &g.Usernames); err != nil {
+		return g, err
+	}
+	return g, nil
+}
+
+const geofenceColumns = "id, name, type, latitude, longitude, radius, polygon, usernames, active_from, active_until, dwell_seconds, created_at"
+
+func listGeofences(db *sql.DB) ([]Geofence, error) {
+	rows, err := db.Query("SELECT " + geofenceColumns + " FROM geofences ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	geofences := []Geofence{}
+	for rows.Next() {
+		g, err := scanGeofence(rows)
+		if err != nil {
+			return nil, err
+		}
+		geofences = append(geofences, g)
+	}
+	return geofences, rows.Err()
+}
+
+func getGeofence(db *sql.DB, id int64) (Geofence, error) {
+	g, err := scanGeofence(db.QueryRow("SELECT "+geofenceColumns+" FROM geofences WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return g, errGeofenceNotFound
+	}
+	return g, err
+}
+
+func geofenceArgs(req GeofenceRequest) ([]interface{}, error) {
+	if req.Polygon == nil {
+		req.Polygon = []Coordinate{}
+	}
+	if req.Usernames == nil {
+		req.Usernames = []string{}
+	}
+	polygon, err := json.Marshal(req.Polygon)
+	if err != nil {
+		return nil, err
+	}
+	usernames, err := json.Marshal(req.Usernames)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{req.Name, req.Type, req.Latitude, req.Longitude, req.Radius, string(polygon), string(usernames),
+		req.ActiveFrom, req.ActiveUntil, req.DwellSeconds}, nil
+}
+
+func createGeofence(db *sql.DB, req GeofenceRequest, now time.Time) (Geofence, error) {
+	args, err := geofenceArgs(req)
+	if err != nil {
+		return Geofence{}, err
+	}
+	res, err := db.Exec(`INSERT INTO geofences (name, type, latitude, longitude, radius, polygon, usernames, active_from, active_until, dwell_seconds, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, append(args, now.UTC())...)
+	if err != nil {
+		return Geofence{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Geofence{}, err
+	}
+	return getGeofence(db, id)
+}
+
+func updateGeofence(db *sql.DB, id int64, req GeofenceRequest) (Geofence, error) {
+	args, err := geofenceArgs(req)
+	if err != nil {
+		return Geofence{}, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return Geofence{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE geofences SET name = ?, type = ?, latitude = ?, longitude = ?, radius = ?, polygon = ?, usernames = ?,
+		active_from = ?, active_until = ?, dwell_seconds = ? WHERE id = ?`, append(args, id)...)
+	if err != nil {
+		return Geofence{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Geofence{}, err
+	} else if n == 0 {
+		return Geofence{}, errGeofenceNotFound
+	}
+	// The stays were measured against the old shape and users; the next fix starts them afresh.
+	if _, err := tx.Exec("DELETE FROM geofence_states WHERE geofence_id = ?", id); err != nil {
+		return Geofence{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Geofence{}, err
+	}
+	return getGeofence(db, id)
+}
+
+func deleteGeofence(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM geofences WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errGeofenceNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM geofence_states WHERE geofence_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type geofenceState struct {
+	enteredAt     time.Time
+	dwellReported bool
+}
+
+// dwellCheckInterval is how often stays are checked for dwell events without a new fix.
+const dwellCheckInterval = 30 * time.Second
+
+func insertGeofenceEvent(tx *sql.Tx, e GeofenceEvent) (GeofenceEvent, error) {
+	res, err := tx.Exec("INSERT INTO geofence_events (geofence_id, username, event, latitude, longitude, timestamp) VALUES (?, ?, ?, ?, ?, ?)",
+		e.GeofenceID, e.Username, e.Event, e.Latitude, e.Longitude, e.Timestamp)
+	if err != nil {
+		return e, err
+	}
+	e.ID, err = res.LastInsertId()
+	return e, err
+}
+
+// markDwellReported records that a stay's dwell event was sent, reporting false when another
+// check got there first.
+func markDwellReported(tx *sql.Tx, geofenceID int64, username string) (bool, error) {
+	res, err := tx.Exec("UPDATE geofence_states SET dwell_reported = 1 WHERE geofence_id = ? AND username = ? AND dwell_reported = 0",
+		geofenceID, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// evaluateGeofences compares a user's new position with every fence that applies to them and
+// stores an event for each fence they entered, left or have now stayed in for its dwell time.
+// Events happen at the time of the fix, so queued fixes uploaded together keep their own times;
+// now is only used for fixes without one.
+func evaluateGeofences(db *sql.DB, req LocationUpdateRequest, now time.Time) ([]GeofenceEvent, error) {
+	geofences, err := listGeofences(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(geofences) == 0 {
+		return nil, nil
+	}
+	at := req.Timestamp
+	if at.IsZero() {
+		at = now
+	}
+	at = at.UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT geofence_id, entered_at, dwell_reported FROM geofence_states WHERE username = ?", req.Username)
+	if err != nil {
+		return nil, err
+	}
+	states := map[int64]geofenceState{}
+	for rows.Next() {
+		var id int64
+		var state geofenceState
+		if err := rows.Scan(&id, &state.enteredAt, &state.dwellReported); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		states[id] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []GeofenceEvent
+	for _, g := range geofences {
+		if !g.appliesTo(req.Username) || !g.activeAt(at) {
+			continue
+		}
+		inside := g.contains(req.Latitude, req.Longitude)
+		state, wasInside := states[g.ID]
+
+		var event string
+		switch {
+		case inside && !wasInside:
+			event = GeofenceEnter
+			_, err = tx.Exec("INSERT INTO geofence_states (geofence_id, username, entered_at, dwell_reported) VALUES (?, ?, ?, 0)",
+				g.ID, req.Username, at)
+		case !inside && wasInside:
+			event = GeofenceExit
+			_, err = tx.Exec("DELETE FROM geofence_states WHERE geofence_id = ? AND username = ?", g.ID, req.Username)
+		case inside && g.DwellSeconds > 0 && !state.dwellReported &&
+			at.Sub(state.enteredAt) >= time.Duration(g.DwellSeconds)*time.Second:
+			event = GeofenceDwell
+			var marked bool
+			if marked, err = markDwellReported(tx, g.ID, req.Username); err == nil && !marked {
+				continue
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := insertGeofenceEvent(tx, GeofenceEvent{
+			GeofenceID: g.ID,
+			Username:   req.Username,
+			Event:      event,
+			Latitude:   req.Latitude,
+			Longitude:  req.Longitude,
+			Timestamp:  at,
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, tx.Commit()
+}
+
+// evaluateDwells stores a dwell event for every stay that reached its fence's dwell time by now
+// without a fix to tell, such as a device that stopped reporting once parked. The event is at
+// the moment the dwell time was reached, at the user's last known position.
+func evaluateDwells(db *sql.DB, now time.Time) ([]GeofenceEvent, error) {
+	geofences, err := listGeofences(db)
+	if err != nil {
+		return nil, err
+	}
+	dwelling := map[int64]Geofence{}
+	for _, g := range geofences {
+		if g.DwellSeconds > 0 {
+			dwelling[g.ID] = g
+		}
+	}
+	if len(dwelling) == 0 {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT s.geofence_id, s.username, s.entered_at, l.latitude, l.longitude
+		FROM geofence_states s JOIN user_locations l ON l.username = s.username WHERE s.dwell_reported = 0`)
+	if err != nil {
+		return nil, err
+	}
+	var due []GeofenceEvent
+	for rows.Next() {
+		var e GeofenceEvent
+		var enteredAt time.Time
+		if err := rows.Scan(&e.GeofenceID, &e.Username, &enteredAt, &e.Latitude, &e.Longitude); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g, ok := dwelling[e.GeofenceID]
+		if !ok {
+			continue
+		}
+		e.Event = GeofenceDwell
+		e.Timestamp = enteredAt.Add(time.Duration(g.DwellSeconds) * time.Second).UTC()
+		if !e.Timestamp.After(now) && g.appliesTo(e.Username) && g.activeAt(e.Timestamp) {
+			due = append(due, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []GeofenceEvent
+	for _, e := range due {
+		marked, err := markDwellReported(tx, e.GeofenceID, e.Username)
+		if err != nil {
+			return nil, err
+		}
+		if !marked {
+			continue
+		}
+		if e, err = insertGeofenceEvent(tx, e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, tx.Commit()
+}
+
+// checkGeofenceDwells runs evaluateDwells every dwellCheckInterval and sends the events to the
+// webhooks.
+func checkGeofenceDwells(db *sql.DB) {
+	ticker := time.NewTicker(dwellCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		var events []GeofenceEvent
+		err := retryBusy(func() (err error) {
+			events, err = evaluateDwells(db, now)
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to evaluate geofence dwells: %v", err)
+			continue
+		}
+		if len(events) == 0 {
+			continue
+		}
+		if err := enqueueWebhookEvents(db, geofenceWebhookEvents(events), now); err != nil {
+			log.Printf("Failed to queue webhook events: %v", err)
+		}
+		webhooks.notify()
+	}
+}
+
+func geofenceWebhookEvents(events []GeofenceEvent) []webhookEvent {
+	var webhookEvents []webhookEvent
+	for _, e := range events {
+		webhookEvents = append(webhookEvents, webhookEvent{Type: "geofence." + e.Event, Usernames: []string{e.Username}, Data: e})
+	}
+	return webhookEvents
+}
+
+func listGeofenceEvents(db *sql.DB, column string, value interface{}, req GeofenceEventsRequest) ([]GeofenceEvent, error) {
+	if req.EndTime.IsZero() {
+		req.EndTime = time.Now()
+	}
+	rows, err := db.Query("SELECT id, geofence_id, username, event, latitude, longitude, timestamp FROM geofence_events WHERE "+column+" = ? AND timestamp BETWEEN ? AND ? ORDER BY id",
+		value, req.StartTime.UTC(), req.EndTime.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []GeofenceEvent{}
+	for rows.Next() {
+		var e GeofenceEvent
+		if err := rows.Scan(&e.ID, &e.GeofenceID, &e.Username, &e.Event, &e.Latitude, &e.Longitude, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// bindGeofenceRequest binds and validates a geofence, resolving the place of its center if given.
+func bindGeofenceRequest(c *gin.Context) (GeofenceRequest, *ResolvedPlace, bool) {
+	var req GeofenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, nil, false
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, nil, false
+	}
+	if req.Place == "" {
+		return req, nil, true
+	}
+	resolved, ok := resolveCenter(c, req.Place)
+	if !ok {
+		return req, nil, false
+	}
+	req.Latitude, req.Longitude, req.Place = resolved.Latitude, resolved.Longitude, ""
+	return req, resolved, true
+}
+
+func CreateGeofenceHandler(c *gin.Context, db *sql.DB) {
+	req, resolved, ok := bindGeofenceRequest(c)
+	if !ok {
+		return
+	}
+
+	g, err := createGeofence(db, req, time.Now())
+	if err != nil {
+		respondError(c, err, "create geofence")
+		return
+	}
+	g.ResolvedPlace = resolved
+	c.JSON(http.StatusCreated, g)
+}
+
+func ListGeofencesHandler(c *gin.Context, db *sql.DB) {
+	geofences, err := listGeofences(db)
+	if err != nil {
+		respondError(c, err, "list geofences")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"geofences": geofences})
+}
+
+func GetGeofenceHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	g, err := getGeofence(db, uri.ID)
+	if err != nil {
+		respondError(c, err, "get geofence")
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func UpdateGeofenceHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req, resolved, ok := bindGeofenceRequest(c)
+	if !ok {
+		return
+	}
+
+	g, err := updateGeofence(db, uri.ID, req)
+	if err != nil {
+		respondError(c, err, "update geofence")
+		return
+	}
+	g.ResolvedPlace = resolved
+	c.JSON(http.StatusOK, g)
+}
+
+func DeleteGeofenceHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleteGeofence(db, uri.ID); err != nil {
+		respondError(c, err, "delete geofence")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "geofence deleted"})
+}
+
+func GetGeofenceEventsHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req GeofenceEventsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := listGeofenceEvents(db, "geofence_id", uri.ID, req)
+	if err != nil {
+		respondError(c, err, "list geofence events")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+func GetUserGeofenceEventsHandler(c *gin.Context, db *sql.DB) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req GeofenceEventsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := listGeofenceEvents(db, "username", uri.Username, req)
+	if err != nil {
+		respondError(c, err, "list geofence events")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeofenceHandlers(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	r := gin.Default()
+	r.POST("/api/v1/geofences", func(c *gin.Context) {
+		CreateGeofenceHandler(c, testDB)
+	})
+	r.GET("/api/v1/geofences/:id", func(c *gin.Context) {
+		GetGeofenceHandler(c, testDB)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/geofences", bytes.NewBufferString(
+		`{"name":"Depot","type":"circle","latitude":45.2671,"longitude":19.8335,"radius":0.5,"usernames":["testuser"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":1`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/geofences/1", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Depot")
+
+	// Polygons need at least three points
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/geofences", bytes.NewBufferString(
+		`{"name":"Line","type":"polygon","polygon":[{"latitude":45,"longitude":19},{"latitude":46,"longitude":20}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/geofences/2", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestEvaluateGeofences(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	_, err := createGeofence(testDB, GeofenceRequest{
+		Name: "Depot", Type: "circle", Latitude: 45.2671, Longitude: 19.8335, Radius: 0.5, DwellSeconds: 60,
+	}, now)
+	assert.NoError(t, err)
+	_, err = createGeofence(testDB, GeofenceRequest{
+		Name: "Other", Type: "polygon", Usernames: []string{"otheruser"},
+		Polygon: []Coordinate{{45, 19}, {46, 19}, {46, 20}, {45, 20}},
+	}, now)
+	assert.NoError(t, err)
+
+	update := func(latitude, longitude float64, at time.Time) []string {
+		events, err := evaluateGeofences(testDB, LocationUpdateRequest{Username: "testuser", Latitude: latitude, Longitude: longitude}, at)
+		assert.NoError(t, err)
+		var names []string
+		for _, e := range events {
+			names = append(names, e.Event)
+		}
+		return names
+	}
+
+	assert.Empty(t, update(44.7866, 20.4489, now))
+	assert.Equal(t, []string{GeofenceEnter}, update(45.2672, 19.8336, now.Add(time.Minute)))
+	assert.Empty(t, update(45.2673, 19.8337, now.Add(90*time.Second)))
+	assert.Equal(t, []string{GeofenceDwell}, update(45.2673, 19.8337, now.Add(2*time.Minute)))
+	assert.Empty(t, update(45.2673, 19.8337, now.Add(3*time.Minute)))
+	assert.Equal(t, []string{GeofenceExit}, update(44.7866, 20.4489, now.Add(4*time.Minute)))
+
+	events, err := listGeofenceEvents(testDB, "username", "testuser", GeofenceEventsRequest{EndTime: now.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+}
+
+func TestUpdateGeofenceResetsStays(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	req := GeofenceRequest{Name: "Depot", Type: "circle", Latitude: 45.2671, Longitude: 19.8335, Radius: 0.5}
+	g, err := createGeofence(testDB, req, now)
+	assert.NoError(t, err)
+	events, err := evaluateGeofences(testDB, LocationUpdateRequest{Username: "testuser", Latitude: 45.2672, Longitude: 19.8336}, now)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	// Moving the geofence away drops the stay instead of reporting an exit from the new shape.
+	req.Latitude, req.Longitude = 44.7866, 20.4489
+	_, err = updateGeofence(testDB, g.ID, req)
+	assert.NoError(t, err)
+	var stays int
+	assert.NoError(t, testDB.QueryRow("SELECT COUNT(*) FROM geofence_states WHERE geofence_id = ?", g.ID).Scan(&stays))
+	assert.Equal(t, 0, stays)
+
+	events, err = evaluateGeofences(testDB, LocationUpdateRequest{Username: "testuser", Latitude: 45.2672, Longitude: 19.8336}, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, err = updateGeofence(testDB, g.ID+1, req)
+	assert.ErrorIs(t, err, errGeofenceNotFound)
+}
+
+func TestGeofenceEventsAtFixTime(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	_, err := createGeofence(testDB, GeofenceRequest{
+		Name: "Depot", Type: "circle", Latitude: 45.2671, Longitude: 19.8335, Radius: 0.5, DwellSeconds: 60,
+		ActiveFrom: "08:00", ActiveUntil: "18:00",
+	}, start)
+	assert.NoError(t, err)
+
+	// Fixes queued offline arrive together at 20:00, outside the window, and still count.
+	uploaded := start.Add(8 * time.Hour)
+	var events []GeofenceEvent
+	for _, fix := range []struct {
+		latitude, longitude float64
+		offset              time.Duration
+	}{{45.2672, 19.8336, 0}, {45.2673, 19.8337, 30 * time.Second}, {45.2673, 19.8337, 90 * time.Second}, {44.7866, 20.4489, 5 * time.Minute}} {
+		req := LocationUpdateRequest{Username: "testuser", Latitude: fix.latitude, Longitude: fix.longitude, Timestamp: start.Add(fix.offset)}
+		e, err := evaluateGeofences(testDB, req, uploaded)
+		assert.NoError(t, err)
+		events = append(events, e...)
+	}
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, GeofenceEnter, events[0].Event)
+		assert.Equal(t, start, events[0].Timestamp)
+		assert.Equal(t, GeofenceDwell, events[1].Event)
+		assert.Equal(t, start.Add(90*time.Second), events[1].Timestamp)
+		assert.Equal(t, GeofenceExit, events[2].Event)
+		assert.Equal(t, start.Add(5*time.Minute), events[2].Timestamp)
+	}
+}
+
+func TestEvaluateDwells(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	_, err := createGeofence(testDB, GeofenceRequest{
+		Name: "Depot", Type: "circle", Latitude: 45.2671, Longitude: 19.8335, Radius: 0.5, DwellSeconds: 60,
+	}, start)
+	assert.NoError(t, err)
+	_, err = createGeofence(testDB, GeofenceRequest{
+		Name: "Yard", Type: "circle", Latitude: 45.2671, Longitude: 19.8335, Radius: 1,
+	}, start)
+	assert.NoError(t, err)
+
+	// The device reports once inside and then goes quiet.
+	req := LocationUpdateRequest{Username: "testuser", Latitude: 45.2672, Longitude: 19.8336, Timestamp: start}
+	assert.NoError(t, updateLocation(testDB, req))
+	events, err := evaluateGeofences(testDB, req, start)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	events, err = evaluateDwells(testDB, start.Add(30*time.Second))
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	events, err = evaluateDwells(testDB, start.Add(10*time.Minute))
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, GeofenceDwell, events[0].Event)
+		assert.Equal(t, start.Add(time.Minute), events[0].Timestamp)
+		assert.Equal(t, 45.2672, events[0].Latitude)
+		assert.NotZero(t, events[0].ID)
+	}
+
+	// Neither the next check nor the next fix reports it again.
+	events, err = evaluateDwells(testDB, start.Add(20*time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	req.Timestamp = start.Add(30 * time.Minute)
+	events, err = evaluateGeofences(testDB, req, req.Timestamp)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestGeofenceActiveWindow(t *testing.T) {
+	g := Geofence{GeofenceRequest: GeofenceRequest{ActiveFrom: "22:00", ActiveUntil: "06:00"}}
+
+	assert.True(t, g.activeAt(time.Date(2024, time.July, 1, 23, 30, 0, 0, time.UTC)))
+	assert.True(t, g.activeAt(time.Date(2024, time.July, 1, 5, 59, 0, 0, time.UTC)))
+	assert.False(t, g.activeAt(time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)))
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -17,17 +20,32 @@ import (
 )
 
 type LocationUpdateRequest struct {
-	Username  string  `json:"username" binding:"required,min=4,max=16,alphanum"`
-	Latitude  float64 `json:"latitude" binding:"required,gte=-90,lte=90"`
-	Longitude float64 `json:"longitude" binding:"required,gte=-180,lte=180"`
+	Username  string    `json:"username" binding:"required,min=4,max=16,alphanum"`
+	Latitude  float64   `json:"latitude" binding:"required_without=Position,gte=-90,lte=90"`
+	Longitude float64   `json:"longitude" binding:"required_without=Position,gte=-180,lte=180"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Accuracy  float64   `json:"accuracy,omitempty" binding:"gte=0"`
+	// Position is a position string in one of the formats of parsePosition, in place of Latitude
+	// and Longitude.
+	Position string `json:"position,omitempty" binding:"max=100"`
 }
 
 type SearchRequest struct {
-	Latitude  float64 `form:"latitude" binding:"required,gte=-90,lte=90"`
-	Longitude float64 `form:"longitude" binding:"required,gte=-180,lte=180"`
-	Radius    float64 `form:"radius" binding:"required"`
-	Page      int     `form:"page" binding:"required"`
-	Size      int     `form:"size" binding:"required"`
+	Latitude  float64 `form:"latitude" binding:"required_without_all=Place Position,gte=-90,lte=90"`
+	Longitude float64 `form:"longitude" binding:"required_without_all=Place Position,gte=-180,lte=180"`
+	// Place is a place name resolved through the gazetteer in place of Latitude and Longitude.
+	Place string `form:"place" binding:"max=200"`
+	// Position is a position string in one of the formats of parsePosition.
+	Position string  `form:"position" binding:"max=100"`
+	Radius   float64 `form:"radius" binding:"required"`
+	Page     int     `form:"page" binding:"required"`
+	Size     int     `form:"size" binding:"required"`
+	// With Cluster set, users close together at map zoom level Zoom are returned as clusters.
+	Cluster bool `form:"cluster"`
+	Zoom    *int `form:"zoom" binding:"omitempty,gte=0,lte=22"`
+	// With NearestPOI set, every user returned has the POI nearest to them, of POICategory if given.
+	NearestPOI  bool   `form:"nearest_poi"`
+	POICategory string `form:"poi_category" binding:"max=32"`
 }
 
 type DistanceRequest struct {
@@ -36,25 +54,134 @@ type DistanceRequest struct {
 	EndTime   time.Time `form:"end_time"`
 }
 
+type UserURI struct {
+	Username string `uri:"username" binding:"required,min=4,max=16,alphanum"`
+}
+
+type IDURI struct {
+	ID int64 `uri:"id" binding:"required,gt=0"`
+}
+
 type UserLocation struct {
 	Username  string  `json:"username"`
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
+	Place     *Place  `json:"place,omitempty"`
+	// NearestPOI is set by searches that ask for it.
+	NearestPOI *NearbyPOI `json:"nearest_poi,omitempty"`
 }
 
 type SearchResponse struct {
-	Users      []UserLocation `json:"users"`
-	Page       int            `json:"page"`
-	TotalPages int            `json:"total_pages"`
-	TotalUsers int            `json:"total_users"`
+	Users      []UserLocation  `json:"users"`
+	Clusters   []SearchCluster `json:"clusters,omitempty"`
+	Page       int             `json:"page"`
+	TotalPages int             `json:"total_pages"`
+	TotalUsers int             `json:"total_users"`
+	// ClusteredUsers counts the users in clusters, who are not part of the pages or TotalUsers.
+	ClusteredUsers int `json:"clustered_users,omitempty"`
+	// ResolvedPlace is the place searched around when the request named one.
+	ResolvedPlace *ResolvedPlace `json:"resolved_place,omitempty"`
+}
+
+// resolvePosition sets the coordinates of an update that gave them as a position string.
+func (req *LocationUpdateRequest) resolvePosition() error {
+	if req.Position == "" {
+		return nil
+	}
+	if req.Latitude != 0 || req.Longitude != 0 {
+		return errors.New("position cannot be combined with latitude and longitude")
+	}
+	var err error
+	req.Latitude, req.Longitude, err = parsePosition(req.Position)
+	return err
 }
 
+// errStaleLocation is returned by updateLocation for a fix older than the stored position, which
+// happens when a device uploads the positions it queued while offline.
+var errStaleLocation = errors.New("location is older than the current position")
+
 func updateLocation(db *sql.DB, req LocationUpdateRequest) error {
-	_, err := db.Exec("INSERT OR REPLACE INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)",
-		req.Username, req.Latitude, req.Longitude)
+	if req.Timestamp.IsZero() {
+		req.Timestamp = time.Now()
+	}
+	res, err := db.Exec(`INSERT INTO user_locations (username, latitude, longitude, accuracy, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET latitude = excluded.latitude, longitude = excluded.longitude,
+			accuracy = excluded.accuracy, updated_at = excluded.updated_at
+		WHERE user_locations.updated_at IS NULL OR user_locations.updated_at <= excluded.updated_at`,
+		req.Username, req.Latitude, req.Longitude, req.Accuracy, req.Timestamp.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errStaleLocation
+	}
+	return nil
+}
+
+// busyRetries is how often retryBusy runs a transaction that found the database busy.
+const busyRetries = 5
+
+// retryBusy runs fn again when it fails with SQLITE_BUSY. A deferred transaction that reads before
+// it writes gets SQLITE_BUSY_SNAPSHOT straight away, without waiting out the busy timeout, when
+// another connection committed since its read; running it again reads the new snapshot.
+func retryBusy(fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= busyRetries; attempt++ {
+		var sqliteErr sqlite3.Error
+		if err = fn(); !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrBusy {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
 	return err
 }
 
+// locationUpdated runs the checks that react to a position stored by updateLocation. The update
+// is already accepted at this point, so failures are logged instead of returned.
+func locationUpdated(db *sql.DB, req LocationUpdateRequest, now time.Time) {
+	timestamp := req.Timestamp
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+	location := LocationEvent{Username: req.Username, Latitude: req.Latitude, Longitude: req.Longitude, Timestamp: timestamp.UTC()}
+	if publisher != nil {
+		if err := publisher.Publish(location); err != nil {
+			log.Printf("Failed to publish location event: %v", err)
+		}
+	}
+
+	events := []webhookEvent{{Type: EventLocationUpdated, Usernames: []string{req.Username}, Data: location}}
+
+	var geofenceEvents []GeofenceEvent
+	err := retryBusy(func() (err error) {
+		geofenceEvents, err = evaluateGeofences(db, req, now)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to evaluate geofences: %v", err)
+	}
+	events = append(events, geofenceWebhookEvents(geofenceEvents)...)
+
+	var proximityEvents []ProximityEvent
+	err = retryBusy(func() (err error) {
+		proximityEvents, err = evaluateProximity(db, req, now)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to evaluate proximity rules: %v", err)
+	}
+	for _, e := range proximityEvents {
+		events = append(events, webhookEvent{Type: "proximity." + e.Event, Usernames: []string{e.UserA, e.UserB}, Data: e})
+	}
+
+	if err := enqueueWebhookEvents(db, events, now); err != nil {
+		log.Printf("Failed to queue webhook events: %v", err)
+	}
+	webhooks.notify()
+}
+
 func searchUsers(db *sql.DB, req SearchRequest) SearchResponse {
 	rows, err := db.Query("SELECT username, latitude, longitude FROM user_locations")
 	if err != nil {
@@ -73,20 +200,33 @@ func searchUsers(db *sql.DB, req SearchRequest) SearchResponse {
 		}
 	}
 
-	totalUsers := len(users)
-	totalPages := int(math.Ceil(float64(totalUsers) / float64(req.Size)))
-	start := (req.Page - 1) * req.Size
-	end := start + req.Size
-	if end > totalUsers {
-		end = totalUsers
+	// Clusters are returned whole with the first page; the pages hold the users outside them.
+	var clusters []SearchCluster
+	clusteredUsers := 0
+	if req.Cluster {
+		clusters, users = clusterUsers(users, *req.Zoom)
+		for _, cluster := range clusters {
+			clusteredUsers += cluster.Count
+		}
+		if req.Page > 1 {
+			clusters = nil
+		}
 	}
+	totalPages := int(math.Ceil(float64(len(users)) / float64(req.Size)))
+	start := min((req.Page-1)*req.Size, len(users))
+	end := min(start+req.Size, len(users))
 	paginatedUsers := users[start:end]
+	for i := range paginatedUsers {
+		paginatedUsers[i].Place = reverseGeocode(paginatedUsers[i].Latitude, paginatedUsers[i].Longitude)
+	}
 
 	return SearchResponse{
-		Users:      paginatedUsers,
-		Page:       req.Page,
-		TotalPages: totalPages,
-		TotalUsers: totalUsers,
+		Users:          paginatedUsers,
+		Clusters:       clusters,
+		Page:           req.Page,
+		TotalPages:     totalPages,
+		TotalUsers:     len(users),
+		ClusteredUsers: clusteredUsers,
 	}
 }
 
@@ -101,18 +241,55 @@ func distance(lat1, lon1, lat2, lon2 float64) float64 {
 	return R * c
 }
 
-func UpdateLocationHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
-	var req LocationUpdateRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// errNotFound is wrapped by the errors returned when a stored record does not exist.
+var errNotFound = errors.New("not found")
+
+// respondError answers 404 for missing records and logs anything else as an internal error.
+func respondError(c *gin.Context, err error, action string) {
+	if errors.Is(err, errNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	log.Printf("Failed to %s: %v", action, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+}
 
-	conn, err := grpc.DialContext(context.Background(), grpcHostname+":50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+// dialLocationHistory connects to the history service on port 50051 of grpcHostname, or on the
+// port grpcHostname names itself.
+func dialLocationHistory(grpcHostname string) (*grpc.ClientConn, error) {
+	target := grpcHostname
+	if _, _, err := net.SplitHostPort(grpcHostname); err != nil {
+		target = net.JoinHostPort(grpcHostname, "50051")
+	}
+	return grpc.DialContext(context.Background(), target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// updateError tells which step of a location update failed.
+type updateError struct {
+	message string
+	err     error
+}
+
+func (e *updateError) Error() string {
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *updateError) Unwrap() error {
+	return e.err
+}
+
+// storeLocationUpdate stores a validated update in the location history microservice and as the
+// user's current position, for every protocol devices report with.
+func storeLocationUpdate(grpcHostname string, db *sql.DB, req LocationUpdateRequest) error {
+	// A device clock running ahead would otherwise hide every later fix as stale.
+	now := time.Now()
+	if req.Timestamp.IsZero() || req.Timestamp.After(now) {
+		req.Timestamp = now
+	}
+
+	conn, err := dialLocationHistory(grpcHostname)
 	if err != nil {
-		log.Printf("Failed to connect to location history microservice: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to location history microservice"})
-		return
+		return &updateError{"Failed to connect to location history microservice", err}
 	}
 	defer conn.Close()
 
@@ -122,20 +299,89 @@ func UpdateLocationHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
 		Username:  req.Username,
 		Latitude:  req.Latitude,
 		Longitude: req.Longitude,
+		Timestamp: timestamppb.New(req.Timestamp),
+		Accuracy:  req.Accuracy,
 	})
 	if err != nil {
-		log.Printf("Failed to update location in microservice: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update location in microservice"})
-		return
+		return &updateError{"Failed to update location in microservice", err}
+	}
+
+	err = updateLocation(db, req)
+	if errors.Is(err, errStaleLocation) {
+		// The fix is part of the history but the current position is newer. Events describe the
+		// current position, so the fix is not published, sent to webhooks or checked against
+		// geofences and proximity rules, which would move consumers and stays back in time.
+		return nil
 	}
+	if err != nil {
+		return &updateError{"Failed to update location in database", err}
+	}
+
+	locationUpdated(db, req, now)
+	return nil
+}
+
+// processLocationUpdate stores a validated update for an HTTP handler. On failure it writes the
+// error response and returns false.
+func processLocationUpdate(c *gin.Context, grpcHostname string, db *sql.DB, req LocationUpdateRequest) bool {
+	if err := storeLocationUpdate(grpcHostname, db, req); err != nil {
+		log.Print(err)
+		message := "Failed to update location"
+		var updateErr *updateError
+		if errors.As(err, &updateErr) {
+			message = updateErr.message
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+		return false
+	}
+	return true
+}
 
-	if err := updateLocation(db, req); err != nil {
-		log.Printf("Failed to update location in database: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update location in database"})
+func UpdateLocationHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
+	var req LocationUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.resolvePosition(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "location updated"})
+	if processLocationUpdate(c, grpcHostname, db, req) {
+		c.JSON(http.StatusOK, gin.H{"status": "location updated"})
+	}
+}
+
+// searchCenter sets the center of a search that gave a place or a position string instead of
+// coordinates. On failure it writes the error response and returns false.
+func searchCenter(c *gin.Context, req *SearchRequest) (*ResolvedPlace, bool) {
+	centers := 0
+	for _, given := range []bool{req.Latitude != 0 || req.Longitude != 0, req.Place != "", req.Position != ""} {
+		if given {
+			centers++
+		}
+	}
+	if centers > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "give only one of latitude and longitude, place or position"})
+		return nil, false
+	}
+	if req.Position != "" {
+		var err error
+		if req.Latitude, req.Longitude, err = parsePosition(req.Position); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, false
+		}
+	}
+	if req.Place == "" {
+		return nil, true
+	}
+	resolved, ok := resolveCenter(c, req.Place)
+	if !ok {
+		return nil, false
+	}
+	req.Latitude, req.Longitude = resolved.Latitude, resolved.Longitude
+	return resolved, true
 }
 
 func SearchUsersHandler(c *gin.Context, db *sql.DB) {
@@ -144,8 +390,23 @@ func SearchUsersHandler(c *gin.Context, db *sql.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Cluster && req.Zoom == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "zoom is required to cluster"})
+		return
+	}
+	resolved, ok := searchCenter(c, &req)
+	if !ok {
+		return
+	}
 
 	res := searchUsers(db, req)
+	res.ResolvedPlace = resolved
+	if req.NearestPOI {
+		if err := addNearestPOIs(db, res.Users, POIFilter{Category: req.POICategory}); err != nil {
+			respondError(c, err, "find nearest POIs")
+			return
+		}
+	}
 	c.JSON(http.StatusOK, res)
 }
 
@@ -161,7 +422,7 @@ func GetDistanceHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
 		req.EndTime = time.Now()
 	}
 
-	conn, err := grpc.DialContext(context.Background(), grpcHostname+":50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := dialLocationHistory(grpcHostname)
 	if err != nil {
 		log.Printf("Failed to connect to location history microservice: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to location history microservice"})
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// HeatmapRequest selects the fixes of a heatmap. BBox is "west,south,east,north" in degrees.
+type HeatmapRequest struct {
+	BBox      string    `form:"bbox" binding:"required"`
+	Zoom      *int      `form:"zoom" binding:"required,gte=0,lte=22"`
+	StartTime time.Time `form:"start_time"`
+	EndTime   time.Time `form:"end_time"`
+	K         int       `form:"k" binding:"gte=0"`
+}
+
+// heatmapPrecision picks the geohash precision for a zoom level: the coarsest one with at least
+// 16 cells across a map tile, which at 256 pixels a tile is a cell every 16 pixels or less.
+func heatmapPrecision(zoom int) int32 {
+	for precision := 1; precision < 8; precision++ {
+		if lonBits := (5*precision + 1) / 2; lonBits >= zoom+4 {
+			return int32(precision)
+		}
+	}
+	return 8
+}
+
+func parseBBox(bbox string) (west, south, east, north float64, err error) {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, errors.New("bbox must be west,south,east,north")
+	}
+	var values [4]float64
+	for i, part := range parts {
+		if values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+			return 0, 0, 0, 0, errors.New("bbox must be west,south,east,north")
+		}
+	}
+	return values[0], values[1], values[2], values[3], nil
+}
+
+// heatmapGeoJSON returns the cells as a FeatureCollection of rectangles.
+func heatmapGeoJSON(heatmap *pb.Heatmap) gin.H {
+	features := make([]gin.H, 0, len(heatmap.Cells))
+	for _, cell := range heatmap.Cells {
+		south := heatmap.MinLatitude + float64(cell.Row)*heatmap.CellHeight
+		west := heatmap.MinLongitude + float64(cell.Column)*heatmap.CellWidth
+		north, east := south+heatmap.CellHeight, west+heatmap.CellWidth
+		features = append(features, gin.H{
+			"type": "Feature",
+			"geometry": gin.H{
+				"type":        "Polygon",
+				"coordinates": [][][2]float64{{{west, south}, {east, south}, {east, north}, {west, north}, {west, south}}},
+			},
+			"properties": gin.H{"geohash": cell.Geohash, "points": cell.Points, "users": cell.Users},
+		})
+	}
+	return gin.H{
+		"type":      "FeatureCollection",
+		"precision": heatmap.Precision,
+		"min_users": heatmap.MinUsers,
+		"features":  features,
+	}
+}
+
+// heatmapCounts returns the number of fixes of every cell of the grid in rows from north to south,
+// with 0 for cells without enough users.
+func heatmapCounts(heatmap *pb.Heatmap) gin.H {
+	counts := make([]int64, int(heatmap.Rows)*int(heatmap.Columns))
+	for _, cell := range heatmap.Cells {
+		counts[int(heatmap.Rows-1-cell.Row)*int(heatmap.Columns)+int(cell.Column)] = cell.Points
+	}
+	return gin.H{
+		"precision": heatmap.Precision,
+		"min_users": heatmap.MinUsers,
+		"bbox": []float64{
+			heatmap.MinLongitude,
+			heatmap.MinLatitude,
+			heatmap.MinLongitude + float64(heatmap.Columns)*heatmap.CellWidth,
+			heatmap.MinLatitude + float64(heatmap.Rows)*heatmap.CellHeight,
+		},
+		"rows":        heatmap.Rows,
+		"columns":     heatmap.Columns,
+		"cell_width":  heatmap.CellWidth,
+		"cell_height": heatmap.CellHeight,
+		"counts":      counts,
+	}
+}
+
+// HeatmapHandler aggregates the location history into cells with at least k users, as GeoJSON or
+// as a grid of counts ("json").
+func HeatmapHandler(c *gin.Context, grpcHostname, format string) {
+	var req HeatmapRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	west, south, east, north, err := parseBBox(req.BBox)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request := &pb.HeatmapRequest{
+		MinLatitude:  south,
+		MinLongitude: west,
+		MaxLatitude:  north,
+		MaxLongitude: east,
+		Precision:    heatmapPrecision(*req.Zoom),
+		MinUsers:     int32(req.K),
+	}
+	if !req.StartTime.IsZero() {
+		request.StartTime = timestamppb.New(req.StartTime)
+	}
+	if !req.EndTime.IsZero() {
+		request.EndTime = timestamppb.New(req.EndTime)
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		heatmap, err := client.GetHeatmap(context.Background(), request)
+		if err != nil {
+			respondHistoryError(c, err, "compute heatmap")
+			return
+		}
+		if format == "geojson" {
+			c.Header("Content-Type", "application/geo+json")
+			c.JSON(http.StatusOK, heatmapGeoJSON(heatmap))
+			return
+		}
+		c.JSON(http.StatusOK, heatmapCounts(heatmap))
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+func TestHeatmapPrecision(t *testing.T) {
+	assert.Equal(t, int32(2), heatmapPrecision(0))
+	assert.Equal(t, int32(3), heatmapPrecision(4))
+	assert.Equal(t, int32(5), heatmapPrecision(9))
+	assert.Equal(t, int32(8), heatmapPrecision(16))
+	assert.Equal(t, int32(8), heatmapPrecision(22))
+}
+
+func testHeatmap() *pb.Heatmap {
+	return &pb.Heatmap{
+		Precision:    1,
+		MinUsers:     5,
+		MinLatitude:  0,
+		MinLongitude: 0,
+		CellHeight:   45,
+		CellWidth:    45,
+		Rows:         2,
+		Columns:      3,
+		Cells: []*pb.HeatmapCell{
+			{Geohash: "s", Row: 0, Column: 0, Points: 10, Users: 6},
+			{Geohash: "v", Row: 1, Column: 2, Points: 7, Users: 5},
+		},
+	}
+}
+
+func TestHeatmapGeoJSON(t *testing.T) {
+	collection := heatmapGeoJSON(testHeatmap())
+	features := collection["features"].([]gin.H)
+	if assert.Len(t, features, 2) {
+		assert.Equal(t, [][][2]float64{{{90, 45}, {135, 45}, {135, 90}, {90, 90}, {90, 45}}},
+			features[1]["geometry"].(gin.H)["coordinates"])
+		assert.Equal(t, gin.H{"geohash": "v", "points": int64(7), "users": int64(5)}, features[1]["properties"])
+	}
+	assert.Equal(t, int32(5), collection["min_users"])
+}
+
+func TestHeatmapCounts(t *testing.T) {
+	grid := heatmapCounts(testHeatmap())
+	// Rows run from north to south.
+	assert.Equal(t, []int64{0, 0, 7, 10, 0, 0}, grid["counts"])
+	assert.Equal(t, []float64{0, 0, 135, 90}, grid["bbox"])
+}
+
+func TestHeatmapHandlerValidation(t *testing.T) {
+	r := gin.Default()
+	r.GET("/api/v1/heatmap.json", func(c *gin.Context) {
+		HeatmapHandler(c, "localhost", "json")
+	})
+	for _, query := range []string{"zoom=5", "bbox=19,44,21,46", "bbox=19,44,21&zoom=5", "bbox=19,44,21,46&zoom=23", "bbox=19,44,21,46&zoom=5&k=-1"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/heatmap.json?"+query, nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// maxImportSize limits uploaded track files; the location history microservice accepts messages
+// of the same size.
+const maxImportSize = 64 << 20
+
+type ImportRequest struct {
+	Format string `form:"format" binding:"omitempty,oneof=gpx kml"`
+	DryRun bool   `form:"dry_run"`
+}
+
+type ImportSummary struct {
+	Points     int64      `json:"points"`
+	Skipped    int64      `json:"skipped"`
+	Duplicates int64      `json:"duplicates"`
+	First      *time.Time `json:"first,omitempty"`
+	Last       *time.Time `json:"last,omitempty"`
+	DryRun     bool       `json:"dry_run"`
+}
+
+// importFormats maps the content types of track files to their format.
+var importFormats = map[string]string{
+	"application/gpx+xml":                  "gpx",
+	"application/vnd.google-earth.kml+xml": "kml",
+}
+
+// readImportFile returns the uploaded file and its format, taken from the query, the file name or
+// the content type. The file is either the "file" field of a multipart form or the whole body.
+func readImportFile(c *gin.Context, format string) ([]byte, string, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, "", err
+		}
+		if format == "" {
+			format = strings.ToLower(strings.TrimPrefix(filepath.Ext(header.Filename), "."))
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, "", err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return data, format, err
+	}
+
+	if format == "" {
+		format = importFormats[c.ContentType()]
+	}
+	data, err := io.ReadAll(c.Request.Body)
+	return data, format, err
+}
+
+func ImportTrackHandler(c *gin.Context, grpcHostname string) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req ImportRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, format, err := readImportFile(c, req.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if format != "gpx" && format != "kml" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be gpx or kml"})
+		return
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		res, err := client.ImportTrack(context.Background(), &pb.ImportRequest{
+			Username: uri.Username,
+			Format:   format,
+			Data:     data,
+			DryRun:   req.DryRun,
+		}, grpc.MaxCallSendMsgSize(maxImportSize))
+		if err != nil {
+			respondHistoryError(c, err, "import track")
+			return
+		}
+
+		summary := ImportSummary{Points: res.Points, Skipped: res.Skipped, Duplicates: res.Duplicates, DryRun: req.DryRun}
+		if res.First != nil {
+			first, last := res.First.AsTime(), res.Last.AsTime()
+			summary.First, summary.Last = &first, &last
+		}
+		status := http.StatusCreated
+		if req.DryRun {
+			status = http.StatusOK
+		}
+		c.JSON(status, summary)
+	})
+}
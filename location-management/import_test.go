@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadImportFile(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "ride.GPX")
+	part.Write([]byte("<gpx></gpx>"))
+	form.Close()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/api/v1/users/testuser/import", &body)
+	c.Request.Header.Set("Content-Type", form.FormDataContentType())
+	data, format, err := readImportFile(c, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "gpx", format)
+	assert.Equal(t, "<gpx></gpx>", string(data))
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/api/v1/users/testuser/import", bytes.NewBufferString("<kml></kml>"))
+	c.Request.Header.Set("Content-Type", "application/vnd.google-earth.kml+xml")
+	data, format, err = readImportFile(c, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "kml", format)
+	assert.Equal(t, "<kml></kml>", string(data))
+}
+
+func TestImportTrackHandlerValidation(t *testing.T) {
+	r := gin.Default()
+	r.POST("/api/v1/users/:username/import", func(c *gin.Context) {
+		ImportTrackHandler(c, "localhost")
+	})
+
+	for _, url := range []string{
+		"/api/v1/users/test@user/import?format=gpx",
+		"/api/v1/users/testuser/import?format=csv",
+		"/api/v1/users/testuser/import",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString("<gpx></gpx>"))
+		req.Header.Set("Content-Type", "text/plain")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+}
@@ -2,26 +2,180 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
 )
 
 var testDB *sql.DB
 
+// startTestLocationHistory serves a stand-in for the history service on a free local port and
+// returns the address to pass as grpcHostname.
+func startTestLocationHistory(t *testing.T, service pb.LocationServiceServer) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterLocationServiceServer(s, service)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
 func setupTestDB() {
 	testDB, _ = sql.Open("sqlite3", ":memory:")
+	// Every connection to :memory: opens a separate database, so keep a single one.
+	testDB.SetMaxOpenConns(1)
 	createTableQuery := `
     CREATE TABLE IF NOT EXISTS user_locations (
         username TEXT PRIMARY KEY,
         latitude REAL,
-        longitude REAL
+        longitude REAL,
+        accuracy REAL DEFAULT 0,
+        updated_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS geofences (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        type TEXT NOT NULL,
+        latitude REAL,
+        longitude REAL,
+        radius REAL,
+        polygon TEXT,
+        usernames TEXT,
+        active_from TEXT,
+        active_until TEXT,
+        dwell_seconds INTEGER DEFAULT 0,
+        created_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS geofence_states (
+        geofence_id INTEGER,
+        username TEXT,
+        entered_at DATETIME,
+        dwell_reported INTEGER DEFAULT 0,
+        PRIMARY KEY (geofence_id, username)
+    );
+
+    CREATE TABLE IF NOT EXISTS geofence_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        geofence_id INTEGER,
+        username TEXT,
+        event TEXT,
+        latitude REAL,
+        longitude REAL,
+        timestamp DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS proximity_rules (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        usernames TEXT,
+        distance REAL,
+        hysteresis REAL,
+        created_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS proximity_states (
+        rule_id INTEGER,
+        user_a TEXT,
+        user_b TEXT,
+        PRIMARY KEY (rule_id, user_a, user_b)
+    );
+
+    CREATE TABLE IF NOT EXISTS proximity_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        rule_id INTEGER,
+        user_a TEXT,
+        user_b TEXT,
+        event TEXT,
+        distance REAL,
+        timestamp DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS devices (
+        device_id TEXT PRIMARY KEY,
+        username TEXT NOT NULL,
+        token_hash TEXT,
+        created_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS owntracks_friends (
+        username TEXT NOT NULL,
+        friend TEXT NOT NULL,
+        PRIMARY KEY (username, friend)
+    );
+
+    CREATE TABLE IF NOT EXISTS webhooks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        event_types TEXT,
+        usernames TEXT,
+        created_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        webhook_id INTEGER,
+        event_type TEXT,
+        payload TEXT,
+        attempts INTEGER DEFAULT 0,
+        next_attempt_at DATETIME,
+        last_error TEXT,
+        created_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        webhook_id INTEGER,
+        event_type TEXT,
+        payload TEXT,
+        attempts INTEGER,
+        last_error TEXT,
+        failed_at DATETIME
+    );
+
+    CREATE TABLE IF NOT EXISTS webhook_cursors (
+        name TEXT PRIMARY KEY,
+        position INTEGER NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS pois (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        category TEXT NOT NULL,
+        latitude REAL NOT NULL,
+        longitude REAL NOT NULL,
+        tags TEXT,
+        description TEXT,
+        created_at DATETIME,
+        updated_at DATETIME
+    );
+
+    CREATE VIRTUAL TABLE IF NOT EXISTS poi_index USING rtree (
+        id,
+        min_latitude, max_latitude,
+        min_longitude, max_longitude
     );
     `
 	testDB.Exec(createTableQuery)
@@ -106,6 +260,55 @@ func TestUpdateLocation(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "error")
 }
 
+// historyService records the updates sent to the history service.
+type historyService struct {
+	pb.UnimplementedLocationServiceServer
+	mu      sync.Mutex
+	updates []*pb.LocationUpdate
+}
+
+func (s *historyService) UpdateLocation(ctx context.Context, req *pb.LocationUpdate) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, req)
+	return &emptypb.Empty{}, nil
+}
+
+func TestStaleLocationUpdate(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	service := &historyService{}
+	hostname := startTestLocationHistory(t, service)
+	events := newChannelPublisher(10)
+	publisher = events
+	defer func() { publisher = nil }()
+	received, _ := events.Subscribe()
+	_, err := createWebhook(testDB, WebhookRequest{URL: "https://hooks.example.com/"}, now)
+	assert.NoError(t, err)
+	_, err = createGeofence(testDB, GeofenceRequest{Name: "Depot", Type: "circle", Latitude: 45.2671, Longitude: 19.8335, Radius: 0.5}, now)
+	assert.NoError(t, err)
+	deliveries := func() int {
+		var n int
+		assert.NoError(t, testDB.QueryRow("SELECT COUNT(*) FROM webhook_deliveries").Scan(&n))
+		return n
+	}
+
+	assert.NoError(t, storeLocationUpdate(hostname, testDB, LocationUpdateRequest{Username: "testuser", Latitude: 44.7866, Longitude: 20.4489, Timestamp: now}))
+	assert.Equal(t, now, (<-received).Timestamp)
+	assert.Equal(t, 1, deliveries())
+
+	// An older fix inside the geofence goes to the history only.
+	assert.NoError(t, storeLocationUpdate(hostname, testDB, LocationUpdateRequest{Username: "testuser", Latitude: 45.2672, Longitude: 19.8336, Timestamp: now.Add(-time.Minute)}))
+	assert.Len(t, service.updates, 2)
+	assert.Empty(t, received)
+	assert.Equal(t, 1, deliveries())
+	geofenceEvents, err := listGeofenceEvents(testDB, "username", "testuser", GeofenceEventsRequest{EndTime: now.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Empty(t, geofenceEvents)
+}
+
 func TestSearchUsers(t *testing.T) {
 	setupTestDB()
 	defer teardownTestDB()
@@ -132,3 +335,51 @@ func TestSearchUsers(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Contains(t, w.Body.String(), "testuser")
 }
+
+func TestRetryBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "busy.db") + "?_journal_mode=WAL"
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	other, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer other.Close()
+	_, err = db.Exec("CREATE TABLE counter (n INTEGER); INSERT INTO counter VALUES (0)")
+	assert.NoError(t, err)
+
+	// The first attempt reads, another connection commits, and the write then fails with
+	// SQLITE_BUSY_SNAPSHOT; the second attempt reads the new value and succeeds.
+	attempts := 0
+	err = retryBusy(func() error {
+		attempts++
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var n int
+		if err := tx.QueryRow("SELECT n FROM counter").Scan(&n); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := other.Exec("UPDATE counter SET n = n + 1"); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE counter SET n = ?", n+1); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	var n int
+	assert.NoError(t, db.QueryRow("SELECT n FROM counter").Scan(&n))
+	assert.Equal(t, 2, n)
+
+	// Other errors are returned at once.
+	attempts = 0
+	failed := errors.New("failed")
+	assert.ErrorIs(t, retryBusy(func() error { attempts++; return failed }), failed)
+	assert.Equal(t, 1, attempts)
+}
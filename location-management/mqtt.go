@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin/binding"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const (
+	mqttKeepAlive      = 60 * time.Second
+	mqttRetryInterval  = 5 * time.Second
+	mqttConnectTimeout = 10 * time.Second
+	mqttQuiesce        = 250 // milliseconds
+)
+
+// matchTopic reports whether topic matches an MQTT subscription pattern and returns the level
+// matched by the first single-level wildcard, which names the user.
+func matchTopic(pattern, topic string) (string, bool) {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+	username := ""
+	wildcard := false
+	for i, level := range patternLevels {
+		if level == "#" {
+			return username, true
+		}
+		if i >= len(topicLevels) {
+			return "", false
+		}
+		switch level {
+		case "+":
+			if !wildcard {
+				username, wildcard = topicLevels[i], true
+			}
+		case topicLevels[i]:
+		default:
+			return "", false
+		}
+	}
+	if len(patternLevels) != len(topicLevels) {
+		return "", false
+	}
+	return username, true
+}
+
+// decodeMQTTLocation accepts the JSON body of the HTTP update or a protobuf LocationUpdate.
+func decodeMQTTLocation(payload []byte) (LocationUpdateRequest, error) {
+	var req LocationUpdateRequest
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &req); err != nil {
+			return req, err
+		}
+		return req, req.resolvePosition()
+	}
+
+	var update pb.LocationUpdate
+	if err := proto.Unmarshal(payload, &update); err != nil {
+		return req, fmt.Errorf("payload is neither JSON nor a LocationUpdate: %w", err)
+	}
+	req = LocationUpdateRequest{
+		Username:  update.Username,
+		Latitude:  update.Latitude,
+		Longitude: update.Longitude,
+		Accuracy:  update.Accuracy,
+	}
+	if update.Timestamp != nil {
+		req.Timestamp = update.Timestamp.AsTime()
+	}
+	return req, nil
+}
+
+// mqttBridge subscribes to location topics on an MQTT broker and stores every position published
+// there. A message is only acknowledged once its position is stored or turned out to be invalid;
+// when storing fails, the bridge reconnects so that the broker delivers the message again.
+type mqttBridge struct {
+	broker string
+	topics []string
+	update func(LocationUpdateRequest) error
+	client mqtt.Client
+	// redeliver asks run to drop the session after a position could not be stored.
+	redeliver chan struct{}
+	retry     time.Duration
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newMQTTBridge(brokerURL, clientID string, topics []string, update func(LocationUpdateRequest) error) (*mqttBridge, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "tcp" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("MQTT broker must look like tcp://host:1883 or tls://host:8883, got %q", brokerURL)
+	}
+	if len(topics) == 0 {
+		return nil, errors.New("no MQTT topics to subscribe to")
+	}
+	for _, topic := range topics {
+		if topic == "" || strings.Contains(topic, "#") && !strings.HasSuffix(topic, "#") {
+			return nil, fmt.Errorf("invalid MQTT topic pattern %q", topic)
+		}
+	}
+
+	b := &mqttBridge{broker: u.Host, topics: topics, update: update, redeliver: make(chan struct{}, 1), retry: mqttRetryInterval,
+		done: make(chan struct{}), stopped: make(chan struct{})}
+	// Without the clean session flag the broker keeps the subscriptions and queues QoS 1 positions
+	// for the client id while the bridge reconnects. The user name and password come from the URL.
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(clientID).
+		SetCleanSession(false).
+		SetKeepAlive(mqttKeepAlive).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection to %s lost: %v", b.broker, err)
+		})
+	b.client = mqtt.NewClient(opts)
+	return b, nil
+}
+
+// run connects to the broker and reconnects whenever a position could not be stored, until close
+// is called. Lost connections are restored by the client itself.
+func (b *mqttBridge) run() {
+	defer close(b.stopped)
+	for {
+		if token := b.client.Connect(); token.Wait() && token.Error() != nil {
+			log.Printf("Failed to connect to MQTT broker %s: %v", b.broker, token.Error())
+			if !b.sleep() {
+				return
+			}
+			continue
+		}
+		select {
+		case <-b.done:
+			b.client.Disconnect(mqttQuiesce)
+			return
+		case <-b.redeliver:
+		}
+		log.Printf("Reconnecting to MQTT broker %s to receive unstored positions again", b.broker)
+		b.client.Disconnect(mqttQuiesce)
+		if !b.sleep() {
+			return
+		}
+	}
+}
+
+// sleep waits before the next connection attempt and reports false if the bridge was closed.
+func (b *mqttBridge) sleep() bool {
+	select {
+	case <-b.done:
+		return false
+	case <-time.After(b.retry):
+		return true
+	}
+}
+
+// close disconnects from the broker and waits until run has returned. Positions that are not
+// acknowledged yet are delivered again on the next start.
+func (b *mqttBridge) close() {
+	close(b.done)
+	<-b.stopped
+}
+
+func (b *mqttBridge) subscribe(client mqtt.Client) {
+	filters := map[string]byte{}
+	for _, topic := range b.topics {
+		filters[topic] = 1
+	}
+	token := client.SubscribeMultiple(filters, b.handleMessage)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		log.Printf("Failed to subscribe to MQTT topics on %s: %v", b.broker, err)
+		return
+	}
+	log.Printf("Connected to MQTT broker %s", b.broker)
+}
+
+// handleMessage stores the position of one message. Invalid positions are logged and acknowledged
+// so that the broker drops them; positions that could not be stored are left unacknowledged.
+func (b *mqttBridge) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	req, err := b.parseMessage(msg.Topic(), msg.Payload())
+	if err != nil {
+		log.Printf("Skipping MQTT message on %s: %v", msg.Topic(), err)
+		msg.Ack()
+		return
+	}
+	if err := b.update(req); err != nil {
+		log.Printf("Failed to store MQTT position on %s: %v", msg.Topic(), err)
+		select {
+		case b.redeliver <- struct{}{}:
+		default:
+		}
+		return
+	}
+	msg.Ack()
+}
+
+// parseMessage returns the validated position of a message.
+func (b *mqttBridge) parseMessage(topic string, payload []byte) (LocationUpdateRequest, error) {
+	username, matched := "", false
+	for _, pattern := range b.topics {
+		if username, matched = matchTopic(pattern, topic); matched {
+			break
+		}
+	}
+	if !matched {
+		return LocationUpdateRequest{}, errors.New("topic matches none of the subscriptions")
+	}
+
+	req, err := decodeMQTTLocation(payload)
+	if err != nil {
+		return req, err
+	}
+	// A device may only publish positions for the user its topic names.
+	if username != "" {
+		if req.Username != "" && req.Username != username {
+			return req, fmt.Errorf("payload is for %s but the topic is for %s", req.Username, username)
+		}
+		req.Username = username
+	}
+	return req, binding.Validator.ValidateStruct(req)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+func TestMatchTopic(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, topic, username string
+		matched                  bool
+	}{
+		{"devices/+/location", "devices/testuser/location", "testuser", true},
+		{"devices/+/location", "devices/testuser/status", "", false},
+		{"devices/+/location", "devices/testuser/location/extra", "", false},
+		{"owntracks/+/+", "owntracks/testuser/phone", "testuser", true},
+		{"fleet/+/#", "fleet/truck007/gps/raw", "truck007", true},
+		{"fleet/positions", "fleet/positions", "", true},
+	} {
+		username, matched := matchTopic(tc.pattern, tc.topic)
+		assert.Equal(t, tc.matched, matched, tc.topic)
+		assert.Equal(t, tc.username, username, tc.topic)
+	}
+}
+
+// fakeBroker accepts one connection of the bridge at a time and answers CONNECT, SUBSCRIBE and
+// PINGREQ itself. Every other packet the bridge sends is handed to the test.
+type fakeBroker struct {
+	t       *testing.T
+	ln      net.Listener
+	conn    net.Conn
+	connect *packets.ConnectPacket
+	packets chan packets.ControlPacket
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeBroker{t: t, ln: ln}
+}
+
+// accept waits for the bridge to connect and subscribe.
+func (f *fakeBroker) accept(sessionPresent bool) {
+	conn, err := f.ln.Accept()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { conn.Close() })
+	f.conn = conn
+	f.packets = make(chan packets.ControlPacket, 10)
+
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.connect = p.(*packets.ConnectPacket)
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.SessionPresent = sessionPresent
+	f.write(connack)
+
+	subscribed := make(chan []string, 1)
+	go func(packetsCh chan packets.ControlPacket) {
+		defer close(packetsCh)
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			switch p := p.(type) {
+			case *packets.SubscribePacket:
+				suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				suback.MessageID = p.MessageID
+				suback.ReturnCodes = p.Qoss
+				f.write(suback)
+				subscribed <- p.Topics
+			case *packets.PingreqPacket:
+				f.write(packets.NewControlPacket(packets.Pingresp))
+			default:
+				packetsCh <- p
+			}
+		}
+	}(f.packets)
+	select {
+	case topics := <-subscribed:
+		assert.Equal(f.t, []string{"devices/+/location"}, topics)
+	case <-time.After(5 * time.Second):
+		f.t.Fatal("timed out waiting for the subscription")
+	}
+}
+
+func (f *fakeBroker) write(p packets.ControlPacket) {
+	if err := p.Write(f.conn); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func (f *fakeBroker) publish(topic string, id uint16, dup bool, payload []byte) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Qos = 1
+	publish.Dup = dup
+	publish.MessageID = id
+	publish.Payload = payload
+	f.write(publish)
+}
+
+// next returns the next packet of the bridge, or nil once the connection is closed.
+func (f *fakeBroker) next() packets.ControlPacket {
+	select {
+	case p := <-f.packets:
+		return p
+	case <-time.After(5 * time.Second):
+		f.t.Fatal("timed out waiting for a packet")
+		return nil
+	}
+}
+
+func (f *fakeBroker) expectPuback(id uint16) {
+	if puback, ok := f.next().(*packets.PubackPacket); assert.True(f.t, ok, "expected PUBACK") {
+		assert.Equal(f.t, id, puback.MessageID)
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	broker := newFakeBroker(t)
+	updates := make(chan LocationUpdateRequest, 10)
+	failures := 1
+	bridge, err := newMQTTBridge("tcp://bridge:secret@"+broker.ln.Addr().String(), "test-bridge", []string{"devices/+/location"},
+		func(req LocationUpdateRequest) error {
+			if req.Username == "thirduser" && failures > 0 {
+				failures--
+				return errors.New("location history is unavailable")
+			}
+			updates <- req
+			return nil
+		})
+	assert.NoError(t, err)
+	bridge.retry = 10 * time.Millisecond
+	go bridge.run()
+	defer bridge.close()
+
+	broker.accept(false)
+	assert.Equal(t, "test-bridge", broker.connect.ClientIdentifier)
+	assert.Equal(t, "bridge", broker.connect.Username)
+	assert.Equal(t, "secret", string(broker.connect.Password))
+	assert.False(t, broker.connect.CleanSession)
+
+	// JSON is stored and acknowledged
+	broker.publish("devices/testuser/location", 7, false, []byte(`{"latitude": 45.2671, "longitude": 19.8335, "accuracy": 5}`))
+	broker.expectPuback(7)
+	assert.Equal(t, LocationUpdateRequest{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Accuracy: 5}, <-updates)
+
+	// A payload naming another user than the topic is acknowledged and skipped
+	broker.publish("devices/testuser/location", 8, false, []byte(`{"username": "otheruser", "latitude": 45.1, "longitude": 19.1}`))
+	broker.expectPuback(8)
+
+	// Protobuf
+	fix, _ := proto.Marshal(&pb.LocationUpdate{
+		Latitude:  44.7866,
+		Longitude: 20.4489,
+		Timestamp: timestamppb.New(time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)),
+	})
+	broker.publish("devices/otheruser/location", 9, false, fix)
+	broker.expectPuback(9)
+	assert.Equal(t, LocationUpdateRequest{Username: "otheruser", Latitude: 44.7866, Longitude: 20.4489,
+		Timestamp: time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)}, <-updates)
+
+	// A position that cannot be stored is not acknowledged; the bridge disconnects and gets it
+	// again in the resumed session.
+	payload := []byte(`{"latitude": 45.25, "longitude": 19.84}`)
+	broker.publish("devices/thirduser/location", 10, false, payload)
+	_, disconnected := broker.next().(*packets.DisconnectPacket)
+	assert.True(t, disconnected, "expected DISCONNECT")
+	assert.Empty(t, updates)
+
+	broker.accept(true)
+	broker.publish("devices/thirduser/location", 10, true, payload)
+	broker.expectPuback(10)
+	assert.Equal(t, LocationUpdateRequest{Username: "thirduser", Latitude: 45.25, Longitude: 19.84}, <-updates)
+}
+
+// TestMQTTBridgeBroker runs the bridge against a real broker, MQTT_TEST_BROKER or one listening on
+// localhost:1883, and is skipped when there is none.
+func TestMQTTBridgeBroker(t *testing.T) {
+	brokerURL := os.Getenv("MQTT_TEST_BROKER")
+	if brokerURL == "" {
+		conn, err := net.DialTimeout("tcp", "localhost:1883", 200*time.Millisecond)
+		if err != nil {
+			t.Skip("no MQTT broker; set MQTT_TEST_BROKER or run one on localhost:1883")
+		}
+		conn.Close()
+		brokerURL = "tcp://localhost:1883"
+	}
+	prefix := fmt.Sprintf("location-management-test-%d", time.Now().UnixNano())
+
+	updates := make(chan LocationUpdateRequest, 10)
+	failures := 1
+	bridge, err := newMQTTBridge(brokerURL, prefix+"-bridge", []string{prefix + "/+/location"},
+		func(req LocationUpdateRequest) error {
+			if failures > 0 {
+				failures--
+				return errors.New("location history is unavailable")
+			}
+			updates <- req
+			return nil
+		})
+	assert.NoError(t, err)
+	bridge.retry = 10 * time.Millisecond
+	go bridge.run()
+	defer bridge.close()
+	assert.Eventually(t, bridge.client.IsConnectionOpen, 5*time.Second, 10*time.Millisecond)
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID(prefix + "-device"))
+	token := device.Connect()
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("failed to connect the device: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	// The subscription is made right after connecting; give the broker a moment to register it.
+	time.Sleep(200 * time.Millisecond)
+	token = device.Publish(prefix+"/testuser/location", 1, false, `{"latitude": 45.2671, "longitude": 19.8335}`)
+	assert.True(t, token.WaitTimeout(5*time.Second))
+	assert.NoError(t, token.Error())
+
+	// The first attempt fails, so the position is only stored once the broker delivers it again.
+	select {
+	case req := <-updates:
+		assert.Equal(t, LocationUpdateRequest{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335}, req)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the broker did not deliver the position again")
+	}
+	assert.Equal(t, 0, failures)
+}
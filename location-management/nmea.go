@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	nmeaLoginTimeout = 30 * time.Second
+	nmeaIdleTimeout  = 10 * time.Minute
+	// NMEA 0183 limits sentences to 82 characters; longer lines are rejected as malformed.
+	nmeaMaxLineLength = 256
+)
+
+var (
+	errNoFix           = errors.New("sentence carries no fix")
+	errNMEALineTooLong = fmt.Errorf("line is longer than %d characters", nmeaMaxLineLength)
+)
+
+type nmeaFix struct {
+	// timeOfDay is the UTC time since midnight; RMC sentences also carry the date.
+	timeOfDay time.Duration
+	date      time.Time
+	latitude  float64
+	longitude float64
+}
+
+// parseNMEA checks the checksum of a sentence and splits it into its fields, the first of which
+// is the address such as GPRMC.
+func parseNMEA(line string) ([]string, error) {
+	if !strings.HasPrefix(line, "$") {
+		return nil, errors.New("sentence does not start with $")
+	}
+	star := strings.LastIndexByte(line, '*')
+	if star < 0 || len(line)-star != 3 {
+		return nil, errors.New("sentence has no checksum")
+	}
+	want, err := strconv.ParseUint(line[star+1:], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum %q", line[star+1:])
+	}
+	var sum byte
+	for i := 1; i < star; i++ {
+		sum ^= line[i]
+	}
+	if byte(want) != sum {
+		return nil, fmt.Errorf("checksum %02X does not match %02X", want, sum)
+	}
+	return strings.Split(line[1:star], ","), nil
+}
+
+// parseNMEACoordinate converts ddmm.mmmm (or dddmm.mmmm for longitudes) and a hemisphere letter
+// to signed degrees.
+func parseNMEACoordinate(value, hemisphere string, degreeDigits int, negative string) (float64, error) {
+	if len(value) < degreeDigits+2 {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+	degrees, err := strconv.Atoi(value[:degreeDigits])
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+	minutes, err := strconv.ParseFloat(value[degreeDigits:], 64)
+	if err != nil || minutes >= 60 {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+	coordinate := float64(degrees) + minutes/60
+	switch hemisphere {
+	case negative:
+		return -coordinate, nil
+	case "N", "E":
+		return coordinate, nil
+	}
+	return 0, fmt.Errorf("invalid hemisphere %q", hemisphere)
+}
+
+// parseNMEATime parses hhmmss with optional fractional seconds.
+func parseNMEATime(value string) (time.Duration, error) {
+	if len(value) < 6 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	hours, err1 := strconv.Atoi(value[0:2])
+	minutes, err2 := strconv.Atoi(value[2:4])
+	seconds, err3 := strconv.ParseFloat(value[4:], 64)
+	if err1 != nil || err2 != nil || err3 != nil || hours > 23 || minutes > 59 || seconds >= 61 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), nil
+}
+
+// parseNMEAFix reads the position of an RMC or GGA sentence. Other sentences and sentences without
+// a valid fix return errNoFix.
+func parseNMEAFix(fields []string) (nmeaFix, error) {
+	var fix nmeaFix
+	if len(fields[0]) != 5 {
+		return fix, errNoFix
+	}
+
+	var timeField, latField, latHemisphere, lonField, lonHemisphere string
+	switch fields[0][2:] {
+	case "RMC":
+		if len(fields) < 10 {
+			return fix, fmt.Errorf("RMC sentence has %d fields", len(fields))
+		}
+		if fields[2] != "A" {
+			return fix, errNoFix
+		}
+		date, err := time.Parse("020106", fields[9])
+		if err != nil {
+			return fix, fmt.Errorf("invalid date %q", fields[9])
+		}
+		fix.date = date
+		timeField, latField, latHemisphere, lonField, lonHemisphere = fields[1], fields[3], fields[4], fields[5], fields[6]
+	case "GGA":
+		if len(fields) < 7 {
+			return fix, fmt.Errorf("GGA sentence has %d fields", len(fields))
+		}
+		if fields[6] == "" || fields[6] == "0" {
+			return fix, errNoFix
+		}
+		timeField, latField, latHemisphere, lonField, lonHemisphere = fields[1], fields[2], fields[3], fields[4], fields[5]
+	default:
+		return fix, errNoFix
+	}
+
+	var err error
+	if fix.timeOfDay, err = parseNMEATime(timeField); err != nil {
+		return fix, err
+	}
+	if fix.latitude, err = parseNMEACoordinate(latField, latHemisphere, 2, "S"); err != nil {
+		return fix, err
+	}
+	if fix.longitude, err = parseNMEACoordinate(lonField, lonHemisphere, 3, "W"); err != nil {
+		return fix, err
+	}
+	return fix, nil
+}
+
+// nmeaSession turns the sentences of one authenticated connection into location updates.
+type nmeaSession struct {
+	username string
+	update   func(LocationUpdateRequest) error
+	// date is taken from the last RMC sentence, since GGA sentences only carry the time of day.
+	date      time.Time
+	last      time.Time
+	fixes     int
+	malformed int
+}
+
+// handleLine returns an error only for malformed lines; failing to store a fix is logged.
+func (s *nmeaSession) handleLine(line string, now time.Time) error {
+	fields, err := parseNMEA(line)
+	if err != nil {
+		return err
+	}
+	fix, err := parseNMEAFix(fields)
+	if err == errNoFix {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !fix.date.IsZero() {
+		s.date = fix.date
+	}
+	date := s.date
+	if date.IsZero() {
+		date = now.UTC().Truncate(24 * time.Hour)
+		// A fix from just before midnight that arrives after it belongs to the day before.
+		if date.Add(fix.timeOfDay).After(now.Add(time.Hour)) {
+			date = date.AddDate(0, 0, -1)
+		}
+	}
+	timestamp := date.Add(fix.timeOfDay)
+	// Units usually send RMC and GGA for the same fix.
+	if timestamp.Equal(s.last) {
+		return nil
+	}
+
+	req := LocationUpdateRequest{Username: s.username, Latitude: fix.latitude, Longitude: fix.longitude, Timestamp: timestamp}
+	if err := binding.Validator.ValidateStruct(req); err != nil {
+		return err
+	}
+	s.last = timestamp
+	if err := s.update(req); err != nil {
+		log.Printf("Failed to store NMEA fix of %s: %v", s.username, err)
+		return nil
+	}
+	s.fixes++
+	return nil
+}
+
+// readNMEALine reads one line without its line ending. Lines that are too long are skipped.
+func readNMEALine(r *bufio.Reader) (string, error) {
+	line, isPrefix, err := r.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !isPrefix {
+		return strings.TrimSpace(string(line)), nil
+	}
+	for isPrefix {
+		if _, isPrefix, err = r.ReadLine(); err != nil {
+			return "", err
+		}
+	}
+	return "", errNMEALineTooLong
+}
+
+// nmeaServer accepts NMEA 0183 streams over TCP. Each connection starts with
+// "LOGIN <device_id> <token>" for a registered device and then sends one sentence per line.
+type nmeaServer struct {
+	db     *sql.DB
+	update func(LocationUpdateRequest) error
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+// serveNMEA listens on addr and serves NMEA streams in the background until close is called.
+func serveNMEA(addr, grpcHostname string, db *sql.DB) (*nmeaServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &nmeaServer{
+		db: db,
+		update: func(req LocationUpdateRequest) error {
+			return storeLocationUpdate(grpcHostname, db, req)
+		},
+	}
+	go func() {
+		if err := s.serve(ln); err != nil {
+			log.Fatalf("Failed to serve NMEA: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// serve accepts connections until the listener fails, returning nil once the server is closed.
+func (s *nmeaServer) serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *nmeaServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *nmeaServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// close stops accepting streams, closes the open ones and waits until the fixes that are being
+// stored are done.
+func (s *nmeaServer) close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+}
+
+func (s *nmeaServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, nmeaMaxLineLength)
+
+	conn.SetReadDeadline(time.Now().Add(nmeaLoginTimeout))
+	line, err := readNMEALine(r)
+	if err != nil {
+		return
+	}
+	login := strings.Fields(line)
+	if len(login) != 3 || login[0] != "LOGIN" {
+		io.WriteString(conn, "ERR expected LOGIN <device_id> <token>\r\n")
+		return
+	}
+	deviceID := login[1]
+	username, err := authenticateDevice(s.db, deviceID, login[2])
+	if err != nil {
+		log.Printf("Failed NMEA login of device %s from %s: %v", deviceID, conn.RemoteAddr(), err)
+		io.WriteString(conn, "ERR unauthorized\r\n")
+		return
+	}
+	io.WriteString(conn, "OK\r\n")
+
+	session := &nmeaSession{username: username, update: s.update}
+	for {
+		conn.SetReadDeadline(time.Now().Add(nmeaIdleTimeout))
+		line, err := readNMEALine(r)
+		if err != nil && err != errNMEALineTooLong {
+			break
+		}
+		if err == nil {
+			if line == "" {
+				continue
+			}
+			err = session.handleLine(line, time.Now())
+		}
+		if err != nil {
+			session.malformed++
+			log.Printf("Malformed NMEA line from device %s (%d so far): %v", deviceID, session.malformed, err)
+		}
+	}
+	log.Printf("NMEA connection of device %s closed after %d fixes and %d malformed lines", deviceID, session.fixes, session.malformed)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRMC = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	testGGA = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+)
+
+// nmeaSentence adds the $ prefix and checksum to body.
+func nmeaSentence(body string) string {
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	return fmt.Sprintf("$%s*%02X", body, sum)
+}
+
+func TestParseNMEAFix(t *testing.T) {
+	fields, err := parseNMEA(testRMC)
+	assert.NoError(t, err)
+	fix, err := parseNMEAFix(fields)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(1994, time.March, 23, 0, 0, 0, 0, time.UTC), fix.date)
+	assert.Equal(t, 12*time.Hour+35*time.Minute+19*time.Second, fix.timeOfDay)
+	assert.InDelta(t, 48.1173, fix.latitude, 1e-6)
+	assert.InDelta(t, 11.516667, fix.longitude, 1e-6)
+
+	fields, err = parseNMEA(nmeaSentence("GNGGA,081500.50,3345.120,S,15112.600,W,1,08,0.9,10.0,M,,M,,"))
+	assert.NoError(t, err)
+	fix, err = parseNMEAFix(fields)
+	assert.NoError(t, err)
+	assert.True(t, fix.date.IsZero())
+	assert.Equal(t, 8*time.Hour+15*time.Minute+500*time.Millisecond, fix.timeOfDay)
+	assert.InDelta(t, -33.752, fix.latitude, 1e-6)
+	assert.InDelta(t, -151.21, fix.longitude, 1e-6)
+
+	_, err = parseNMEA(strings.Replace(testRMC, "*6A", "*6B", 1))
+	assert.Error(t, err)
+	_, err = parseNMEA("GPRMC,123519,A*00")
+	assert.Error(t, err)
+
+	for _, body := range []string{
+		"GPRMC,123519,V,,,,,,,230394,,",
+		"GPGGA,123519,,,,,0,00,,,M,,M,,",
+		"GPGSV,3,1,11,03,03,111,00,04,15,270,00,06,01,010,00,13,06,292,00",
+	} {
+		fields, err := parseNMEA(nmeaSentence(body))
+		assert.NoError(t, err)
+		_, err = parseNMEAFix(fields)
+		assert.Equal(t, errNoFix, err, body)
+	}
+
+	fields, _ = parseNMEA(nmeaSentence("GPRMC,123519,A,4807.038,X,01131.000,E,022.4,084.4,230394,003.1,W"))
+	_, err = parseNMEAFix(fields)
+	assert.Error(t, err)
+}
+
+func TestNMEAServer(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	_, err := createDevice(testDB, DeviceRequest{DeviceID: "unit1", Username: "testuser", Token: "0123456789abcdef"}, time.Now())
+	assert.NoError(t, err)
+
+	updates := make(chan LocationUpdateRequest, 10)
+	s := &nmeaServer{db: testDB, update: func(req LocationUpdateRequest) error {
+		updates <- req
+		return nil
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ln) }()
+
+	// A wrong token is turned away
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	fmt.Fprint(conn, "LOGIN unit1 wrongtoken000000\r\n")
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "ERR unauthorized\r\n", reply)
+	conn.Close()
+
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "LOGIN unit1 0123456789abcdef\r\n")
+	reply, _ = bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "OK\r\n", reply)
+
+	// Malformed lines are skipped and the stream carries on; GGA repeats the RMC fix and is dropped
+	fmt.Fprint(conn, "garbage\r\n"+strings.Repeat("x", 1000)+"\r\n"+testRMC+"\r\n"+testGGA+"\r\n")
+	fmt.Fprint(conn, nmeaSentence("GPGGA,123520,4807.040,N,01131.002,E,1,08,0.9,545.4,M,46.9,M,,")+"\r\n")
+
+	var got []LocationUpdateRequest
+	for len(got) < 2 {
+		select {
+		case req := <-updates:
+			got = append(got, req)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for NMEA fixes")
+		}
+	}
+	assert.Equal(t, "testuser", got[0].Username)
+	assert.Equal(t, time.Date(1994, time.March, 23, 12, 35, 19, 0, time.UTC), got[0].Timestamp)
+	assert.Equal(t, time.Date(1994, time.March, 23, 12, 35, 20, 0, time.UTC), got[1].Timestamp)
+	assert.InDelta(t, 48.117333, got[1].Latitude, 1e-6)
+	assert.Empty(t, updates)
+
+	// Closing the server ends open streams and stops accepting new ones
+	s.close()
+	assert.NoError(t, <-served)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.Error(t, err)
+}
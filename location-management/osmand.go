@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// OsmAndRequest is a position reported with the OsmAnd protocol used by the OsmAnd app, the
+// Traccar client and many cheap trackers. Speed, bearing and altitude are accepted but not stored.
+type OsmAndRequest struct {
+	ID        string  `form:"id" binding:"required,max=64"`
+	Latitude  float64 `form:"lat" binding:"required"`
+	Longitude float64 `form:"lon" binding:"required"`
+	Timestamp string  `form:"timestamp"`
+	Accuracy  float64 `form:"accuracy"`
+	Speed     float64 `form:"speed"`
+	Bearing   float64 `form:"bearing"`
+	Altitude  float64 `form:"altitude"`
+}
+
+// parseOsmAndTimestamp accepts the formats trackers send: Unix seconds or milliseconds, ISO 8601
+// and "2006-01-02 15:04:05" in UTC. An empty timestamp means now.
+func parseOsmAndTimestamp(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp %q", value)
+}
+
+// OsmAndHandler takes reports as query parameters of a GET or as a form POST. Devices have to be
+// registered first so that their id maps to a user.
+func OsmAndHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
+	var report OsmAndRequest
+	if err := c.ShouldBind(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	timestamp, err := parseOsmAndTimestamp(report.Timestamp)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	username, err := deviceUsername(db, report.ID)
+	if err != nil {
+		respondError(c, err, "look up device")
+		return
+	}
+
+	req := LocationUpdateRequest{
+		Username:  username,
+		Latitude:  report.Latitude,
+		Longitude: report.Longitude,
+		Timestamp: timestamp,
+		Accuracy:  report.Accuracy,
+	}
+	if err := binding.Validator.ValidateStruct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if processLocationUpdate(c, grpcHostname, db, req) {
+		c.Status(http.StatusOK)
+	}
+}
+
+// registerOsmAndRoutes serves the protocol at path for both GET and POST.
+func registerOsmAndRoutes(r *gin.Engine, path, grpcHostname string, db *sql.DB) {
+	handler := func(c *gin.Context) {
+		OsmAndHandler(c, grpcHostname, db)
+	}
+	r.GET(path, handler)
+	r.POST(path, handler)
+}
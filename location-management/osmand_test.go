@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceHandlers(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	r := gin.Default()
+	r.POST("/api/v1/devices", func(c *gin.Context) {
+		CreateDeviceHandler(c, testDB)
+	})
+	r.GET("/api/v1/devices", func(c *gin.Context) {
+		ListDevicesHandler(c, testDB)
+	})
+	r.DELETE("/api/v1/devices/:device_id", func(c *gin.Context) {
+		DeleteDeviceHandler(c, testDB)
+	})
+
+	body, _ := json.Marshal(DeviceRequest{DeviceID: "864895030000001", Username: "testuser"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/devices", bytes.NewBuffer(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created Device
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Len(t, created.Token, 32)
+
+	// The token is only shown when the device is registered
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/devices", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "864895030000001")
+	assert.NotContains(t, w.Body.String(), created.Token)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/devices", bytes.NewBuffer(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	username, err := deviceUsername(testDB, "864895030000001")
+	assert.NoError(t, err)
+	assert.Equal(t, "testuser", username)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/devices/864895030000001", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/devices/864895030000001", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestOsmAndHandler(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	r := gin.Default()
+	registerOsmAndRoutes(r, "/", "localhost", testDB)
+
+	// Unknown devices are rejected before anything is stored
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/?id=unknown&lat=45.2671&lon=19.8335&timestamp=1719835200", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	_, err := createDevice(testDB, DeviceRequest{DeviceID: "tracker1", Username: "testuser"}, time.Now())
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/?id=tracker1&lat=95&lon=19.8335", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/?id=tracker1&lat=45.2671&lon=19.8335&timestamp=yesterday", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestParseOsmAndTimestamp(t *testing.T) {
+	want := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	for _, value := range []string{"1719835200", "1719835200000", "2024-07-01T12:00:00Z", "2024-07-01 12:00:00"} {
+		got, err := parseOsmAndTimestamp(value)
+		assert.NoError(t, err, value)
+		assert.True(t, want.Equal(got), value)
+	}
+
+	got, err := parseOsmAndTimestamp("")
+	assert.NoError(t, err)
+	assert.True(t, got.IsZero())
+}
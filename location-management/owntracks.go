@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// OwnTracksLocation is the location message of the OwnTracks apps. Other message types, such as
+// transitions or waypoints, are accepted and ignored.
+type OwnTracksLocation struct {
+	Type      string  `json:"_type"`
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Timestamp int64   `json:"tst"`
+	Accuracy  float64 `json:"acc,omitempty"`
+	TrackerID string  `json:"tid,omitempty"`
+	Topic     string  `json:"topic,omitempty"`
+}
+
+// OwnTracksCard gives a friend a name in the OwnTracks apps.
+type OwnTracksCard struct {
+	Type      string `json:"_type"`
+	Name      string `json:"name"`
+	TrackerID string `json:"tid"`
+	Topic     string `json:"topic"`
+}
+
+// OwnTracksFriendsRequest replaces the users whose positions the OwnTracks apps of a user show.
+type OwnTracksFriendsRequest struct {
+	Friends []string `json:"friends" binding:"max=100,dive,min=4,max=16,alphanum"`
+}
+
+var errOwnTracksCredentials = errors.New("invalid device credentials")
+
+// ownTracksUsername authenticates the app as a registered device: the basic auth user name is the
+// device id and the password its token. The user is the one the device reports for.
+func ownTracksUsername(c *gin.Context, db *sql.DB) (string, error) {
+	deviceID, token, ok := c.Request.BasicAuth()
+	if !ok {
+		return "", errOwnTracksCredentials
+	}
+	username, err := authenticateDevice(db, deviceID, token)
+	if errors.Is(err, errDeviceNotFound) || errors.Is(err, errInvalidDeviceToken) {
+		return "", errOwnTracksCredentials
+	}
+	return username, err
+}
+
+func ownTracksTrackerID(username string) string {
+	if len(username) > 2 {
+		username = username[:2]
+	}
+	return strings.ToUpper(username)
+}
+
+// ownTracksFriends returns the current position of every friend of the user, each followed by a
+// card. The apps tell friends apart by topic, so every user gets a stable one.
+func ownTracksFriends(db *sql.DB, username string) ([]interface{}, error) {
+	rows, err := db.Query(`SELECT l.username, l.latitude, l.longitude, l.accuracy, l.updated_at
+		FROM owntracks_friends f JOIN user_locations l ON l.username = f.friend
+		WHERE f.username = ? AND f.friend != f.username
+		ORDER BY l.username`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := []interface{}{}
+	for rows.Next() {
+		var friend string
+		var location OwnTracksLocation
+		var accuracy sql.NullFloat64
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&friend, &location.Latitude, &location.Longitude, &accuracy, &updatedAt); err != nil {
+			return nil, err
+		}
+		location.Type = "location"
+		location.Accuracy = accuracy.Float64
+		if updatedAt.Valid {
+			location.Timestamp = updatedAt.Time.Unix()
+		}
+		location.TrackerID = ownTracksTrackerID(friend)
+		location.Topic = "owntracks/" + friend + "/location-management"
+		friends = append(friends, location, OwnTracksCard{Type: "card", Name: friend, TrackerID: location.TrackerID, Topic: location.Topic})
+	}
+	return friends, rows.Err()
+}
+
+func OwnTracksHandler(c *gin.Context, grpcHostname string, db *sql.DB) {
+	var msg OwnTracksLocation
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	username, err := ownTracksUsername(c, db)
+	if errors.Is(err, errOwnTracksCredentials) {
+		c.Header("WWW-Authenticate", `Basic realm="owntracks"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondError(c, err, "authenticate device")
+		return
+	}
+
+	if msg.Type == "location" {
+		req := LocationUpdateRequest{
+			Username:  username,
+			Latitude:  msg.Latitude,
+			Longitude: msg.Longitude,
+			Accuracy:  msg.Accuracy,
+		}
+		if msg.Timestamp > 0 {
+			req.Timestamp = time.Unix(msg.Timestamp, 0)
+		}
+		if err := binding.Validator.ValidateStruct(req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !processLocationUpdate(c, grpcHostname, db, req) {
+			return
+		}
+	}
+
+	friends, err := ownTracksFriends(db, username)
+	if err != nil {
+		respondError(c, err, "list friends")
+		return
+	}
+	c.JSON(http.StatusOK, friends)
+}
+
+// listOwnTracksFriends returns the friends of a user in name order.
+func listOwnTracksFriends(db *sql.DB, username string) ([]string, error) {
+	rows, err := db.Query("SELECT friend FROM owntracks_friends WHERE username = ? ORDER BY friend", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := []string{}
+	for rows.Next() {
+		var friend string
+		if err := rows.Scan(&friend); err != nil {
+			return nil, err
+		}
+		friends = append(friends, friend)
+	}
+	return friends, rows.Err()
+}
+
+// setOwnTracksFriends replaces the friends of a user. The user is left out of its own friends.
+func setOwnTracksFriends(db *sql.DB, username string, friends []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM owntracks_friends WHERE username = ?", username); err != nil {
+		return err
+	}
+	for _, friend := range friends {
+		if friend == username {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO owntracks_friends (username, friend) VALUES (?, ?)", username, friend); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func GetOwnTracksFriendsHandler(c *gin.Context, db *sql.DB) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	friends, err := listOwnTracksFriends(db, uri.Username)
+	if err != nil {
+		respondError(c, err, "list friends")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": uri.Username, "friends": friends})
+}
+
+func SetOwnTracksFriendsHandler(c *gin.Context, db *sql.DB) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req OwnTracksFriendsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setOwnTracksFriends(db, uri.Username, req.Friends); err != nil {
+		respondError(c, err, "update friends")
+		return
+	}
+	friends, err := listOwnTracksFriends(db, uri.Username)
+	if err != nil {
+		respondError(c, err, "list friends")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": uri.Username, "friends": friends})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateLocationKeepsNewestFix(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Timestamp: now, Accuracy: 8}))
+	err := updateLocation(testDB, LocationUpdateRequest{Username: "testuser", Latitude: 44.7866, Longitude: 20.4489, Timestamp: now.Add(-time.Hour)})
+	assert.ErrorIs(t, err, errStaleLocation)
+	assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{Username: "testuser", Latitude: 45.2500, Longitude: 19.8400, Timestamp: now.Add(time.Minute), Accuracy: 20}))
+
+	friends, err := ownTracksFriends(testDB, "otheruser")
+	assert.NoError(t, err)
+	assert.Empty(t, friends)
+	assert.NoError(t, setOwnTracksFriends(testDB, "otheruser", []string{"testuser", "otheruser"}))
+	friends, err = ownTracksFriends(testDB, "otheruser")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		OwnTracksLocation{Type: "location", Latitude: 45.2500, Longitude: 19.8400, Timestamp: now.Add(time.Minute).Unix(), Accuracy: 20,
+			TrackerID: "TE", Topic: "owntracks/testuser/location-management"},
+		OwnTracksCard{Type: "card", Name: "testuser", TrackerID: "TE", Topic: "owntracks/testuser/location-management"},
+	}, friends)
+}
+
+func TestOwnTracksHandler(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{Username: "otheruser", Latitude: 44.7866, Longitude: 20.4489}))
+	assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{Username: "thirduser", Latitude: 45.2500, Longitude: 19.8400}))
+	_, err := createDevice(testDB, DeviceRequest{DeviceID: "phone", Username: "testuser", Token: "0123456789abcdef"}, time.Now())
+	assert.NoError(t, err)
+
+	r := gin.Default()
+	r.POST("/api/v1/owntracks", func(c *gin.Context) {
+		OwnTracksHandler(c, "localhost", testDB)
+	})
+	r.GET("/api/v1/users/:username/owntracks-friends", func(c *gin.Context) {
+		GetOwnTracksFriendsHandler(c, testDB)
+	})
+	r.PUT("/api/v1/users/:username/owntracks-friends", func(c *gin.Context) {
+		SetOwnTracksFriendsHandler(c, testDB)
+	})
+	post := func(msg interface{}, device, token, limitUser string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(msg)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/owntracks", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if device != "" {
+			req.SetBasicAuth(device, token)
+		}
+		if limitUser != "" {
+			req.Header.Set("X-Limit-U", limitUser)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Only the configured friends are shown
+	w := serve("PUT", "/api/v1/users/testuser/owntracks-friends", `{"friends":["otheruser","testuser"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"username":"testuser","friends":["otheruser"]}`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, serve("PUT", "/api/v1/users/testuser/owntracks-friends", `{"friends":["x"]}`).Code)
+
+	// Messages other than locations are answered with the friends list
+	transition := map[string]interface{}{"_type": "transition", "event": "enter", "tst": 1719835200}
+	w = post(transition, "phone", "0123456789abcdef", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var friends []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &friends))
+	if assert.Len(t, friends, 2) {
+		assert.Equal(t, "location", friends[0]["_type"])
+		assert.Equal(t, 44.7866, friends[0]["lat"])
+		assert.Equal(t, "card", friends[1]["_type"])
+		assert.Equal(t, "otheruser", friends[1]["name"])
+	}
+
+	// Locations are validated before they reach the update flow
+	w = post(OwnTracksLocation{Type: "location", Latitude: 95, Longitude: 19.8335, Timestamp: 1719835200}, "phone", "0123456789abcdef", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The device must authenticate; the X-Limit-U header does not name the user
+	for _, w := range []*httptest.ResponseRecorder{
+		post(transition, "", "", "testuser"),
+		post(transition, "phone", "wrong-token-0000", ""),
+		post(transition, "testuser", "0123456789abcdef", "testuser"),
+	} {
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `Basic realm="owntracks"`, w.Header().Get("WWW-Authenticate"))
+	}
+	w = post(transition, "phone", "0123456789abcdef", "otheruser")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"otheruser"`)
+	assert.NotContains(t, w.Body.String(), "thirduser")
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultNearestPOIs is how many POIs the nearest POI lookup returns unless asked for more.
+	defaultNearestPOIs = 5
+	// poiSearchRadius is the radius in kilometers of the first box the nearest POIs are looked for in.
+	poiSearchRadius = 1.0
+	// poiScanLimit is how many POIs addNearestPOIs reads at once to compare with every user instead
+	// of searching the index around each of them.
+	poiScanLimit = 1000
+	// earthRadiusKm is the radius that distance uses.
+	earthRadiusKm = 6371.0
+)
+
+// POIRequest is a point of interest such as a depot, customer site or meeting point. Categories
+// and tags are stored in lower case.
+type POIRequest struct {
+	Name        string   `json:"name" binding:"required,max=128"`
+	Category    string   `json:"category" binding:"required,max=32"`
+	Latitude    float64  `json:"latitude" binding:"required_without=Position,gte=-90,lte=90"`
+	Longitude   float64  `json:"longitude" binding:"required_without=Position,gte=-180,lte=180"`
+	Tags        []string `json:"tags,omitempty" binding:"dive,max=32"`
+	Description string   `json:"description,omitempty" binding:"max=1024"`
+	// Position is a position string in one of the formats of parsePosition, in place of Latitude
+	// and Longitude; only the coordinates are stored.
+	Position string `json:"position,omitempty" binding:"max=100"`
+}
+
+type POI struct {
+	ID int64 `json:"id"`
+	POIRequest
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NearbyPOI is a POI with its distance in kilometers from a position.
+type NearbyPOI struct {
+	POI
+	Distance float64 `json:"distance"`
+}
+
+type POIFilter struct {
+	Category string `form:"category" binding:"max=32"`
+	Tag      string `form:"tag" binding:"max=32"`
+}
+
+type NearestPOIsRequest struct {
+	POIFilter
+	Limit int `form:"limit" binding:"omitempty,gte=1,lte=100"`
+	// Radius limits the lookup to POIs within that many kilometers.
+	Radius float64 `form:"radius" binding:"omitempty,gt=0"`
+}
+
+var errPOINotFound = fmt.Errorf("POI %w", errNotFound)
+
+// normalize resolves the position string and folds the category and tags, dropping empty and
+// repeated tags.
+func (req *POIRequest) normalize() error {
+	if req.Position != "" {
+		if req.Latitude != 0 || req.Longitude != 0 {
+			return errors.New("position cannot be combined with latitude and longitude")
+		}
+		var err error
+		if req.Latitude, req.Longitude, err = parsePosition(req.Position); err != nil {
+			return err
+		}
+		req.Position = ""
+	}
+	req.Category = strings.ToLower(strings.TrimSpace(req.Category))
+	if req.Category == "" {
+		return errors.New("category cannot be blank")
+	}
+	tags := []string{}
+	for _, tag := range req.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	req.Tags = tags
+	return nil
+}
+
+// where returns the conditions of the filter on the pois table, each starting with AND, and their
+// arguments. Tags are matched as the quoted strings of the JSON array they are stored in.
+func (f POIFilter) where() (string, []any) {
+	var conditions string
+	var args []any
+	if category := strings.ToLower(strings.TrimSpace(f.Category)); category != "" {
+		conditions += " AND category = ?"
+		args = append(args, category)
+	}
+	if tag := strings.ToLower(strings.TrimSpace(f.Tag)); tag != "" {
+		quoted, _ := json.Marshal(tag)
+		conditions += " AND instr(tags, ?) > 0"
+		args = append(args, string(quoted))
+	}
+	return conditions, args
+}
+
+func scanPOI(scanner interface{ Scan(...any) error }) (POI, error) {
+	var p POI
+	var tags string
+	var description sql.NullString
+	err := scanner.Scan(&p.ID, &p.Name, &p.Category, &p.Latitude, &p.Longitude, &tags, &description, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+	p.Description = description.String
+	if err := json.Unmarshal([]byte(tags), &p.Tags); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+const poiColumns = "id, name, category, latitude, longitude, tags, description, created_at, updated_at"
+
+// queryPOIs returns the POIs of a query selecting poiColumns.
+func queryPOIs(db *sql.DB, query string, args ...any) ([]POI, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pois := []POI{}
+	for rows.Next() {
+		p, err := scanPOI(rows)
+		if err != nil {
+			return nil, err
+		}
+		pois = append(pois, p)
+	}
+	return pois, rows.Err()
+}
+
+func listPOIs(db *sql.DB, filter POIFilter) ([]POI, error) {
+	conditions, args := filter.where()
+	return queryPOIs(db, "SELECT "+poiColumns+" FROM pois WHERE 1 = 1"+conditions+" ORDER BY id", args...)
+}
+
+func countPOIs(db *sql.DB, filter POIFilter) (int, error) {
+	conditions, args := filter.where()
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pois WHERE 1 = 1"+conditions, args...).Scan(&count)
+	return count, err
+}
+
+func getPOI(db *sql.DB, id int64) (POI, error) {
+	p, err := scanPOI(db.QueryRow("SELECT "+poiColumns+" FROM pois WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return p, errPOINotFound
+	}
+	return p, err
+}
+
+// createPOI stores a POI and its entry in the poi_index R*Tree together.
+func createPOI(db *sql.DB, req POIRequest, now time.Time) (POI, error) {
+	tags, err := json.Marshal(req.Tags)
+	if err != nil {
+		return POI{}, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return POI{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO pois (name, category, latitude, longitude, tags, description, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, req.Name, req.Category, req.Latitude, req.Longitude, string(tags), req.Description, now.UTC(), now.UTC())
+	if err != nil {
+		return POI{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return POI{}, err
+	}
+	if _, err := tx.Exec("INSERT INTO poi_index (id, min_latitude, max_latitude, min_longitude, max_longitude) VALUES (?, ?, ?, ?, ?)",
+		id, req.Latitude, req.Latitude, req.Longitude, req.Longitude); err != nil {
+		return POI{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return POI{}, err
+	}
+	return getPOI(db, id)
+}
+
+func updatePOI(db *sql.DB, id int64, req POIRequest, now time.Time) (POI, error) {
+	tags, err := json.Marshal(req.Tags)
+	if err != nil {
+		return POI{}, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return POI{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE pois SET name = ?, category = ?, latitude = ?, longitude = ?, tags = ?, description = ?, updated_at = ?
+		WHERE id = ?`, req.Name, req.Category, req.Latitude, req.Longitude, string(tags), req.Description, now.UTC(), id)
+	if err != nil {
+		return POI{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return POI{}, err
+	} else if n == 0 {
+		return POI{}, errPOINotFound
+	}
+	if _, err := tx.Exec("UPDATE poi_index SET min_latitude = ?, max_latitude = ?, min_longitude = ?, max_longitude = ? WHERE id = ?",
+		req.Latitude, req.Latitude, req.Longitude, req.Longitude, id); err != nil {
+		return POI{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return POI{}, err
+	}
+	return getPOI(db, id)
+}
+
+func deletePOI(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM pois WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errPOINotFound
+	}
+	if _, err := tx.Exec("DELETE FROM poi_index WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// poiBoxes returns the boxes of [min latitude, max latitude, min longitude, max longitude] that
+// cover a circle of radius kilometers: one, or two where the circle crosses the antimeridian. The
+// longitudes span as far as the circle reaches on a sphere, which is further than at the center's
+// latitude.
+func poiBoxes(latitude, longitude, radius float64) [][4]float64 {
+	angle := radius / earthRadiusKm
+	minLat, maxLat := latitude-angle*180/math.Pi, latitude+angle*180/math.Pi
+	if minLat <= -90 || maxLat >= 90 || angle >= math.Pi/2 {
+		// The circle covers a pole, and so every longitude.
+		return [][4]float64{{math.Max(minLat, -90), math.Min(maxLat, 90), -180, 180}}
+	}
+	reach := math.Sin(angle) / math.Cos(latitude*math.Pi/180)
+	if reach >= 1 {
+		return [][4]float64{{minLat, maxLat, -180, 180}}
+	}
+	span := math.Asin(reach) * 180 / math.Pi
+	minLon, maxLon := longitude-span, longitude+span
+	switch {
+	case minLon < -180:
+		return [][4]float64{{minLat, maxLat, minLon + 360, 180}, {minLat, maxLat, -180, maxLon}}
+	case maxLon > 180:
+		return [][4]float64{{minLat, maxLat, minLon, 180}, {minLat, maxLat, -180, maxLon - 360}}
+	}
+	return [][4]float64{{minLat, maxLat, minLon, maxLon}}
+}
+
+// poisWithin returns the POIs matching the filter within radius kilometers of a position, nearest
+// first, reading the candidates from the poi_index R*Tree.
+func poisWithin(db *sql.DB, latitude, longitude, radius float64, filter POIFilter) ([]NearbyPOI, error) {
+	conditions, filterArgs := filter.where()
+	seen := map[int64]bool{}
+	nearby := []NearbyPOI{}
+	for _, box := range poiBoxes(latitude, longitude, radius) {
+		args := append([]any{box[1], box[0], box[3], box[2]}, filterArgs...)
+		pois, err := queryPOIs(db, "SELECT "+poiColumns+` FROM pois WHERE id IN (SELECT id FROM poi_index
+			WHERE min_latitude <= ? AND max_latitude >= ? AND min_longitude <= ? AND max_longitude >= ?)`+conditions, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pois {
+			if seen[p.ID] {
+				continue
+			}
+			seen[p.ID] = true
+			if d := distance(latitude, longitude, p.Latitude, p.Longitude); d <= radius {
+				nearby = append(nearby, NearbyPOI{POI: p, Distance: math.Round(d*1000) / 1000})
+			}
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		if nearby[i].Distance != nearby[j].Distance {
+			return nearby[i].Distance < nearby[j].Distance
+		}
+		return nearby[i].ID < nearby[j].ID
+	})
+	return nearby, nil
+}
+
+// nearestPOIs returns up to limit POIs nearest to a position, within maxDistance kilometers when
+// it is positive.
+func nearestPOIs(db *sql.DB, latitude, longitude float64, limit int, maxDistance float64, filter POIFilter) ([]NearbyPOI, error) {
+	total, err := countPOIs(db, filter)
+	if err != nil {
+		return nil, err
+	}
+	return searchNearestPOIs(db, latitude, longitude, min(limit, total), maxDistance, filter)
+}
+
+// searchNearestPOIs looks for the nearest POIs in circles four times wider each time until one
+// holds limit POIs; only the POIs inside a circle are sure to be nearer than every POI outside it.
+// limit must not exceed the number of POIs matching the filter, so that the search stops once it
+// has found all of them.
+func searchNearestPOIs(db *sql.DB, latitude, longitude float64, limit int, maxDistance float64, filter POIFilter) ([]NearbyPOI, error) {
+	if limit == 0 {
+		return []NearbyPOI{}, nil
+	}
+	halfCircumference := math.Pi * earthRadiusKm
+	radius := poiSearchRadius
+	for {
+		if maxDistance > 0 {
+			radius = math.Min(radius, maxDistance)
+		}
+		nearby, err := poisWithin(db, latitude, longitude, radius, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(nearby) >= limit || radius >= halfCircumference || (maxDistance > 0 && radius >= maxDistance) {
+			return nearby[:min(len(nearby), limit)], nil
+		}
+		radius *= 4
+	}
+}
+
+// addNearestPOIs sets the POI nearest to each user. Up to poiScanLimit POIs are read once and
+// compared with every user; more are searched in the index around each user.
+func addNearestPOIs(db *sql.DB, users []UserLocation, filter POIFilter) error {
+	total, err := countPOIs(db, filter)
+	if err != nil || total == 0 {
+		return err
+	}
+	if total > poiScanLimit {
+		for i := range users {
+			nearest, err := searchNearestPOIs(db, users[i].Latitude, users[i].Longitude, 1, 0, filter)
+			if err != nil {
+				return err
+			}
+			if len(nearest) > 0 {
+				users[i].NearestPOI = &nearest[0]
+			}
+		}
+		return nil
+	}
+
+	pois, err := listPOIs(db, filter)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		var nearest *NearbyPOI
+		for _, p := range pois {
+			d := math.Round(distance(users[i].Latitude, users[i].Longitude, p.Latitude, p.Longitude)*1000) / 1000
+			// The POIs are in id order, so ties go to the lowest id as in poisWithin.
+			if nearest == nil || d < nearest.Distance {
+				nearest = &NearbyPOI{POI: p, Distance: d}
+			}
+		}
+		users[i].NearestPOI = nearest
+	}
+	return nil
+}
+
+func bindPOIRequest(c *gin.Context) (POIRequest, bool) {
+	var req POIRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	return req, true
+}
+
+func CreatePOIHandler(c *gin.Context, db *sql.DB) {
+	req, ok := bindPOIRequest(c)
+	if !ok {
+		return
+	}
+
+	p, err := createPOI(db, req, time.Now())
+	if err != nil {
+		respondError(c, err, "create POI")
+		return
+	}
+	c.JSON(http.StatusCreated, p)
+}
+
+func ListPOIsHandler(c *gin.Context, db *sql.DB) {
+	var filter POIFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pois, err := listPOIs(db, filter)
+	if err != nil {
+		respondError(c, err, "list POIs")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pois": pois})
+}
+
+func GetPOIHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p, err := getPOI(db, uri.ID)
+	if err != nil {
+		respondError(c, err, "get POI")
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func UpdatePOIHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req, ok := bindPOIRequest(c)
+	if !ok {
+		return
+	}
+
+	p, err := updatePOI(db, uri.ID, req, time.Now())
+	if err != nil {
+		respondError(c, err, "update POI")
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func DeletePOIHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deletePOI(db, uri.ID); err != nil {
+		respondError(c, err, "delete POI")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "POI deleted"})
+}
+
+// NearestPOIsHandler returns the POIs nearest to a user's current position.
+func NearestPOIsHandler(c *gin.Context, db *sql.DB) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req NearestPOIsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultNearestPOIs
+	}
+
+	location, err := getCurrentLocation(db, uri.Username)
+	if err != nil {
+		respondError(c, err, "read location")
+		return
+	}
+	pois, err := nearestPOIs(db, location.Latitude, location.Longitude, req.Limit, req.Radius, req.POIFilter)
+	if err != nil {
+		respondError(c, err, "find nearest POIs")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"username":  location.Username,
+		"latitude":  location.Latitude,
+		"longitude": location.Longitude,
+		"pois":      pois,
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPOIBoxes(t *testing.T) {
+	boxes := poiBoxes(45, 19, 10)
+	if assert.Len(t, boxes, 1) {
+		assert.InDelta(t, 45-10/kmPerDegree, boxes[0][0], 1e-3)
+		// Ten kilometers are more degrees of longitude than of latitude away from the equator.
+		assert.InDelta(t, 19+10/kmPerDegree/0.7071, boxes[0][3], 1e-3)
+	}
+
+	// Circles crossing the antimeridian are split in two,
+	boxes = poiBoxes(-17, 179.9, 50)
+	if assert.Len(t, boxes, 2) {
+		assert.Equal(t, 180.0, boxes[0][3])
+		assert.Equal(t, -180.0, boxes[1][2])
+		assert.Less(t, boxes[1][3], -179.0)
+	}
+	// and circles covering a pole span every longitude.
+	assert.Equal(t, [][4]float64{{88.6, 90, -180, 180}}, roundBoxes(poiBoxes(89.5, 10, 100)))
+}
+
+func roundBoxes(boxes [][4]float64) [][4]float64 {
+	for i := range boxes {
+		for j := range boxes[i] {
+			boxes[i][j] = float64(int(boxes[i][j]*10)) / 10
+		}
+	}
+	return boxes
+}
+
+func TestPOIHandlers(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	r := gin.Default()
+	r.POST("/api/v1/pois", func(c *gin.Context) {
+		CreatePOIHandler(c, testDB)
+	})
+	r.GET("/api/v1/pois", func(c *gin.Context) {
+		ListPOIsHandler(c, testDB)
+	})
+	r.GET("/api/v1/pois/:id", func(c *gin.Context) {
+		GetPOIHandler(c, testDB)
+	})
+	r.PUT("/api/v1/pois/:id", func(c *gin.Context) {
+		UpdatePOIHandler(c, testDB)
+	})
+	r.DELETE("/api/v1/pois/:id", func(c *gin.Context) {
+		DeletePOIHandler(c, testDB)
+	})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("POST", "/api/v1/pois", `{"name":"North depot","category":" Depot","position":"45°15'N 19°50'E","tags":["Fuel","fuel"," night "]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var depot POI
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &depot))
+	assert.Equal(t, "depot", depot.Category)
+	assert.Equal(t, []string{"fuel", "night"}, depot.Tags)
+	assert.InDelta(t, 45.25, depot.Latitude, 1e-9)
+	assert.Empty(t, depot.Position)
+
+	w = serve("POST", "/api/v1/pois", `{"name":"Acme","category":"customer","latitude":44.8,"longitude":20.46,"description":"Ring at the gate"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/api/v1/pois", `{"name":"Nowhere","category":"depot"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/api/v1/pois", `{"name":"Blank","category":"  ","latitude":1,"longitude":1}`).Code)
+
+	list := func(query string) []POI {
+		w := serve("GET", "/api/v1/pois"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var res struct{ POIs []POI }
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.POIs
+	}
+	assert.Len(t, list(""), 2)
+	assert.Len(t, list("?category=DEPOT"), 1)
+	assert.Len(t, list("?tag=night"), 1)
+	assert.Len(t, list("?tag=nigh"), 0)
+	assert.Len(t, list("?category=customer&tag=night"), 0)
+
+	path := "/api/v1/pois/" + strconv.FormatInt(depot.ID, 10)
+	w = serve("PUT", path, `{"name":"North depot","category":"depot","latitude":45.3,"longitude":19.9}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var updated POI
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Empty(t, updated.Tags)
+	assert.Equal(t, depot.CreatedAt, updated.CreatedAt)
+
+	// The spatial index follows the POI.
+	nearby, err := poisWithin(testDB, 45.3, 19.9, 0.1, POIFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, nearby, 1)
+
+	assert.Equal(t, http.StatusOK, serve("DELETE", path, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", path, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", path, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("PUT", path, `{"name":"Gone","category":"depot","latitude":1,"longitude":1}`).Code)
+	nearby, _ = poisWithin(testDB, 45.3, 19.9, 0.1, POIFilter{})
+	assert.Empty(t, nearby)
+}
+
+func TestNearestPOIs(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	now := time.Now()
+	for _, req := range []POIRequest{
+		{Name: "Depot", Category: "depot", Latitude: 45.26, Longitude: 19.84},
+		{Name: "Meeting point", Category: "meeting", Latitude: 45.2551, Longitude: 19.8452, Tags: []string{"cafe"}},
+		{Name: "Belgrade depot", Category: "depot", Latitude: 44.8, Longitude: 20.46},
+		{Name: "Suva", Category: "customer", Latitude: -18.14, Longitude: 178.44},
+		{Name: "Taveuni", Category: "customer", Latitude: -16.85, Longitude: -179.97},
+	} {
+		_, err := createPOI(testDB, req, now)
+		assert.NoError(t, err)
+	}
+	names := func(pois []NearbyPOI) []string {
+		names := []string{}
+		for _, p := range pois {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	pois, err := nearestPOIs(testDB, 45.2551, 19.8452, 2, 0, POIFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Meeting point", "Depot"}, names(pois))
+	assert.Equal(t, 0.0, pois[0].Distance)
+
+	// Far POIs are found once the circles have grown to them.
+	pois, _ = nearestPOIs(testDB, 45.2551, 19.8452, 5, 0, POIFilter{Category: "depot"})
+	assert.Equal(t, []string{"Depot", "Belgrade depot"}, names(pois))
+	pois, _ = nearestPOIs(testDB, 45.2551, 19.8452, 5, 10, POIFilter{Category: "depot"})
+	assert.Equal(t, []string{"Depot"}, names(pois))
+
+	// Without matching POIs nothing is searched, and asking for more than there are returns all.
+	pois, err = nearestPOIs(testDB, 45.2551, 19.8452, 5, 0, POIFilter{Category: "warehouse"})
+	assert.NoError(t, err)
+	assert.Empty(t, pois)
+	pois, _ = nearestPOIs(testDB, 45.2551, 19.8452, 100, 0, POIFilter{Category: "customer"})
+	assert.ElementsMatch(t, []string{"Suva", "Taveuni"}, names(pois))
+
+	// The nearest POI across the antimeridian is nearer than one on the same side.
+	pois, _ = nearestPOIs(testDB, -16.8, 179.9, 1, 0, POIFilter{})
+	assert.Equal(t, []string{"Taveuni"}, names(pois))
+
+	// Comparing every user with every POI finds what the index search around each user finds.
+	users := []UserLocation{{Username: "testuser", Latitude: 45.2551, Longitude: 19.8452}, {Username: "otheruser", Latitude: -17, Longitude: 179.5}}
+	assert.NoError(t, addNearestPOIs(testDB, users, POIFilter{}))
+	for _, user := range users {
+		nearest, err := searchNearestPOIs(testDB, user.Latitude, user.Longitude, 1, 0, POIFilter{})
+		assert.NoError(t, err)
+		if assert.NotNil(t, user.NearestPOI) && assert.Len(t, nearest, 1) {
+			assert.Equal(t, nearest[0], *user.NearestPOI)
+		}
+	}
+
+	testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)", "testuser", 45.2551, 19.8452)
+	testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)", "otheruser", 44.81, 20.46)
+
+	r := gin.Default()
+	r.GET("/api/v1/users/:username/pois/nearest", func(c *gin.Context) {
+		NearestPOIsHandler(c, testDB)
+	})
+	r.GET("/api/v1/location/search", func(c *gin.Context) {
+		SearchUsersHandler(c, testDB)
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/v1/users/testuser/pois/nearest?tag=cafe")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res struct {
+		Username string
+		POIs     []NearbyPOI
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, []string{"Meeting point"}, names(res.POIs))
+
+	w = get("/api/v1/users/testuser/pois/nearest")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(t, res.POIs, 5)
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/users/nobody/pois/nearest").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/users/testuser/pois/nearest?limit=0&radius=-1").Code)
+
+	w = get("/api/v1/location/search?latitude=45&longitude=20&radius=100&page=1&size=10&nearest_poi=true&poi_category=depot")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var search SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &search))
+	nearest := map[string]string{}
+	for _, user := range search.Users {
+		if assert.NotNil(t, user.NearestPOI, user.Username) {
+			nearest[user.Username] = user.NearestPOI.Name
+		}
+	}
+	assert.Equal(t, map[string]string{"testuser": "Depot", "otheruser": "Belgrade depot"}, nearest)
+
+	w = get("/api/v1/location/search?latitude=45&longitude=20&radius=100&page=1&size=10")
+	assert.NotContains(t, w.Body.String(), "nearest_poi")
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// errNotPositionFormat is returned by a position parser for input that is not in its format at all,
+// as opposed to input in its format that is invalid.
+var errNotPositionFormat = errors.New("not in this format")
+
+// positionFormats parse the position strings of field reports, in the order they are tried. A
+// prefix such as "mgrs:" picks one format for input that several formats would accept.
+var positionFormats = []struct {
+	prefix, name string
+	parse        func(string) (float64, float64, error)
+}{
+	{"dms", "a latitude and longitude in degrees", parseDegrees},
+	{"geohash", "a geohash", parseGeohash},
+	{"pluscode", "a Plus Code", parsePlusCode},
+	{"mgrs", "an MGRS reference", parseMGRS},
+}
+
+// parsePosition reads a position as decimal degrees or degrees, minutes and seconds, a geohash, a
+// Plus Code or an MGRS reference, and returns its WGS84 latitude and longitude. Geohashes, Plus
+// Codes and MGRS references stand for an area; the position is its center.
+func parsePosition(s string) (float64, float64, error) {
+	s = strings.TrimSpace(s)
+	if prefix, rest, ok := strings.Cut(s, ":"); ok {
+		for _, format := range positionFormats {
+			if strings.EqualFold(strings.TrimSpace(prefix), format.prefix) {
+				latitude, longitude, err := format.parse(strings.TrimSpace(rest))
+				if errors.Is(err, errNotPositionFormat) {
+					return 0, 0, fmt.Errorf("%q is not %s", rest, format.name)
+				}
+				return latitude, longitude, err
+			}
+		}
+	}
+
+	var found []string
+	var latitude, longitude float64
+	var invalid error
+	for _, format := range positionFormats {
+		lat, lon, err := format.parse(s)
+		switch {
+		case err == nil:
+			found = append(found, format.prefix)
+			latitude, longitude = lat, lon
+		case !errors.Is(err, errNotPositionFormat) && invalid == nil:
+			invalid = err
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return latitude, longitude, nil
+	case len(found) > 1:
+		return 0, 0, fmt.Errorf("position %q is ambiguous: prefix it with one of %s", s, strings.Join(found, ": or ")+":")
+	case invalid != nil:
+		return 0, 0, invalid
+	}
+	return 0, 0, fmt.Errorf("position %q is not decimal degrees, degrees and minutes, a geohash, a Plus Code or an MGRS reference", s)
+}
+
+var (
+	// degreesPattern matches one coordinate: an optional hemisphere before or after degrees, and
+	// minutes and seconds, marked with symbols or only separated by spaces.
+	degreesPattern = regexp.MustCompile(`^([NSEW])?\s*([+-])?(\d+(?:\.\d+)?)\s*(°)?(?:\s*(\d+(?:\.\d+)?)\s*(')?(?:\s*(\d+(?:\.\d+)?)\s*(")?)?)?\s*([NSEW])?$`)
+	degreesSymbols = strings.NewReplacer("º", "°", "˚", "°", "′", "'", "’", "'", "‘", "'", "´", "'", "″", `"`, "”", `"`, "“", `"`, "''", `"`)
+)
+
+// parseCoordinate reads one coordinate of parseDegrees, returning its axis as 'N' for a latitude,
+// 'E' for a longitude or 0 when it has no hemisphere.
+func parseCoordinate(s string) (float64, byte, error) {
+	m := degreesPattern.FindStringSubmatch(s)
+	if m == nil || (m[1] != "" && m[9] != "") {
+		return 0, 0, errNotPositionFormat
+	}
+	// Only the last number may have a fraction, and minutes and seconds need the numbers before
+	// them to be marked as well.
+	last := 3
+	if m[5] != "" {
+		last = 5
+	}
+	if m[7] != "" {
+		last = 7
+	}
+	for i := 3; i < last; i += 2 {
+		if strings.Contains(m[i], ".") {
+			return 0, 0, errNotPositionFormat
+		}
+	}
+	if (m[6] != "" && m[4] == "") || (m[8] != "" && m[6] == "") {
+		return 0, 0, errNotPositionFormat
+	}
+	value, _ := strconv.ParseFloat(m[3], 64)
+	if m[5] != "" {
+		minutes, _ := strconv.ParseFloat(m[5], 64)
+		if minutes >= 60 {
+			return 0, 0, fmt.Errorf("%g minutes in %q are not less than 60", minutes, s)
+		}
+		value += minutes / 60
+	}
+	if m[7] != "" {
+		seconds, _ := strconv.ParseFloat(m[7], 64)
+		if seconds >= 60 {
+			return 0, 0, fmt.Errorf("%g seconds in %q are not less than 60", seconds, s)
+		}
+		value += seconds / 3600
+	}
+
+	hemisphere := m[1] + m[9]
+	if hemisphere != "" && m[2] != "" {
+		return 0, 0, fmt.Errorf("%q has both a sign and a hemisphere", s)
+	}
+	if m[2] == "-" || hemisphere == "S" || hemisphere == "W" {
+		value = -value
+	}
+	switch hemisphere {
+	case "N", "S":
+		return value, 'N', nil
+	case "E", "W":
+		return value, 'E', nil
+	}
+	return value, 0, nil
+}
+
+// degreesSplits returns the ways to split a position into its two coordinates: at its one comma or
+// semicolon, or else at any run of spaces, or around hemisphere letters when there are none.
+func degreesSplits(s string) [][2]string {
+	if i := strings.IndexAny(s, ",;"); i >= 0 {
+		if strings.IndexAny(s[i+1:], ",;") >= 0 {
+			return nil
+		}
+		return [][2]string{{s[:i], s[i+1:]}}
+	}
+	var splits [][2]string
+	fields := strings.Fields(s)
+	for i := 1; i < len(fields); i++ {
+		splits = append(splits, [2]string{strings.Join(fields[:i], " "), strings.Join(fields[i:], " ")})
+	}
+	if len(fields) == 1 {
+		for i := 1; i < len(s); i++ {
+			if strings.IndexByte("NSEW", s[i-1]) >= 0 || strings.IndexByte("NSEW+-", s[i]) >= 0 {
+				splits = append(splits, [2]string{s[:i], s[i:]})
+			}
+		}
+	}
+	return splits
+}
+
+// parseDegrees reads a latitude and longitude in decimal degrees ("45.25, 19.8333"), or in degrees
+// and minutes with optional seconds ("45°15'N 19°50'E"). Coordinates without hemispheres are the
+// latitude first; with them they may come in either order.
+func parseDegrees(s string) (float64, float64, error) {
+	s = strings.ToUpper(degreesSymbols.Replace(s))
+	var results [][2]float64
+	var invalid error
+	for _, split := range degreesSplits(s) {
+		first, firstAxis, err := parseCoordinate(strings.TrimSpace(split[0]))
+		if err == nil {
+			var second float64
+			var secondAxis byte
+			if second, secondAxis, err = parseCoordinate(strings.TrimSpace(split[1])); err == nil {
+				var latitude, longitude float64
+				latitude, longitude, err = orderCoordinates(s, first, firstAxis, second, secondAxis)
+				if err == nil {
+					if !containsPosition(results, latitude, longitude) {
+						results = append(results, [2]float64{latitude, longitude})
+					}
+					continue
+				}
+			}
+		}
+		if !errors.Is(err, errNotPositionFormat) && invalid == nil {
+			invalid = err
+		}
+	}
+	switch {
+	case len(results) == 1:
+		return results[0][0], results[0][1], nil
+	case len(results) > 1:
+		return 0, 0, fmt.Errorf("position %q can be read as %s: mark degrees, minutes and seconds with °, ' and \" or separate the coordinates with a comma",
+			s, describePositions(results))
+	case invalid != nil:
+		return 0, 0, invalid
+	}
+	return 0, 0, errNotPositionFormat
+}
+
+// orderCoordinates decides which coordinate is the latitude and checks their ranges.
+func orderCoordinates(s string, first float64, firstAxis byte, second float64, secondAxis byte) (float64, float64, error) {
+	if firstAxis != 0 && firstAxis == secondAxis {
+		if firstAxis == 'N' {
+			return 0, 0, fmt.Errorf("position %q has two latitudes", s)
+		}
+		return 0, 0, fmt.Errorf("position %q has two longitudes", s)
+	}
+	latitude, longitude := first, second
+	if firstAxis == 'E' || secondAxis == 'N' {
+		latitude, longitude = second, first
+	}
+	if math.Abs(latitude) > 90 {
+		return 0, 0, fmt.Errorf("latitude %g in %q is not between -90 and 90", latitude, s)
+	}
+	if math.Abs(longitude) > 180 {
+		return 0, 0, fmt.Errorf("longitude %g in %q is not between -180 and 180", longitude, s)
+	}
+	return latitude, longitude, nil
+}
+
+func containsPosition(positions [][2]float64, latitude, longitude float64) bool {
+	for _, p := range positions {
+		if math.Abs(p[0]-latitude) < 1e-9 && math.Abs(p[1]-longitude) < 1e-9 {
+			return true
+		}
+	}
+	return false
+}
+
+func describePositions(positions [][2]float64) string {
+	descriptions := make([]string, len(positions))
+	for i, p := range positions {
+		descriptions[i] = fmt.Sprintf("%.6f, %.6f", p[0], p[1])
+	}
+	return strings.Join(descriptions, " or ")
+}
+
+// parseGeohash returns the center of a geohash cell.
+func parseGeohash(s string) (float64, float64, error) {
+	s = strings.ToLower(s)
+	if len(s) == 0 || len(s) > 12 {
+		return 0, 0, errNotPositionFormat
+	}
+	bounds := [2][2]float64{{-90, 90}, {-180, 180}}
+	even := true
+	for _, r := range s {
+		value := strings.IndexRune(geohashAlphabet, r)
+		if value < 0 {
+			return 0, 0, errNotPositionFormat
+		}
+		for bit := 4; bit >= 0; bit-- {
+			// Bits alternate between longitude and latitude, starting with longitude.
+			b := &bounds[0]
+			if even {
+				b = &bounds[1]
+			}
+			mid := (b[0] + b[1]) / 2
+			if value&(1<<bit) != 0 {
+				b[0] = mid
+			} else {
+				b[1] = mid
+			}
+			even = !even
+		}
+	}
+	return (bounds[0][0] + bounds[0][1]) / 2, (bounds[1][0] + bounds[1][1]) / 2, nil
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+const (
+	plusCodeAlphabet = "23456789CFGHJMPQRVWX"
+	// plusCodeSeparator follows the eighth digit of a full code.
+	plusCodeSeparator = 8
+	// plusCodePairs is the number of digits encoded as pairs of latitude and longitude digits; the
+	// ones after them refine the area in a grid of 4 columns and 5 rows.
+	plusCodePairs = 10
+)
+
+var plusCodePattern = regexp.MustCompile(`^([023456789CFGHJMPQRVWX]*)\+([23456789CFGHJMPQRVWX]*)$`)
+
+// parsePlusCode returns the center of the area of an Open Location Code. A short code such as
+// "CX7Q+9V Novi Sad" is completed with the place after it, through the gazetteer.
+func parsePlusCode(s string) (float64, float64, error) {
+	code, reference := s, ""
+	if i := strings.IndexAny(s, " ,"); i >= 0 {
+		code, reference = s[:i], strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s[i:]), ","))
+	}
+	code = strings.ToUpper(code)
+	m := plusCodePattern.FindStringSubmatch(code)
+	if m == nil {
+		return 0, 0, errNotPositionFormat
+	}
+	digits, refinement := m[1], m[2]
+	separator := len(digits)
+	padding := ""
+	if i := strings.IndexByte(digits, '0'); i >= 0 {
+		digits, padding = digits[:i], digits[i:]
+	}
+	switch {
+	case separator > plusCodeSeparator || separator%2 != 0 || separator < 2:
+		return 0, 0, fmt.Errorf("Plus Code %q has its + in the wrong place", code)
+	case padding != "" && (strings.Trim(padding, "0") != "" || separator != plusCodeSeparator || len(digits)%2 != 0 ||
+		digits == "" || refinement != ""):
+		return 0, 0, fmt.Errorf("Plus Code %q is padded wrongly", code)
+	case len(refinement) == 1:
+		return 0, 0, fmt.Errorf("Plus Code %q has a single digit after the +", code)
+	}
+
+	if separator == plusCodeSeparator {
+		if reference != "" {
+			return 0, 0, fmt.Errorf("full Plus Code %q needs no place after it", code)
+		}
+		return decodePlusCode(digits + refinement)
+	}
+
+	// A short code drops the leading digits that the place after it supplies.
+	if reference == "" {
+		return 0, 0, fmt.Errorf("short Plus Code %q needs a place after it, e.g. %q", code, code+" Novi Sad")
+	}
+	if geocoder == nil || len(geocoder.places) == 0 {
+		return 0, 0, fmt.Errorf("short Plus Code %q cannot be completed: no gazetteer is loaded", code)
+	}
+	place, err := geocoder.resolvePlace(reference)
+	if err != nil {
+		return 0, 0, fmt.Errorf("short Plus Code %q cannot be completed: no place matches %q", code, reference)
+	}
+	return recoverPlusCode(digits+refinement, plusCodeSeparator-separator, place.Latitude, place.Longitude)
+}
+
+// decodePlusCode returns the center of the area of the digits of a full code without its separator.
+func decodePlusCode(digits string) (float64, float64, error) {
+	if strings.IndexByte(plusCodeAlphabet, digits[0]) >= 9 || strings.IndexByte(plusCodeAlphabet, digits[1]) >= 18 {
+		return 0, 0, fmt.Errorf("Plus Code digits %q are outside the globe", digits[:2])
+	}
+	latitude, longitude := -90.0, -180.0
+	size := 400.0
+	for i := 0; i < min(len(digits), plusCodePairs); i += 2 {
+		size /= 20
+		latitude += float64(strings.IndexByte(plusCodeAlphabet, digits[i])) * size
+		longitude += float64(strings.IndexByte(plusCodeAlphabet, digits[i+1])) * size
+	}
+	latitudeSize, longitudeSize := size, size
+	for i := plusCodePairs; i < len(digits); i++ {
+		value := strings.IndexByte(plusCodeAlphabet, digits[i])
+		latitudeSize /= 5
+		longitudeSize /= 4
+		latitude += float64(value/4) * latitudeSize
+		longitude += float64(value%4) * longitudeSize
+	}
+	return math.Min(latitude+latitudeSize/2, 90), longitude + longitudeSize/2, nil
+}
+
+// recoverPlusCode completes a short code missing its first dropped digits with those of the
+// reference position, and moves it to the neighbouring cell when that is nearer the reference.
+func recoverPlusCode(short string, dropped int, latitude, longitude float64) (float64, float64, error) {
+	resolution := math.Pow(20, float64(2-dropped/2))
+	prefix := make([]byte, dropped)
+	lat, lon := math.Min(latitude+90, 180-1e-10), math.Mod(longitude+180+360, 360)
+	for i, size := 0, 20.0; i < dropped; i += 2 {
+		prefix[i] = plusCodeAlphabet[int(lat/size)%20]
+		prefix[i+1] = plusCodeAlphabet[int(lon/size)%20]
+		lat, lon = math.Mod(lat, size), math.Mod(lon, size)
+		size /= 20
+	}
+	codeLatitude, codeLongitude, err := decodePlusCode(string(prefix) + short)
+	if err != nil {
+		return 0, 0, err
+	}
+	half := resolution / 2
+	switch {
+	case latitude+half < codeLatitude && codeLatitude-resolution >= -90:
+		codeLatitude -= resolution
+	case latitude-half > codeLatitude && codeLatitude+resolution <= 90:
+		codeLatitude += resolution
+	}
+	switch {
+	case longitude+half < codeLongitude:
+		codeLongitude -= resolution
+	case longitude-half > codeLongitude:
+		codeLongitude += resolution
+	}
+	if codeLongitude >= 180 {
+		codeLongitude -= 360
+	} else if codeLongitude < -180 {
+		codeLongitude += 360
+	}
+	return codeLatitude, codeLongitude, nil
+}
+
+var mgrsPattern = regexp.MustCompile(`^(\d{1,2})([C-HJ-NP-X])([A-HJ-NP-Z])([A-HJ-NP-V])(\d*)$`)
+
+// mgrsBandNorthing is the lowest northing in meters of each latitude band, with the false northing
+// of the southern hemisphere, to place the 100 km squares, whose letters repeat every 2000 km.
+var mgrsBandNorthing = map[byte]float64{
+	'C': 1100000, 'D': 2000000, 'E': 2800000, 'F': 3700000, 'G': 4600000, 'H': 5500000, 'J': 6400000,
+	'K': 7300000, 'L': 8200000, 'M': 9100000, 'N': 0, 'P': 800000, 'Q': 1700000, 'R': 2600000,
+	'S': 3500000, 'T': 4400000, 'U': 5300000, 'V': 6200000, 'W': 7000000, 'X': 7900000,
+}
+
+// parseMGRS returns the center of the square of an MGRS reference such as "34TDR 12345 67890" in
+// one of the UTM zones; the polar UPS areas are not supported.
+func parseMGRS(s string) (float64, float64, error) {
+	m := mgrsPattern.FindStringSubmatch(strings.ToUpper(strings.Join(strings.Fields(s), "")))
+	if m == nil {
+		return 0, 0, errNotPositionFormat
+	}
+	zone, _ := strconv.Atoi(m[1])
+	band, column, row, digits := m[2][0], m[3][0], m[4][0], m[5]
+	if zone < 1 || zone > 60 {
+		return 0, 0, fmt.Errorf("MGRS zone %d is not between 1 and 60", zone)
+	}
+	if len(digits)%2 != 0 || len(digits) > 10 {
+		return 0, 0, fmt.Errorf("MGRS reference %q needs as many easting as northing digits, at most 5 each", s)
+	}
+
+	// Each zone uses a third of the column letters, in turn, and every other zone starts its rows at F.
+	columns := [3]string{"STUVWXYZ", "ABCDEFGH", "JKLMNPQR"}[zone%3]
+	e := strings.IndexByte(columns, column)
+	if e < 0 {
+		return 0, 0, fmt.Errorf("MGRS column letter %c is not used in zone %d", column, zone)
+	}
+	rows := "ABCDEFGHJKLMNPQRSTUV"
+	n := strings.IndexByte(rows, row)
+	if zone%2 == 0 {
+		n = (n + len(rows) - 5) % len(rows)
+	}
+
+	easting, northing := float64(e+1)*100000, float64(n)*100000
+	for northing < mgrsBandNorthing[band] {
+		northing += 2000000
+	}
+	precision := len(digits) / 2
+	size := math.Pow(10, float64(5-precision))
+	if precision > 0 {
+		east, _ := strconv.Atoi(digits[:precision])
+		north, _ := strconv.Atoi(digits[precision:])
+		easting += float64(east) * size
+		northing += float64(north) * size
+	}
+	easting, northing = easting+size/2, northing+size/2
+	if band < 'N' {
+		northing -= 10000000
+	}
+	latitude, longitude := utmToLatLon(zone, easting, northing)
+	return latitude, longitude, nil
+}
+
+// utmToLatLon converts a WGS84 UTM position, with negative northings south of the equator, with the
+// Krüger series, which is accurate to well under a millimeter within a zone.
+func utmToLatLon(zone int, easting, northing float64) (float64, float64) {
+	const (
+		a  = 6378137.0
+		f  = 1 / 298.257223563
+		k0 = 0.9996
+	)
+	n := f / (2 - f)
+	A := a / (1 + n) * (1 + n*n/4 + n*n*n*n/64)
+	beta := [3]float64{n/2 - 2*n*n/3 + 37*n*n*n/96, n*n/48 + n*n*n/15, 17 * n * n * n / 480}
+	delta := [3]float64{2*n - 2*n*n/3 - 2*n*n*n, 7*n*n/3 - 8*n*n*n/5, 56 * n * n * n / 15}
+
+	xi := northing / (k0 * A)
+	eta := (easting - 500000) / (k0 * A)
+	xi1, eta1 := xi, eta
+	for j := 1; j <= 3; j++ {
+		k := 2 * float64(j)
+		xi1 -= beta[j-1] * math.Sin(k*xi) * math.Cosh(k*eta)
+		eta1 -= beta[j-1] * math.Cos(k*xi) * math.Sinh(k*eta)
+	}
+	chi := math.Asin(math.Sin(xi1) / math.Cosh(eta1))
+	phi := chi
+	for j := 1; j <= 3; j++ {
+		phi += delta[j-1] * math.Sin(2*float64(j)*chi)
+	}
+	centralMeridian := float64(zone*6 - 183)
+	lambda := centralMeridian + math.Atan2(math.Sinh(eta1), math.Cos(xi1))*180/math.Pi
+	return phi * 180 / math.Pi, lambda
+}
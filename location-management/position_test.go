@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertPosition(t *testing.T, input string, latitude, longitude, delta float64) {
+	t.Helper()
+	lat, lon, err := parsePosition(input)
+	if assert.NoError(t, err, input) {
+		assert.InDelta(t, latitude, lat, delta, input)
+		assert.InDelta(t, longitude, lon, delta, input)
+	}
+}
+
+func assertPositionError(t *testing.T, input, message string) {
+	t.Helper()
+	_, _, err := parsePosition(input)
+	if assert.Error(t, err, input) {
+		assert.Contains(t, err.Error(), message, input)
+	}
+}
+
+func TestParseDegrees(t *testing.T) {
+	for _, input := range []string{"45.25167, 19.83694", "45.25167 19.83694", "45.25167;19.83694", "45.25167N 19.83694E", "45.25167N19.83694E", "19.83694e 45.25167n"} {
+		assertPosition(t, input, 45.25167, 19.83694, 1e-9)
+	}
+	for _, input := range []string{`45°15'N 19°50'E`, `19°50′E 45°15′N`, `N 45° 15' E 19° 50'`, "45 15 N 19 50 E", "45 15, 19 50", `45º15.0'N, 19º50.0'E`} {
+		assertPosition(t, input, 45.25, 19.833333, 1e-6)
+	}
+	assertPosition(t, `45°15'6"N, 19°50'12"E`, 45.251667, 19.836667, 1e-6)
+	assertPosition(t, `45°15'6''N 19°50'12''E`, 45.251667, 19.836667, 1e-6)
+	assertPosition(t, `33°52'8"S 151°12'33"E`, -33.868889, 151.209167, 1e-6)
+	assertPosition(t, "-54.8019 -68.303", -54.8019, -68.303, 1e-9)
+	assertPosition(t, "54.8019S 68.303W", -54.8019, -68.303, 1e-9)
+
+	assertPositionError(t, "45 15 19 50", "can be read as 45.000000, 15.330556 or 45.250000, 19.833333 or 45.255278, 50.000000")
+	assertPositionError(t, "95, 19", "latitude 95 in")
+	assertPositionError(t, "45.25E 19.84E", "two longitudes")
+	assertPositionError(t, `45°75'N 19°50'E`, "75 minutes")
+	assertPositionError(t, "-45.25N 19.84E", "both a sign and a hemisphere")
+	assertPositionError(t, "45.25, 19.84, 3", "is not decimal degrees")
+}
+
+func TestParseGeohash(t *testing.T) {
+	assertPosition(t, "ezs42", 42.605, -5.603, 0.001)
+	assertPosition(t, "U2N17", 45.2415, 19.8413, 0.001)
+	assertPositionError(t, "geohash:u2n17a", `"u2n17a" is not a geohash`)
+}
+
+func TestParseMGRS(t *testing.T) {
+	// Computed with the forward Krüger series; 1 m squares are read as their centers.
+	assertPosition(t, "34TDR0873511566", 45.25167, 19.83694, 1e-5)
+	assertPosition(t, "34T DR 08735 11566", 45.25167, 19.83694, 1e-5)
+	assertPosition(t, "31NAA6602100000", 0, 0, 1e-5)
+	assertPosition(t, "56HLH3436850948", -33.8688, 151.2093, 1e-5)
+	assertPosition(t, "33XWG1427883355", 78.2232, 15.6267, 1e-5)
+	assertPosition(t, "19FEV4480527029", -54.8019, -68.303, 1e-5)
+	assertPosition(t, "34T DR", 45.6, 20.36, 0.05)
+
+	assertPositionError(t, "34TDR087351156", "as many easting as northing digits")
+	assertPositionError(t, "61TDR0873511566", "zone 61")
+	assertPositionError(t, "34TSR0873511566", "column letter S is not used in zone 34")
+
+	// Short references without I, O, A or L are also valid geohashes.
+	assertPositionError(t, "34tdr0811", "ambiguous: prefix it with one of geohash: or mgrs:")
+	assertPosition(t, "mgrs:34tdr0811", 45.2517, 19.8369, 0.01)
+	assertPosition(t, "geohash:34tdr0811", -30.53905, -126.95794, 1e-4)
+}
+
+func TestParsePlusCode(t *testing.T) {
+	defer func() { geocoder = nil }()
+
+	assertPosition(t, "8FQX7R2P+MQ", 45.25167, 19.83694, 1e-4)
+	assertPosition(t, "8fqx7r2p+mq8", 45.25167, 19.83694, 2e-5)
+	assertPosition(t, "6FG22222+22", 0, 0, 1e-4)
+	assertPosition(t, "37QH5MXW+6R", -54.8019, -68.303, 1e-4)
+	assertPosition(t, "8FQX0000+", 45.5, 19.5, 1e-9)
+
+	assertPositionError(t, "8FQX7R2P+M", "single digit after the +")
+	assertPositionError(t, "8FQ+", "wrong place")
+	assertPositionError(t, "8FQX00R2+", "padded wrongly")
+	assertPositionError(t, "XFQX7R2P+MQ", "outside the globe")
+	assertPositionError(t, "8FQX7R2P+MQ Novi Sad", "needs no place")
+
+	geocoder = nil
+	assertPositionError(t, "7R2P+MQ", "needs a place after it")
+	assertPositionError(t, "7R2P+MQ Novi Sad", "no gazetteer is loaded")
+	geocoder = testGazetteer(t)
+	assertPosition(t, "7R2P+MQ Novi Sad", 45.25167, 19.83694, 1e-4)
+	assertPosition(t, "QX7R2P+MQ, Belgrade", 45.25167, 19.83694, 1e-4)
+	assertPositionError(t, "7R2P+MQ Gotham", `no place matches "Gotham"`)
+}
+
+func TestPositionInput(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+	testDB.Exec("INSERT INTO user_locations (username, latitude, longitude) VALUES (?, ?, ?)", "testuser", 45.25, 19.8333)
+
+	r := gin.Default()
+	r.POST("/api/v1/location", func(c *gin.Context) {
+		UpdateLocationHandler(c, "localhost", testDB)
+	})
+	r.GET("/api/v1/location/search", func(c *gin.Context) {
+		SearchUsersHandler(c, testDB)
+	})
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	search := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/v1/location/search?radius=1&page=1&size=10&"+query, nil)
+		return serve(req)
+	}
+
+	w := search("position=" + "45%C2%B015%27N+19%C2%B050%27E")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, 1, res.TotalUsers)
+
+	w = search("position=45+15+19+50")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "can be read as")
+	assert.Equal(t, http.StatusBadRequest, search("position=u2n17&latitude=45.25&longitude=19.83").Code)
+
+	// Updates with an invalid position are rejected before they are stored.
+	update := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/location", bytes.NewBufferString(body))
+		return serve(req)
+	}
+	w = update(`{"username":"testuser","position":"34TDR0811"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "ambiguous")
+	assert.Equal(t, http.StatusBadRequest, update(`{"username":"testuser","position":"45.25N","latitude":45.25}`).Code)
+	assert.Equal(t, http.StatusBadRequest, update(`{"username":"testuser"}`).Code)
+
+	req := LocationUpdateRequest{Username: "testuser", Position: "mgrs:34TDR0873511566"}
+	assert.NoError(t, req.resolvePosition())
+	assert.InDelta(t, 45.25167, req.Latitude, 1e-5)
+
+	mqtt, err := decodeMQTTLocation([]byte(`{"username":"testuser","position":"8FQX7R2P+MQ"}`))
+	assert.NoError(t, err)
+	assert.InDelta(t, 19.83694, mqtt.Longitude, 1e-4)
+}
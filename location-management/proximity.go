@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ProximityTriggered = "triggered"
+	ProximityCleared   = "cleared"
+)
+
+type ProximityRuleRequest struct {
+	Name       string   `json:"name" binding:"required,max=64"`
+	Usernames  []string `json:"usernames" binding:"required,min=2,unique,dive,min=4,max=16,alphanum"`
+	Distance   float64  `json:"distance" binding:"required,gt=0"`
+	Hysteresis float64  `json:"hysteresis" binding:"gte=0"`
+}
+
+type ProximityRule struct {
+	ID int64 `json:"id"`
+	ProximityRuleRequest
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ProximityEvent struct {
+	ID        int64     `json:"id"`
+	RuleID    int64     `json:"rule_id"`
+	UserA     string    `json:"user_a"`
+	UserB     string    `json:"user_b"`
+	Event     string    `json:"event"`
+	Distance  float64   `json:"distance"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ProximityEventsRequest struct {
+	RuleID    int64     `form:"rule_id" binding:"gte=0"`
+	Username  string    `form:"username" binding:"omitempty,min=4,max=16,alphanum"`
+	StartTime time.Time `form:"start_time"`
+	EndTime   time.Time `form:"end_time"`
+}
+
+// proximityMaxAge is how far apart in time two positions may be and still be compared; a partner
+// whose last position is older than that is no longer known to be where it was.
+const proximityMaxAge = 15 * time.Minute
+
+var errProximityRuleNotFound = fmt.Errorf("proximity rule %w", errNotFound)
+
+func scanProximityRule(scanner interface{ Scan(...interface{}) error }) (ProximityRule, error) {
+	var rule ProximityRule
+	var usernames string
+	if err := scanner.Scan(&rule.ID, &rule.Name, &usernames, &rule.Distance, &rule.Hysteresis, &rule.CreatedAt); err != nil {
+		return rule, err
+	}
+	return rule, json.Unmarshal([]byte(usernames), &rule.Usernames)
+}
+
+func listProximityRules(db *sql.DB) ([]ProximityRule, error) {
+	rows, err := db.Query("SELECT id, name, usernames, distance, hysteresis, created_at FROM proximity_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []ProximityRule{}
+	for rows.Next() {
+		rule, err := scanProximityRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func getProximityRule(db *sql.DB, id int64) (ProximityRule, error) {
+	rule, err := scanProximityRule(db.QueryRow("SELECT id, name, usernames, distance, hysteresis, created_at FROM proximity_rules WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return rule, errProximityRuleNotFound
+	}
+	return rule, err
+}
+
+func createProximityRule(db *sql.DB, req ProximityRuleRequest, now time.Time) (ProximityRule, error) {
+	usernames, err := json.Marshal(req.Usernames)
+	if err != nil {
+		return ProximityRule{}, err
+	}
+	res, err := db.Exec("INSERT INTO proximity_rules (name, usernames, distance, hysteresis, created_at) VALUES (?, ?, ?, ?, ?)",
+		req.Name, string(usernames), req.Distance, req.Hysteresis, now.UTC())
+	if err != nil {
+		return ProximityRule{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return ProximityRule{}, err
+	}
+	return getProximityRule(db, id)
+}
+
+func deleteProximityRule(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM proximity_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errProximityRuleNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM proximity_states WHERE rule_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// evaluateProximity checks the user that just moved against the other members of every rule they
+// belong to. A pair triggers once when it comes within the rule's distance and only clears after
+// moving further apart than distance plus hysteresis, so jitter at the edge does not repeat alerts.
+// Events are stamped with the time of the fix, and partners whose position is more than
+// proximityMaxAge away from it are skipped.
+func evaluateProximity(db *sql.DB, req LocationUpdateRequest, now time.Time) ([]ProximityEvent, error) {
+	rules, err := listProximityRules(db)
+	if err != nil {
+		return nil, err
+	}
+	at := req.Timestamp
+	if at.IsZero() {
+		at = now
+	}
+	at = at.UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var events []ProximityEvent
+	for _, rule := range rules {
+		member := false
+		for _, username := range rule.Usernames {
+			member = member || username == req.Username
+		}
+		if !member {
+			continue
+		}
+
+		for _, other := range rule.Usernames {
+			if other == req.Username {
+				continue
+			}
+			var latitude, longitude float64
+			var updatedAt sql.NullTime
+			err := tx.QueryRow("SELECT latitude, longitude, updated_at FROM user_locations WHERE username = ?", other).
+				Scan(&latitude, &longitude, &updatedAt)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !updatedAt.Valid || at.Sub(updatedAt.Time).Abs() > proximityMaxAge {
+				continue
+			}
+
+			// Pairs are stored in a fixed order so both users update the same state.
+			userA, userB := req.Username, other
+			if userB < userA {
+				userA, userB = userB, userA
+			}
+			var near bool
+			err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM proximity_states WHERE rule_id = ? AND user_a = ? AND user_b = ?)",
+				rule.ID, userA, userB).Scan(&near)
+			if err != nil {
+				return nil, err
+			}
+
+			d := distance(req.Latitude, req.Longitude, latitude, longitude)
+			var event string
+			switch {
+			case !near && d <= rule.Distance:
+				event = ProximityTriggered
+				_, err = tx.Exec("INSERT INTO proximity_states (rule_id, user_a, user_b) VALUES (?, ?, ?)", rule.ID, userA, userB)
+			case near && d > rule.Distance+rule.Hysteresis:
+				event = ProximityCleared
+				_, err = tx.Exec("DELETE FROM proximity_states WHERE rule_id = ? AND user_a = ? AND user_b = ?", rule.ID, userA, userB)
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			e := ProximityEvent{RuleID: rule.ID, UserA: userA, UserB: userB, Event: event, Distance: d, Timestamp: at}
+			res, err := tx.Exec("INSERT INTO proximity_events (rule_id, user_a, user_b, event, distance, timestamp) VALUES (?, ?, ?, ?, ?, ?)",
+				e.RuleID, e.UserA, e.UserB, e.Event, e.Distance, e.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			if e.ID, err = res.LastInsertId(); err != nil {
+				return nil, err
+			}
+			events = append(events, e)
+		}
+	}
+
+	return events, tx.Commit()
+}
+
+func listProximityEvents(db *sql.DB, req ProximityEventsRequest) ([]ProximityEvent, error) {
+	if req.EndTime.IsZero() {
+		req.EndTime = time.Now()
+	}
+	rows, err := db.Query(`SELECT id, rule_id, user_a, user_b, event, distance, timestamp FROM proximity_events
+		WHERE (? = 0 OR rule_id = ?) AND (? = '' OR user_a = ? OR user_b = ?) AND timestamp BETWEEN ? AND ?
+		ORDER BY id`,
+		req.RuleID, req.RuleID, req.Username, req.Username, req.Username, req.StartTime.UTC(), req.EndTime.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ProximityEvent{}
+	for rows.Next() {
+		var e ProximityEvent
+		if err := rows.Scan(&e.ID, &e.RuleID, &e.UserA, &e.UserB, &e.Event, &e.Distance, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func CreateProximityRuleHandler(c *gin.Context, db *sql.DB) {
+	var req ProximityRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule, err := createProximityRule(db, req, time.Now())
+	if err != nil {
+		respondError(c, err, "create proximity rule")
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+func ListProximityRulesHandler(c *gin.Context, db *sql.DB) {
+	rules, err := listProximityRules(db)
+	if err != nil {
+		respondError(c, err, "list proximity rules")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func GetProximityRuleHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule, err := getProximityRule(db, uri.ID)
+	if err != nil {
+		respondError(c, err, "get proximity rule")
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func DeleteProximityRuleHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleteProximityRule(db, uri.ID); err != nil {
+		respondError(c, err, "delete proximity rule")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "proximity rule deleted"})
+}
+
+func GetProximityEventsHandler(c *gin.Context, db *sql.DB) {
+	var req ProximityEventsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := listProximityEvents(db, req)
+	if err != nil {
+		respondError(c, err, "list proximity events")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluateProximity(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	_, err := createProximityRule(testDB, ProximityRuleRequest{
+		Name: "Patrol", Usernames: []string{"alice1", "bobby2"}, Distance: 1, Hysteresis: 0.5,
+	}, now)
+	assert.NoError(t, err)
+
+	// Each fix is a minute after the previous one and is evaluated when it arrives an hour later.
+	at := now
+	move := func(username string, latitude, longitude float64) []string {
+		at = at.Add(time.Minute)
+		req := LocationUpdateRequest{Username: username, Latitude: latitude, Longitude: longitude, Timestamp: at}
+		assert.NoError(t, updateLocation(testDB, req))
+		events, err := evaluateProximity(testDB, req, at.Add(time.Hour))
+		assert.NoError(t, err)
+		var names []string
+		for _, e := range events {
+			names = append(names, e.Event)
+		}
+		return names
+	}
+
+	// Roughly 0.11 km per 0.001 degree of latitude
+	assert.Empty(t, move("alice1", 45.2500, 19.8300))
+	assert.Empty(t, move("bobby2", 45.2700, 19.8300))
+	assert.Equal(t, []string{ProximityTriggered}, move("bobby2", 45.2580, 19.8300))
+	// Still close, and inside the hysteresis margin: no repeated or cleared alerts
+	assert.Empty(t, move("alice1", 45.2510, 19.8300))
+	assert.Empty(t, move("bobby2", 45.2620, 19.8300))
+	assert.Equal(t, []string{ProximityCleared}, move("bobby2", 45.2660, 19.8300))
+	// Unrelated users do not produce events
+	assert.Empty(t, move("carol3", 45.2510, 19.8300))
+
+	events, err := listProximityEvents(testDB, ProximityEventsRequest{Username: "alice1", EndTime: now.Add(time.Hour)})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "alice1", events[0].UserA)
+		assert.Equal(t, "bobby2", events[0].UserB)
+		assert.Equal(t, now.Add(3*time.Minute), events[0].Timestamp)
+	}
+
+	// Positions further apart in time than proximityMaxAge are not compared.
+	at = at.Add(proximityMaxAge)
+	assert.Empty(t, move("bobby2", 45.2510, 19.8300))
+	assert.Equal(t, []string{ProximityTriggered}, move("alice1", 45.2500, 19.8300))
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+var errPublisherClosed = errors.New("publisher is closed")
+
+// EventPublisher forwards accepted location updates to a message bus.
+type EventPublisher interface {
+	Publish(event LocationEvent) error
+	Close() error
+}
+
+// publisher receives every accepted location update; it is set up in main and stays nil when
+// publishing is disabled.
+var publisher EventPublisher
+
+// locationEvents is the publisher behind the location event stream; it is only set with
+// -publisher=channel.
+var locationEvents *channelPublisher
+
+// newPublisher returns the publisher selected by kind. Publish never blocks: the nats and file
+// publishers are wrapped in a bounded buffer, and the channel publisher drops events for
+// subscribers that fall behind.
+func newPublisher(kind, natsURL, natsSubject, file string, buffer int) (EventPublisher, error) {
+	if kind == "" {
+		return nil, nil
+	}
+	if buffer < 1 {
+		return nil, fmt.Errorf("publish buffer must hold at least one event")
+	}
+
+	var next EventPublisher
+	var err error
+	switch kind {
+	case "channel":
+		return newChannelPublisher(buffer), nil
+	case "nats":
+		next, err = newNATSPublisher(natsURL, natsSubject)
+	case "file":
+		next, err = newFilePublisher(file)
+	default:
+		return nil, fmt.Errorf("unknown publisher %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncPublisher(next, buffer), nil
+}
+
+// asyncPublisher hands events to a background goroutine through a bounded buffer. When the buffer
+// is full the event is dropped, so a slow broker cannot hold up location updates.
+type asyncPublisher struct {
+	next    EventPublisher
+	queue   chan LocationEvent
+	done    chan struct{}
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+func newAsyncPublisher(next EventPublisher, buffer int) *asyncPublisher {
+	p := &asyncPublisher{
+		next:  next,
+		queue: make(chan LocationEvent, buffer),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *asyncPublisher) Publish(event LocationEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errPublisherClosed
+	}
+	select {
+	case p.queue <- event:
+		return nil
+	default:
+		p.dropped++
+		return fmt.Errorf("publish buffer is full, %d events dropped so far", p.dropped)
+	}
+}
+
+func (p *asyncPublisher) run() {
+	defer close(p.done)
+	for event := range p.queue {
+		if err := p.next.Publish(event); err != nil {
+			log.Printf("Failed to publish location event for %s: %v", event.Username, err)
+		}
+	}
+}
+
+// Close publishes the events that are still buffered and closes the underlying publisher. Later
+// events are refused with errPublisherClosed.
+func (p *asyncPublisher) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errPublisherClosed
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	<-p.done
+	return p.next.Close()
+}
+
+// channelPublisher fans events out to consumers in the same process, such as the location event
+// stream. Every subscriber has its own buffer; a subscriber whose buffer is full misses the event
+// instead of holding up location updates and the other subscribers.
+type channelPublisher struct {
+	mu          sync.Mutex
+	buffer      int
+	subscribers map[chan LocationEvent]struct{}
+	closed      bool
+	dropped     int
+}
+
+func newChannelPublisher(buffer int) *channelPublisher {
+	return &channelPublisher{buffer: buffer, subscribers: map[chan LocationEvent]struct{}{}}
+}
+
+// Subscribe returns a channel that receives the events published from now on and a function that
+// ends the subscription. The channel is closed when the subscription ends or the publisher closes.
+func (p *channelPublisher) Subscribe() (<-chan LocationEvent, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	events := make(chan LocationEvent, p.buffer)
+	if p.closed {
+		close(events)
+		return events, func() {}
+	}
+	p.subscribers[events] = struct{}{}
+	return events, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[events]; ok {
+			delete(p.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+func (p *channelPublisher) Publish(event LocationEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	missed := 0
+	for events := range p.subscribers {
+		select {
+		case events <- event:
+		default:
+			missed++
+		}
+	}
+	if missed > 0 {
+		p.dropped += missed
+		return fmt.Errorf("%d subscribers fell behind, %d events dropped so far", missed, p.dropped)
+	}
+	return nil
+}
+
+func (p *channelPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for events := range p.subscribers {
+		close(events)
+	}
+	p.subscribers = nil
+	p.closed = true
+	return nil
+}
+
+// LocationEventsRequest optionally limits the location event stream to one user.
+type LocationEventsRequest struct {
+	Username string `form:"username" binding:"omitempty,min=4,max=16,alphanum"`
+}
+
+// LocationEventsHandler streams accepted location updates as server-sent events for as long as the
+// client stays connected. It needs the channel publisher; events is nil otherwise.
+func LocationEventsHandler(c *gin.Context, events *channelPublisher) {
+	if events == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Location events are only streamed with -publisher=channel"})
+		return
+	}
+	var req LocationEventsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-updates:
+			if !ok {
+				return
+			}
+			if req.Username != "" && event.Username != req.Username {
+				continue
+			}
+			c.Render(-1, sse.Event{Event: EventLocationUpdated, Data: event})
+			c.Writer.Flush()
+		}
+	}
+}
+
+// filePublisher appends every event as one JSON line.
+type filePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newFilePublisher(path string) (*filePublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &filePublisher{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (p *filePublisher) Publish(event LocationEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enc.Encode(event)
+}
+
+func (p *filePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file.Close()
+}
+
+// natsPublisher publishes every event as JSON on one NATS subject. The client reconnects on its
+// own and buffers events while the server is unreachable.
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(rawURL, subject string) (*natsPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("NATS URL must look like nats://host:4222, got %q", rawURL)
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	conn, err := nats.Connect(rawURL,
+		nats.Name("location-management"),
+		nats.Timeout(natsDialTimeout),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Printf("NATS error: %v", err)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (p *natsPublisher) Publish(event LocationEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return p.conn.Publish(p.subject, payload)
+}
+
+// Close sends the events the client still holds and closes the connection.
+func (p *natsPublisher) Close() error {
+	err := p.conn.FlushTimeout(natsDialTimeout)
+	p.conn.Close()
+	return err
+}
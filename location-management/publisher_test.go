@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingPublisher holds every event until release is closed.
+type blockingPublisher struct {
+	release chan struct{}
+	events  chan LocationEvent
+}
+
+func (p *blockingPublisher) Publish(event LocationEvent) error {
+	<-p.release
+	p.events <- event
+	return nil
+}
+
+func (p *blockingPublisher) Close() error {
+	close(p.events)
+	return nil
+}
+
+func TestAsyncPublisherDropsWhenFull(t *testing.T) {
+	next := &blockingPublisher{release: make(chan struct{}), events: make(chan LocationEvent, 10)}
+	p := newAsyncPublisher(next, 2)
+
+	// The first event is taken by the worker, the next two fill the buffer.
+	assert.NoError(t, p.Publish(LocationEvent{Username: "user0001"}))
+	assert.Eventually(t, func() bool { return len(p.queue) == 0 }, time.Second, time.Millisecond)
+	assert.NoError(t, p.Publish(LocationEvent{Username: "user0002"}))
+	assert.NoError(t, p.Publish(LocationEvent{Username: "user0003"}))
+	assert.Error(t, p.Publish(LocationEvent{Username: "user0004"}))
+
+	close(next.release)
+	assert.NoError(t, p.Close())
+	// Events of updates that arrive during shutdown are refused instead of panicking.
+	assert.ErrorIs(t, p.Publish(LocationEvent{Username: "user0005"}), errPublisherClosed)
+	var published []string
+	for event := range next.events {
+		published = append(published, event.Username)
+	}
+	assert.Equal(t, []string{"user0001", "user0002", "user0003"}, published)
+}
+
+func TestChannelPublisher(t *testing.T) {
+	p, err := newPublisher("channel", "", "", "", 1)
+	assert.NoError(t, err)
+	events := p.(*channelPublisher)
+	fast, unsubscribe := events.Subscribe()
+	slow, _ := events.Subscribe()
+
+	// The slow subscriber misses the second event without holding up the fast one.
+	assert.NoError(t, p.Publish(LocationEvent{Username: "user0001"}))
+	assert.Equal(t, "user0001", (<-fast).Username)
+	assert.Error(t, p.Publish(LocationEvent{Username: "user0002"}))
+	assert.Equal(t, "user0002", (<-fast).Username)
+	assert.Equal(t, "user0001", (<-slow).Username)
+
+	unsubscribe()
+	_, open := <-fast
+	assert.False(t, open)
+	assert.NoError(t, p.Close())
+	_, open = <-slow
+	assert.False(t, open)
+}
+
+func TestLocationEventsHandler(t *testing.T) {
+	events := newChannelPublisher(8)
+	r := gin.Default()
+	r.GET("/api/v1/locations/events", func(c *gin.Context) {
+		LocationEventsHandler(c, events)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/api/v1/locations/events?username=testuser")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// The stream is open once the handler has subscribed.
+	assert.Eventually(t, func() bool {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		return len(events.subscribers) == 1
+	}, time.Second, time.Millisecond)
+	events.Publish(LocationEvent{Username: "otheruser", Latitude: 44.7866, Longitude: 20.4489})
+	events.Publish(LocationEvent{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335})
+	events.Close()
+
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(body), "event:location.updated"))
+	assert.Contains(t, string(body), `"username":"testuser"`)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/locations/events", nil)
+	unconfigured := gin.Default()
+	unconfigured.GET("/api/v1/locations/events", func(c *gin.Context) {
+		LocationEventsHandler(c, nil)
+	})
+	unconfigured.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	p, err := newPublisher("file", "", "", path, 8)
+	assert.NoError(t, err)
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, p.Publish(LocationEvent{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335, Timestamp: now}))
+	assert.NoError(t, p.Publish(LocationEvent{Username: "otheruser", Latitude: 44.7866, Longitude: 20.4489, Timestamp: now}))
+	assert.NoError(t, p.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 2) {
+		var event LocationEvent
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+		assert.Equal(t, LocationEvent{Username: "otheruser", Latitude: 44.7866, Longitude: 20.4489, Timestamp: now}, event)
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	// A minimal server: nats.go sends CONNECT and a PING and waits for the PONG.
+	received := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			if line == "PING" {
+				conn.Write([]byte("PONG\r\n"))
+				continue
+			}
+			received <- line
+		}
+	}()
+
+	p, err := newNATSPublisher("nats://"+ln.Addr().String(), "locations.updated")
+	assert.NoError(t, err)
+	assert.NoError(t, p.Publish(LocationEvent{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335}))
+	assert.NoError(t, p.Close())
+
+	assert.True(t, strings.HasPrefix(<-received, "CONNECT {"))
+	pub := <-received
+	payload := <-received
+	assert.Equal(t, fmt.Sprintf("PUB locations.updated %d", len(payload)), pub)
+	assert.Contains(t, payload, `"username":"testuser"`)
+
+	_, err = newNATSPublisher("http://localhost:4222", "locations.updated")
+	assert.Error(t, err)
+	_, err = newPublisher("kafka", "", "", "", 8)
+	assert.Error(t, err)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+const (
+	mapMargin = 24
+	// mapMinSpan is the smallest extent of a map in meters, so a user who stayed put is not drawn
+	// at an absurd zoom.
+	mapMinSpan  = 500
+	earthRadius = 6371000.0
+)
+
+var (
+	mapBackground = color.RGBA{0xf2, 0xef, 0xe9, 0xff}
+	mapTrack      = color.RGBA{0x1f, 0x6f, 0xd1, 0xff}
+	mapStart      = color.RGBA{0x2e, 0xa0, 0x43, 0xff}
+	mapEnd        = color.RGBA{0xd1, 0x3b, 0x2e, 0xff}
+	mapInk        = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	mapWhite      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+type TrackRenderRequest struct {
+	StartTime time.Time     `form:"start_time"`
+	EndTime   time.Time     `form:"end_time"`
+	Gap       time.Duration `form:"gap,default=10m"`
+	Width     int           `form:"width,default=800" binding:"gte=100,lte=2000"`
+	Height    int           `form:"height,default=600" binding:"gte=100,lte=2000"`
+}
+
+type mapPoint struct{ x, y float64 }
+
+// mercator projects a position to Web Mercator coordinates in radians.
+func mercator(latitude, longitude float64) mapPoint {
+	lat := math.Max(-85, math.Min(85, latitude)) * math.Pi / 180
+	return mapPoint{longitude * math.Pi / 180, math.Log(math.Tan(math.Pi/4 + lat/2))}
+}
+
+// trackMap fits the segments of a track into an image of the given size.
+type trackMap struct {
+	width, height int
+	segments      [][]mapPoint
+	// scale is pixels per Mercator radian; meters is the ground distance of one pixel at the
+	// center of the map.
+	scale, meters float64
+	minX, maxY    float64
+	offX, offY    float64
+}
+
+func newTrackMap(segments [][]exportPoint, width, height int) *trackMap {
+	m := &trackMap{width: width, height: height}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, segment := range segments {
+		projected := make([]mapPoint, len(segment))
+		for i, p := range segment {
+			projected[i] = mercator(p.latitude, p.longitude)
+			minX, maxX = math.Min(minX, projected[i].x), math.Max(maxX, projected[i].x)
+			minY, maxY = math.Min(minY, projected[i].y), math.Max(maxY, projected[i].y)
+		}
+		m.segments = append(m.segments, projected)
+	}
+
+	// One Mercator radian is earthRadius*cos(latitude) meters on the ground.
+	centerY := (minY + maxY) / 2
+	cosLat := math.Cos(2*math.Atan(math.Exp(centerY)) - math.Pi/2)
+	minSpan := mapMinSpan / (earthRadius * cosLat)
+	if maxX-minX < minSpan {
+		centerX := (minX + maxX) / 2
+		minX, maxX = centerX-minSpan/2, centerX+minSpan/2
+	}
+	if maxY-minY < minSpan {
+		minY, maxY = centerY-minSpan/2, centerY+minSpan/2
+	}
+
+	innerW, innerH := float64(width-2*mapMargin), float64(height-2*mapMargin)
+	m.scale = math.Min(innerW/(maxX-minX), innerH/(maxY-minY))
+	m.meters = earthRadius * cosLat / m.scale
+	m.minX, m.maxY = minX, maxY
+	m.offX = mapMargin + (innerW-(maxX-minX)*m.scale)/2
+	m.offY = mapMargin + (innerH-(maxY-minY)*m.scale)/2
+	return m
+}
+
+// pixel returns the image position of a projected point; y grows downwards.
+func (m *trackMap) pixel(p mapPoint) (float64, float64) {
+	return m.offX + (p.x-m.minX)*m.scale, m.offY + (m.maxY-p.y)*m.scale
+}
+
+// scaleBar picks a round distance that is at most a quarter of the width and returns its label
+// and length in pixels.
+func (m *trackMap) scaleBar() (string, float64) {
+	limit := m.meters * float64(m.width) / 4
+	distance := math.Pow(10, math.Floor(math.Log10(limit)))
+	for _, factor := range []float64{5, 2} {
+		if distance*factor <= limit {
+			distance *= factor
+			break
+		}
+	}
+	label := strconv.FormatFloat(distance, 'f', -1, 64) + " m"
+	if distance >= 1000 {
+		label = strconv.FormatFloat(distance/1000, 'f', -1, 64) + " km"
+	}
+	return label, distance / m.meters
+}
+
+// mapFont is a 5x7 bitmap font covering the characters of scale bar labels.
+var mapFont = map[rune][7]string{
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"####.", "....#", "....#", ".###.", "....#", "....#", "####."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'.': {".....", ".....", ".....", ".....", ".....", ".##..", ".##.."},
+	'k': {"#....", "#....", "#..#.", "#.#..", "##...", "#.#..", "#..#."},
+	'm': {".....", ".....", "##.#.", "#.#.#", "#.#.#", "#.#.#", "#.#.#"},
+	' ': {".....", ".....", ".....", ".....", ".....", ".....", "....."},
+}
+
+// canvas draws on an RGBA image.
+type canvas struct {
+	img *image.RGBA
+}
+
+func (c canvas) disk(x, y, r float64, col color.RGBA) {
+	for py := int(math.Floor(y - r)); py <= int(math.Ceil(y+r)); py++ {
+		for px := int(math.Floor(x - r)); px <= int(math.Ceil(x+r)); px++ {
+			dx, dy := float64(px)+0.5-x, float64(py)+0.5-y
+			if dx*dx+dy*dy <= r*r {
+				c.img.SetRGBA(px, py, col)
+			}
+		}
+	}
+}
+
+// line stamps disks along a segment, which gives thick lines with round joins.
+func (c canvas) line(x0, y0, x1, y1, width float64, col color.RGBA) {
+	steps := int(math.Ceil(math.Hypot(x1-x0, y1-y0)))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		c.disk(x0+(x1-x0)*t, y0+(y1-y0)*t, width/2, col)
+	}
+}
+
+func (c canvas) text(x, y int, s string, col color.RGBA) {
+	for _, r := range s {
+		glyph := mapFont[r]
+		for gy, row := range glyph {
+			for gx, bit := range row {
+				if bit == '#' {
+					c.img.SetRGBA(x+gx, y+gy, col)
+				}
+			}
+		}
+		x += 6
+	}
+}
+
+func (c canvas) marker(x, y float64, col color.RGBA) {
+	c.disk(x, y, 7, mapWhite)
+	c.disk(x, y, 5, col)
+}
+
+func renderTrackPNG(w io.Writer, m *trackMap) error {
+	img := image.NewRGBA(image.Rect(0, 0, m.width, m.height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(mapBackground), image.Point{}, draw.Src)
+	c := canvas{img}
+
+	for _, segment := range m.segments {
+		x0, y0 := m.pixel(segment[0])
+		c.disk(x0, y0, 1.5, mapTrack)
+		for _, p := range segment[1:] {
+			x1, y1 := m.pixel(p)
+			// Points within a pixel of the last one drawn add nothing.
+			if math.Abs(x1-x0) < 1 && math.Abs(y1-y0) < 1 {
+				continue
+			}
+			c.line(x0, y0, x1, y1, 3, mapTrack)
+			x0, y0 = x1, y1
+		}
+	}
+	first, last := m.ends()
+	endX, endY := m.pixel(last)
+	c.marker(endX, endY, mapEnd)
+	startX, startY := m.pixel(first)
+	c.marker(startX, startY, mapStart)
+
+	label, length := m.scaleBar()
+	x, y := float64(mapMargin), float64(m.height-mapMargin/2)
+	c.line(x, y, x+length, y, 2, mapInk)
+	c.line(x, y-4, x, y, 2, mapInk)
+	c.line(x+length, y-4, x+length, y, 2, mapInk)
+	c.text(int(x+length)+6, int(y)-6, label, mapInk)
+
+	return png.Encode(w, img)
+}
+
+func (m *trackMap) ends() (mapPoint, mapPoint) {
+	lastSegment := m.segments[len(m.segments)-1]
+	return m.segments[0][0], lastSegment[len(lastSegment)-1]
+}
+
+func renderTrackSVG(w io.Writer, m *trackMap, username string) error {
+	b := bufio.NewWriter(w)
+	hex := func(c color.RGBA) string { return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B) }
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %[1]d %[2]d">`+"\n", m.width, m.height)
+	fmt.Fprintf(b, "<title>%s</title>\n", escapeXML(username))
+	fmt.Fprintf(b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hex(mapBackground))
+	for _, segment := range m.segments {
+		fmt.Fprintf(b, `<polyline fill="none" stroke="%s" stroke-width="3" stroke-linecap="round" stroke-linejoin="round" points="`, hex(mapTrack))
+		var lastX, lastY float64
+		for i, p := range segment {
+			x, y := m.pixel(p)
+			if i > 0 {
+				if math.Abs(x-lastX) < 1 && math.Abs(y-lastY) < 1 {
+					continue
+				}
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(b, "%.1f,%.1f", x, y)
+			lastX, lastY = x, y
+		}
+		b.WriteString("\"/>\n")
+	}
+	first, last := m.ends()
+	for _, marker := range []struct {
+		point mapPoint
+		color color.RGBA
+	}{{last, mapEnd}, {first, mapStart}} {
+		x, y := m.pixel(marker.point)
+		fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="6" fill="%s" stroke="white" stroke-width="2"/>`+"\n", x, y, hex(marker.color))
+	}
+
+	label, length := m.scaleBar()
+	x, y := float64(mapMargin), float64(m.height-mapMargin/2)
+	fmt.Fprintf(b, `<path d="M%.1f %.1fV%.1fH%.1fV%.1f" fill="none" stroke="%s" stroke-width="2"/>`+"\n",
+		x, y-4, y, x+length, y-4, hex(mapInk))
+	fmt.Fprintf(b, `<text x="%.1f" y="%.1f" font-family="sans-serif" font-size="11" fill="%s">%s</text>`+"\n",
+		x+length+6, y+1, hex(mapInk), label)
+	b.WriteString("</svg>\n")
+	return b.Flush()
+}
+
+// RenderTrackHandler draws the track of a user between start_time and end_time as a PNG or SVG
+// map: the segments as lines, the first point green and the last red, fitted to the image, with a
+// scale bar. There are no map tiles underneath.
+func RenderTrackHandler(c *gin.Context, grpcHostname, format string) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req TrackRenderRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Gap <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "gap must be positive"})
+		return
+	}
+	if req.EndTime.IsZero() {
+		req.EndTime = time.Now()
+	}
+
+	withLocationHistory(c, grpcHostname, func(client pb.LocationServiceClient) {
+		stream, err := client.GetTrack(c.Request.Context(), &pb.TrackRequest{
+			Username:  uri.Username,
+			StartTime: timestamppb.New(req.StartTime),
+			EndTime:   timestamppb.New(req.EndTime),
+		})
+		if err != nil {
+			respondHistoryError(c, err, "read track")
+			return
+		}
+		var segments [][]exportPoint
+		var prev time.Time
+		for {
+			point, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				respondHistoryError(c, err, "read track")
+				return
+			}
+			p := exportPoint{latitude: point.Latitude, longitude: point.Longitude, timestamp: point.Timestamp.AsTime()}
+			if len(segments) == 0 || p.timestamp.Sub(prev) > req.Gap {
+				segments = append(segments, nil)
+			}
+			segments[len(segments)-1] = append(segments[len(segments)-1], p)
+			prev = p.timestamp
+		}
+		if len(segments) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "track has no points in the time range"})
+			return
+		}
+
+		m := newTrackMap(segments, req.Width, req.Height)
+		if format == "svg" {
+			c.Header("Content-Type", "image/svg+xml")
+			c.Status(http.StatusOK)
+			err = renderTrackSVG(c.Writer, m, uri.Username)
+		} else {
+			c.Header("Content-Type", "image/png")
+			c.Status(http.StatusOK)
+			err = renderTrackPNG(c.Writer, m)
+		}
+		if err != nil {
+			log.Printf("Failed to render track: %v", err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image/png"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func renderTestSegments() [][]exportPoint {
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	return [][]exportPoint{
+		{
+			{latitude: 45.2671, longitude: 19.8335, timestamp: start},
+			{latitude: 45.2550, longitude: 19.8450, timestamp: start.Add(time.Minute)},
+		},
+		{
+			{latitude: 45.2400, longitude: 19.8600, timestamp: start.Add(time.Hour)},
+		},
+	}
+}
+
+func TestTrackMap(t *testing.T) {
+	m := newTrackMap(renderTestSegments(), 800, 600)
+	for _, segment := range m.segments {
+		for _, p := range segment {
+			x, y := m.pixel(p)
+			assert.True(t, x >= mapMargin-1e-6 && x <= 800-mapMargin+1e-6, x)
+			assert.True(t, y >= mapMargin-1e-6 && y <= 600-mapMargin+1e-6, y)
+		}
+	}
+	// The first point is the north-west corner of the track.
+	x, y := m.pixel(m.segments[0][0])
+	assert.InDelta(t, mapMargin, y, 1e-6)
+	assert.Less(t, x, 400.0)
+
+	// The track spans 3 km from north to south over 552 pixels.
+	assert.InDelta(t, 5.46, m.meters, 0.01)
+	label, length := m.scaleBar()
+	assert.Equal(t, "1 km", label)
+	assert.InDelta(t, 1000/m.meters, length, 1e-9)
+
+	// A single position still gets a map of at least mapMinSpan meters.
+	m = newTrackMap([][]exportPoint{{{latitude: 45.2671, longitude: 19.8335}}}, 400, 400)
+	assert.False(t, math.IsInf(m.scale, 0))
+	assert.InDelta(t, mapMinSpan/352.0, m.meters, 0.01)
+	label, _ = m.scaleBar()
+	assert.Equal(t, "100 m", label)
+}
+
+func TestRenderTrack(t *testing.T) {
+	m := newTrackMap(renderTestSegments(), 640, 480)
+
+	var buf bytes.Buffer
+	assert.NoError(t, renderTrackPNG(&buf, m))
+	img, err := png.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 640, img.Bounds().Dx())
+	first, last := m.ends()
+	x, y := m.pixel(first)
+	assert.Equal(t, mapStart, img.At(int(x), int(y)))
+	x, y = m.pixel(last)
+	assert.Equal(t, mapEnd, img.At(int(x), int(y)))
+	assert.Equal(t, mapBackground, img.At(1, 1))
+
+	buf.Reset()
+	assert.NoError(t, renderTrackSVG(&buf, m, "testuser"))
+	var svg struct {
+		Title     string `xml:"title"`
+		Polylines []struct {
+			Points string `xml:"points,attr"`
+		} `xml:"polyline"`
+		Circles []struct {
+			Fill string `xml:"fill,attr"`
+		} `xml:"circle"`
+		Text string `xml:"text"`
+	}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &svg))
+	assert.Equal(t, "testuser", svg.Title)
+	assert.Len(t, svg.Polylines, 2)
+	assert.Len(t, svg.Circles, 2)
+	assert.Equal(t, "#2ea043", svg.Circles[1].Fill)
+	assert.Equal(t, "1 km", svg.Text)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+type ReplayRequest struct {
+	StartTime time.Time `form:"start_time" binding:"required"`
+	EndTime   time.Time `form:"end_time"`
+	Speed     float64   `form:"speed" binding:"omitempty,gt=0,lte=3600"`
+	From      time.Time `form:"from"`
+}
+
+type ReplayPoint struct {
+	Username  string    `json:"username"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Timestamp time.Time `json:"timestamp"`
+	Place     *Place    `json:"place,omitempty"`
+}
+
+// replayDelay is how long playback waits between two points at the given speed factor.
+func replayDelay(prev, next time.Time, speed float64) time.Duration {
+	return time.Duration(float64(next.Sub(prev)) / speed)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ReplayTrackHandler streams a user's track as server-sent events, keeping the original time
+// between points divided by the speed factor. Clients pause by disconnecting and seek by
+// reconnecting with from set to a timestamp. Events carry the point's row id, so a Last-Event-ID
+// header resumes right after that point even among points of the same second.
+func ReplayTrackHandler(c *gin.Context, grpcHostname string) {
+	var uri UserURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req ReplayRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Set EndTime to current time if not provided
+	if req.EndTime.IsZero() {
+		req.EndTime = time.Now()
+	}
+	if req.Speed == 0 {
+		req.Speed = 1
+	}
+
+	var lastEventID int64
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Last-Event-ID must be the id of a replayed point"})
+			return
+		}
+		lastEventID = n
+	}
+	start := req.StartTime
+	if req.From.After(start) {
+		start = req.From
+	}
+
+	conn, err := dialLocationHistory(grpcHostname)
+	if err != nil {
+		log.Printf("Failed to connect to location history microservice: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to location history microservice"})
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewLocationServiceClient(conn)
+
+	ctx := c.Request.Context()
+	stream, err := client.GetTrack(ctx, &pb.TrackRequest{
+		Username:  uri.Username,
+		StartTime: timestamppb.New(start),
+		EndTime:   timestamppb.New(req.EndTime),
+		AfterId:   lastEventID,
+	})
+	if err != nil {
+		log.Printf("Failed to read track from microservice: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read track from microservice"})
+		return
+	}
+
+	started := false
+	var prev time.Time
+	for {
+		point, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !started {
+				// A Last-Event-ID that is not a point of the user is rejected before the first point.
+				respondHistoryError(c, err, "read track")
+				return
+			}
+			log.Printf("Failed to read track from microservice: %v", err)
+			if ctx.Err() == nil {
+				c.Render(-1, sse.Event{Event: "error", Data: gin.H{"error": "Failed to read track from microservice"}})
+			}
+			return
+		}
+
+		timestamp := point.Timestamp.AsTime()
+		if started && !sleepContext(ctx, replayDelay(prev, timestamp, req.Speed)) {
+			return
+		}
+		started = true
+		prev = timestamp
+
+		c.Render(-1, sse.Event{
+			Id:    strconv.FormatInt(point.Id, 10),
+			Event: "point",
+			Data: ReplayPoint{
+				Username:  uri.Username,
+				Latitude:  point.Latitude,
+				Longitude: point.Longitude,
+				Timestamp: timestamp,
+				Place:     reverseGeocode(point.Latitude, point.Longitude),
+			},
+		})
+		c.Writer.Flush()
+	}
+
+	c.Render(-1, sse.Event{Event: "end", Data: gin.H{"status": "replay finished"}})
+}
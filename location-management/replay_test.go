@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+// trackService serves a fixed track ordered by id the way the history service does, and hands
+// every GetTrack request to requests.
+type trackService struct {
+	pb.UnimplementedLocationServiceServer
+	points   []*pb.TrackPoint
+	requests chan *pb.TrackRequest
+}
+
+func (s *trackService) GetTrack(req *pb.TrackRequest, stream pb.LocationService_GetTrackServer) error {
+	s.requests <- req
+	known := req.AfterId == 0
+	for _, point := range s.points {
+		known = known || point.Id == req.AfterId
+	}
+	if !known {
+		return status.Errorf(codes.InvalidArgument, "point %d is not part of the track of %s", req.AfterId, req.Username)
+	}
+	for _, point := range s.points {
+		t := point.Timestamp.AsTime()
+		if t.Before(req.StartTime.AsTime()) || t.After(req.EndTime.AsTime()) || point.Id <= req.AfterId {
+			continue
+		}
+		if err := stream.Send(point); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type replayEvent struct {
+	id, event string
+	point     ReplayPoint
+}
+
+func readReplayEvents(t *testing.T, body string) []replayEvent {
+	var events []replayEvent
+	var event replayEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			events = append(events, event)
+			event = replayEvent{}
+		case strings.HasPrefix(line, "id:"):
+			event.id = strings.TrimPrefix(line, "id:")
+		case strings.HasPrefix(line, "event:"):
+			event.event = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:") && event.event == "point":
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event.point))
+		}
+	}
+	return events
+}
+
+func TestReplayDelay(t *testing.T) {
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Minute, replayDelay(start, start.Add(time.Minute), 1))
+	assert.Equal(t, 15*time.Second, replayDelay(start, start.Add(time.Minute), 4))
+	assert.Equal(t, time.Duration(0), replayDelay(start, start, 60))
+}
+
+func TestReplayTrackHandler(t *testing.T) {
+	start := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	service := &trackService{
+		points: []*pb.TrackPoint{
+			{Id: 3, Latitude: 45.25, Longitude: 19.84, Timestamp: timestamppb.New(start)},
+			// Stored timestamps have whole seconds, so fixes a moment apart share one.
+			{Id: 7, Latitude: 45.26, Longitude: 19.84, Timestamp: timestamppb.New(start.Add(time.Second))},
+			{Id: 8, Latitude: 45.27, Longitude: 19.84, Timestamp: timestamppb.New(start.Add(time.Second))},
+			{Id: 9, Latitude: 45.28, Longitude: 19.84, Timestamp: timestamppb.New(start.Add(2 * time.Second))},
+		},
+		requests: make(chan *pb.TrackRequest, 10),
+	}
+	hostname := startTestLocationHistory(t, service)
+
+	r := gin.Default()
+	r.GET("/api/v1/users/:username/replay", func(c *gin.Context) {
+		ReplayTrackHandler(c, hostname)
+	})
+	replay := func(query, lastEventID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/users/testuser/replay?start_time=2024-07-01T12:00:00Z&end_time=2024-07-01T13:00:00Z&"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	ids := func(events []replayEvent) []string {
+		ids := []string{}
+		for _, e := range events {
+			ids = append(ids, e.event+":"+e.id)
+		}
+		return ids
+	}
+
+	// Two seconds of track at 20 times the speed take a tenth of a second.
+	began := time.Now()
+	w := replay("speed=20", "")
+	elapsed := time.Since(began)
+	assert.Equal(t, http.StatusOK, w.Code)
+	events := readReplayEvents(t, w.Body.String())
+	assert.Equal(t, []string{"point:3", "point:7", "point:8", "point:9", "end:"}, ids(events))
+	assert.Equal(t, 45.26, events[1].point.Latitude)
+	assert.Equal(t, start.Add(time.Second), events[2].point.Timestamp)
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+	<-service.requests
+
+	// Resuming after a point goes on with the next one of the same second.
+	w = replay("speed=3600", "7")
+	assert.Equal(t, []string{"point:8", "point:9", "end:"}, ids(readReplayEvents(t, w.Body.String())))
+	req := <-service.requests
+	assert.Equal(t, int64(7), req.AfterId)
+	assert.Equal(t, "testuser", req.Username)
+
+	// Seeking starts the track at from.
+	w = replay("speed=3600&from=2024-07-01T12:00:02Z", "")
+	assert.Equal(t, []string{"point:9", "end:"}, ids(readReplayEvents(t, w.Body.String())))
+	req = <-service.requests
+	assert.Equal(t, start.Add(2*time.Second), req.StartTime.AsTime())
+	assert.Equal(t, int64(0), req.AfterId)
+
+	// Resuming after a point that is not part of the track is rejected.
+	w = replay("speed=3600", "5")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "point 5 is not part of the track")
+	<-service.requests
+
+	assert.Equal(t, http.StatusBadRequest, replay("", "2024-07-01T12:00:01Z").Code)
+	assert.Equal(t, http.StatusBadRequest, replay("speed=0.5&from=soon", "").Code)
+	assert.Equal(t, http.StatusBadRequest, replay("speed=-1", "").Code)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	mvtExtent = 4096
+	// mvtBuffer is how far past its edges, in tile units, a tile includes positions, so markers on
+	// an edge are drawn whole on both tiles.
+	mvtBuffer = 64
+	// Below mvtClusterZoom, and in tiles with more than mvtMaxFeatures positions, positions are
+	// clustered in cells of mvtClusterCell tile units, which bounds a tile to (4096/64)^2 features.
+	mvtClusterZoom  = 14
+	mvtMaxFeatures  = 4096
+	mvtClusterCell  = 64
+	mvtLayerVersion = 2
+)
+
+// TileURI addresses a tile; Y is the file name, such as "1234.mvt".
+type TileURI struct {
+	Z int    `uri:"z" binding:"gte=0,lte=22"`
+	X int    `uri:"x" binding:"gte=0"`
+	Y string `uri:"y" binding:"required"`
+}
+
+type tilePosition struct {
+	username  string
+	updatedAt sql.NullTime
+	// x and y are in tile units, from the top left corner.
+	x, y int64
+}
+
+// tileBounds returns the positions a tile covers, including its buffer, as latitude and longitude.
+func tileBounds(z, x, y int) (minLat, minLon, maxLat, maxLon float64) {
+	n := math.Exp2(float64(z))
+	buffer := float64(mvtBuffer) / mvtExtent
+	lon := func(tx float64) float64 { return tx/n*360 - 180 }
+	lat := func(ty float64) float64 { return math.Atan(math.Sinh(math.Pi*(1-2*ty/n))) * 180 / math.Pi }
+	return lat(float64(y) + 1 + buffer), lon(float64(x) - buffer), lat(float64(y) - buffer), lon(float64(x) + 1 + buffer)
+}
+
+// tilePoint projects a position to the units of tile (z, x, y).
+func tilePoint(z, x, y int, latitude, longitude float64) (int64, int64) {
+	n := math.Exp2(float64(z))
+	lat := math.Max(-85.0511, math.Min(85.0511, latitude)) * math.Pi / 180
+	tx := (longitude + 180) / 360 * n
+	ty := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n
+	return int64(math.Floor((tx - float64(x)) * mvtExtent)), int64(math.Floor((ty - float64(y)) * mvtExtent))
+}
+
+func queryTilePositions(db *sql.DB, z, x, y int) ([]tilePosition, error) {
+	minLat, minLon, maxLat, maxLon := tileBounds(z, x, y)
+	rows, err := db.Query(`SELECT username, latitude, longitude, updated_at FROM user_locations
+		WHERE latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?`, minLat, maxLat, minLon, maxLon)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var positions []tilePosition
+	for rows.Next() {
+		var p tilePosition
+		var latitude, longitude float64
+		if err := rows.Scan(&p.username, &latitude, &longitude, &p.updatedAt); err != nil {
+			return nil, err
+		}
+		p.x, p.y = tilePoint(z, x, y, latitude, longitude)
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+// mvtLayer builds one layer of a Mapbox Vector Tile (specification 2.1), sharing keys and values
+// between features.
+type mvtLayer struct {
+	name     string
+	features []byte
+	keys     []string
+	keyIndex map[string]uint64
+	values   [][]byte
+	valIndex map[string]uint64
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{name: name, keyIndex: map[string]uint64{}, valIndex: map[string]uint64{}}
+}
+
+func (l *mvtLayer) key(k string) uint64 {
+	if i, ok := l.keyIndex[k]; ok {
+		return i
+	}
+	l.keyIndex[k] = uint64(len(l.keys))
+	l.keys = append(l.keys, k)
+	return l.keyIndex[k]
+}
+
+// value adds an encoded Value message, deduplicated by its encoding.
+func (l *mvtLayer) value(encoded []byte) uint64 {
+	if i, ok := l.valIndex[string(encoded)]; ok {
+		return i
+	}
+	l.valIndex[string(encoded)] = uint64(len(l.values))
+	l.values = append(l.values, encoded)
+	return l.valIndex[string(encoded)]
+}
+
+func mvtString(s string) []byte {
+	return protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), s)
+}
+
+func mvtUint(n uint64) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, 5, protowire.VarintType), n)
+}
+
+func mvtBool(b bool) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, 7, protowire.VarintType), protowire.EncodeBool(b))
+}
+
+// addPoint adds a point feature with the given properties, as pairs of a key and an encoded value.
+func (l *mvtLayer) addPoint(x, y int64, properties ...any) {
+	var tags []byte
+	for i := 0; i+1 < len(properties); i += 2 {
+		tags = protowire.AppendVarint(tags, l.key(properties[i].(string)))
+		tags = protowire.AppendVarint(tags, l.value(properties[i+1].([]byte)))
+	}
+	// A single MoveTo command (id 1, count 1) followed by the zigzag-encoded position.
+	geometry := protowire.AppendVarint(nil, 1|1<<3)
+	geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(x))
+	geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(y))
+
+	var feature []byte
+	feature = protowire.AppendTag(feature, 2, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, tags)
+	feature = protowire.AppendTag(feature, 3, protowire.VarintType)
+	feature = protowire.AppendVarint(feature, 1) // POINT
+	feature = protowire.AppendTag(feature, 4, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, geometry)
+
+	l.features = protowire.AppendTag(l.features, 2, protowire.BytesType)
+	l.features = protowire.AppendBytes(l.features, feature)
+}
+
+// encode returns the layer as a field of a Tile message.
+func (l *mvtLayer) encode() []byte {
+	var layer []byte
+	layer = protowire.AppendTag(layer, 15, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, mvtLayerVersion)
+	layer = protowire.AppendTag(layer, 1, protowire.BytesType)
+	layer = protowire.AppendString(layer, l.name)
+	layer = append(layer, l.features...)
+	for _, k := range l.keys {
+		layer = protowire.AppendTag(layer, 3, protowire.BytesType)
+		layer = protowire.AppendString(layer, k)
+	}
+	for _, v := range l.values {
+		layer = protowire.AppendTag(layer, 4, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, v)
+	}
+	layer = protowire.AppendTag(layer, 5, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, mvtExtent)
+
+	tile := protowire.AppendTag(nil, 3, protowire.BytesType)
+	return protowire.AppendBytes(tile, layer)
+}
+
+// encodeUserTile encodes positions as the "users" layer. Each position is a feature with its
+// username and updated_at; clustered tiles replace positions sharing a cell with one feature at
+// their centroid carrying cluster=true and point_count.
+func encodeUserTile(positions []tilePosition, cluster bool) []byte {
+	if len(positions) == 0 {
+		return nil
+	}
+	layer := newMVTLayer("users")
+	addPosition := func(p tilePosition) {
+		updatedAt := ""
+		if p.updatedAt.Valid {
+			updatedAt = p.updatedAt.Time.UTC().Format(time.RFC3339)
+		}
+		layer.addPoint(p.x, p.y, "username", mvtString(p.username), "updated_at", mvtString(updatedAt))
+	}
+	if !cluster {
+		for _, p := range positions {
+			addPosition(p)
+		}
+		return layer.encode()
+	}
+
+	type cell struct {
+		first      tilePosition
+		count      int64
+		sumX, sumY int64
+	}
+	cells := map[[2]int64]*cell{}
+	var order [][2]int64
+	for _, p := range positions {
+		k := [2]int64{floorDiv(p.x, mvtClusterCell), floorDiv(p.y, mvtClusterCell)}
+		c, ok := cells[k]
+		if !ok {
+			c = &cell{first: p}
+			cells[k] = c
+			order = append(order, k)
+		}
+		c.count++
+		c.sumX += p.x
+		c.sumY += p.y
+	}
+	for _, k := range order {
+		c := cells[k]
+		if c.count == 1 {
+			addPosition(c.first)
+			continue
+		}
+		layer.addPoint(c.sumX/c.count, c.sumY/c.count, "cluster", mvtBool(true), "point_count", mvtUint(uint64(c.count)))
+	}
+	return layer.encode()
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func parseTileURI(c *gin.Context) (z, x, y int, err error) {
+	var uri TileURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		return 0, 0, 0, err
+	}
+	name, ok := strings.CutSuffix(uri.Y, ".mvt")
+	if !ok {
+		return 0, 0, 0, errors.New("tiles are served as .mvt")
+	}
+	y, err = strconv.Atoi(name)
+	if err != nil {
+		return 0, 0, 0, errors.New("invalid tile row")
+	}
+	if n := 1 << uri.Z; uri.X >= n || y < 0 || y >= n {
+		return 0, 0, 0, errors.New("tile is outside the zoom level")
+	}
+	return uri.Z, uri.X, y, nil
+}
+
+// UserTileHandler serves the current positions of users as Mapbox Vector Tiles.
+func UserTileHandler(c *gin.Context, db *sql.DB) {
+	z, x, y, err := parseTileURI(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	positions, err := queryTilePositions(db, z, x, y)
+	if err != nil {
+		respondError(c, err, "read tile")
+		return
+	}
+	tile := encodeUserTile(positions, z < mvtClusterZoom || len(positions) > mvtMaxFeatures)
+	c.Data(http.StatusOK, "application/vnd.mapbox-vector-tile", tile)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedFeature is a point feature of a decoded tile, with its properties resolved.
+type decodedFeature struct {
+	x, y       int64
+	properties map[string]any
+}
+
+// decodeUserTile decodes the "users" layer of a tile written by encodeUserTile.
+func decodeUserTile(t *testing.T, tile []byte) (extent uint64, features []decodedFeature) {
+	t.Helper()
+	fields := func(b []byte, each func(num protowire.Number, v uint64, data []byte)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			assert.Greater(t, n, 0)
+			b = b[n:]
+			switch typ {
+			case protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				each(num, v, nil)
+				b = b[n:]
+			case protowire.BytesType:
+				data, n := protowire.ConsumeBytes(b)
+				each(num, 0, data)
+				b = b[n:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+	packed := func(b []byte) []uint64 {
+		var values []uint64
+		for len(b) > 0 {
+			v, n := protowire.ConsumeVarint(b)
+			values = append(values, v)
+			b = b[n:]
+		}
+		return values
+	}
+
+	var layers [][]byte
+	fields(tile, func(num protowire.Number, _ uint64, data []byte) {
+		assert.Equal(t, protowire.Number(3), num)
+		layers = append(layers, data)
+	})
+	assert.Len(t, layers, 1)
+
+	var keys []string
+	var values []any
+	var rawFeatures [][]byte
+	fields(layers[0], func(num protowire.Number, v uint64, data []byte) {
+		switch num {
+		case 1:
+			assert.Equal(t, "users", string(data))
+		case 2:
+			rawFeatures = append(rawFeatures, data)
+		case 3:
+			keys = append(keys, string(data))
+		case 4:
+			fields(data, func(num protowire.Number, v uint64, data []byte) {
+				switch num {
+				case 1:
+					values = append(values, string(data))
+				case 5:
+					values = append(values, v)
+				case 7:
+					values = append(values, v != 0)
+				}
+			})
+		case 5:
+			extent = v
+		case 15:
+			assert.Equal(t, uint64(2), v)
+		}
+	})
+
+	for _, raw := range rawFeatures {
+		f := decodedFeature{properties: map[string]any{}}
+		fields(raw, func(num protowire.Number, v uint64, data []byte) {
+			switch num {
+			case 2:
+				tags := packed(data)
+				for i := 0; i+1 < len(tags); i += 2 {
+					f.properties[keys[tags[i]]] = values[tags[i+1]]
+				}
+			case 3:
+				assert.Equal(t, uint64(1), v)
+			case 4:
+				geometry := packed(data)
+				assert.Equal(t, []uint64{9}, geometry[:1])
+				f.x, f.y = protowire.DecodeZigZag(geometry[1]), protowire.DecodeZigZag(geometry[2])
+			}
+		})
+		features = append(features, f)
+	}
+	return extent, features
+}
+
+func TestTilePoint(t *testing.T) {
+	x, y := tilePoint(0, 0, 0, 0, 0)
+	assert.Equal(t, int64(2048), x)
+	assert.Equal(t, int64(2048), y)
+
+	// Novi Sad is in tile 14/9094/5876.
+	x, y = tilePoint(14, 9094, 5876, 45.2671, 19.8335)
+	assert.True(t, x >= 0 && x < mvtExtent, x)
+	assert.True(t, y >= 0 && y < mvtExtent, y)
+
+	minLat, minLon, maxLat, maxLon := tileBounds(14, 9094, 5876)
+	assert.True(t, minLat < 45.2671 && 45.2671 < maxLat)
+	assert.True(t, minLon < 19.8335 && 19.8335 < maxLon)
+}
+
+func TestEncodeUserTile(t *testing.T) {
+	updatedAt := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	positions := []tilePosition{
+		{username: "first", x: 100, y: 100},
+		{username: "second", x: 110, y: 120},
+		{username: "third", x: -20, y: 4000},
+	}
+	for i := range positions {
+		positions[i].updatedAt.Time, positions[i].updatedAt.Valid = updatedAt, true
+	}
+
+	extent, features := decodeUserTile(t, encodeUserTile(positions, false))
+	assert.Equal(t, uint64(mvtExtent), extent)
+	assert.Len(t, features, 3)
+	assert.Equal(t, decodedFeature{x: -20, y: 4000, properties: map[string]any{
+		"username": "third", "updated_at": "2024-07-01T12:00:00Z",
+	}}, features[2])
+
+	// The first two share a cell and become one cluster at their centroid.
+	_, features = decodeUserTile(t, encodeUserTile(positions, true))
+	assert.Len(t, features, 2)
+	assert.Equal(t, decodedFeature{x: 105, y: 110, properties: map[string]any{
+		"cluster": true, "point_count": uint64(2),
+	}}, features[0])
+	assert.Equal(t, "third", features[1].properties["username"])
+
+	assert.Empty(t, encodeUserTile(nil, true))
+}
+
+func TestUserTileHandler(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{
+			Username: fmt.Sprintf("user%d", i), Latitude: 45.2671 + float64(i)*0.001, Longitude: 19.8335, Timestamp: now,
+		}))
+	}
+	assert.NoError(t, updateLocation(testDB, LocationUpdateRequest{Username: "faraway", Latitude: -33.8688, Longitude: 151.2093, Timestamp: now}))
+
+	r := gin.Default()
+	r.GET("/tiles/users/:z/:x/:y", func(c *gin.Context) {
+		UserTileHandler(c, testDB)
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/tiles/users/14/9094/5876.mvt")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/vnd.mapbox-vector-tile", w.Header().Get("Content-Type"))
+	_, features := decodeUserTile(t, w.Body.Bytes())
+	assert.Len(t, features, 3)
+	for _, f := range features {
+		assert.Contains(t, f.properties["username"], "user")
+	}
+
+	// At zoom 2 the three users in Novi Sad are one cluster.
+	_, features = decodeUserTile(t, get("/tiles/users/2/2/1.mvt").Body.Bytes())
+	assert.Len(t, features, 1)
+	assert.Equal(t, uint64(3), features[0].properties["point_count"])
+
+	w = get("/tiles/users/14/0/0.mvt")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+
+	for _, path := range []string{"/tiles/users/2/4/0.mvt", "/tiles/users/23/0/0.mvt", "/tiles/users/2/0/0.png", "/tiles/users/2/0/a.mvt"} {
+		assert.Equal(t, http.StatusBadRequest, get(path).Code, path)
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventLocationUpdated is sent for every accepted update. Geofence and proximity events are
+// published as "geofence.<event>" and "proximity.<event>".
+const EventLocationUpdated = "location.updated"
+
+// EventAlertTriggered is sent for every alert the location history microservice raises.
+const EventAlertTriggered = "alert.triggered"
+
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = time.Second
+	webhookBatchSize    = 100
+	maxWebhookBackoff   = time.Hour
+)
+
+// webhooks delivers queued events in the background; it is set up in main.
+var webhooks *webhookDispatcher
+
+// webhookAllowPrivate lets webhooks reach loopback, private and link-local addresses.
+var webhookAllowPrivate bool
+
+type WebhookRequest struct {
+	URL        string   `json:"url" binding:"required,url"`
+	Secret     string   `json:"secret,omitempty" binding:"omitempty,min=16"`
+	EventTypes []string `json:"event_types,omitempty" binding:"dive,oneof=location.updated geofence.enter geofence.exit geofence.dwell proximity.triggered proximity.cleared alert.triggered"`
+	Usernames  []string `json:"usernames,omitempty" binding:"dive,min=4,max=16,alphanum"`
+}
+
+type Webhook struct {
+	ID int64 `json:"id"`
+	WebhookRequest
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DeadLetter struct {
+	ID        int64     `json:"id"`
+	WebhookID int64     `json:"webhook_id"`
+	EventType string    `json:"event_type"`
+	Payload   string    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+type DeadLettersRequest struct {
+	WebhookID int64 `form:"webhook_id" binding:"gte=0"`
+}
+
+// LocationEvent is the data of a location.updated event.
+type LocationEvent struct {
+	Username  string    `json:"username"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookEvent is queued for every webhook whose filters match its type and one of its users.
+type webhookEvent struct {
+	Type      string
+	Usernames []string
+	Data      interface{}
+}
+
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+var (
+	errWebhookNotFound    = fmt.Errorf("webhook %w", errNotFound)
+	errDeadLetterNotFound = fmt.Errorf("dead letter %w", errNotFound)
+	errWebhookAddress     = errors.New("webhook address is loopback, private or link-local")
+)
+
+// webhookAddressAllowed reports whether webhooks may be sent to ip. Unless allowPrivate is set,
+// only public addresses are, so that a webhook cannot reach the services next to this one.
+func webhookAddressAllowed(ip net.IP, allowPrivate bool) bool {
+	if allowPrivate {
+		return true
+	}
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// validateWebhookURL rejects URLs that are not http(s) or name a host webhooks may not be sent
+// to. Host names are checked again for every connection, once they are resolved.
+func validateWebhookURL(rawURL string, allowPrivate bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook URL must be http or https")
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil && !webhookAddressAllowed(ip, allowPrivate) {
+		return errWebhookAddress
+	}
+	if !allowPrivate && (strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost")) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signWebhook returns the value of the signature header: the hex HMAC-SHA256 of the body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay doubles the backoff with every failed attempt.
+func retryDelay(backoff time.Duration, attempts int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+	return delay
+}
+
+func matchesFilter(filter []string, values ...string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		for _, v := range values {
+			if f == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func listWebhooks(db *sql.DB) ([]Webhook, error) {
+	rows, err := db.Query("SELECT id, url, secret, event_types, usernames, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		var eventTypes, usernames string
+		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &eventTypes, &usernames, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(eventTypes), &w.EventTypes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(usernames), &w.Usernames); err != nil {
+			return nil, err
+		}
+		list = append(list, w)
+	}
+	return list, rows.Err()
+}
+
+func createWebhook(db *sql.DB, req WebhookRequest, now time.Time) (Webhook, error) {
+	if req.Secret == "" {
+		secret, err := randomHex(32)
+		if err != nil {
+			return Webhook{}, err
+		}
+		req.Secret = secret
+	}
+	if req.EventTypes == nil {
+		req.EventTypes = []string{}
+	}
+	if req.Usernames == nil {
+		req.Usernames = []string{}
+	}
+	eventTypes, err := json.Marshal(req.EventTypes)
+	if err != nil {
+		return Webhook{}, err
+	}
+	usernames, err := json.Marshal(req.Usernames)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	w := Webhook{WebhookRequest: req, CreatedAt: now.UTC()}
+	res, err := db.Exec("INSERT INTO webhooks (url, secret, event_types, usernames, created_at) VALUES (?, ?, ?, ?, ?)",
+		req.URL, req.Secret, string(eventTypes), string(usernames), w.CreatedAt)
+	if err != nil {
+		return Webhook{}, err
+	}
+	w.ID, err = res.LastInsertId()
+	return w, err
+}
+
+func deleteWebhook(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errWebhookNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// enqueueWebhookEvents stores a delivery of every event for each webhook subscribed to it.
+func enqueueWebhookEvents(db *sql.DB, events []webhookEvent, now time.Time) error {
+	if len(events) == 0 {
+		return nil
+	}
+	subscriptions, err := listWebhooks(db)
+	if err != nil || len(subscriptions) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := queueWebhookEvents(tx, subscriptions, events, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queueWebhookEvents adds a delivery of every event to each of the subscriptions that takes it.
+func queueWebhookEvents(tx *sql.Tx, subscriptions []Webhook, events []webhookEvent, now time.Time) error {
+	for _, event := range events {
+		id, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(webhookPayload{ID: id, Event: event.Type, Timestamp: now.UTC(), Data: event.Data})
+		if err != nil {
+			return err
+		}
+		for _, w := range subscriptions {
+			if !matchesFilter(w.EventTypes, event.Type) || !matchesFilter(w.Usernames, event.Usernames...) {
+				continue
+			}
+			_, err := tx.Exec("INSERT INTO webhook_deliveries (webhook_id, event_type, payload, attempts, next_attempt_at, last_error, created_at) VALUES (?, ?, ?, 0, ?, '', ?)",
+				w.ID, event.Type, string(payload), now.UTC(), now.UTC())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func listDeadLetters(db *sql.DB, req DeadLettersRequest) ([]DeadLetter, error) {
+	rows, err := db.Query("SELECT id, webhook_id, event_type, payload, attempts, last_error, failed_at FROM webhook_dead_letters WHERE (? = 0 OR webhook_id = ?) ORDER BY id",
+		req.WebhookID, req.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var l DeadLetter
+		if err := rows.Scan(&l.ID, &l.WebhookID, &l.EventType, &l.Payload, &l.Attempts, &l.LastError, &l.FailedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	return letters, rows.Err()
+}
+
+// redeliverDeadLetter moves a dead letter back into the delivery queue with a fresh set of attempts.
+func redeliverDeadLetter(db *sql.DB, id int64, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event_type, payload, attempts, next_attempt_at, last_error, created_at)
+		SELECT webhook_id, event_type, payload, 0, ?, '', ? FROM webhook_dead_letters
+		WHERE id = ? AND webhook_id IN (SELECT id FROM webhooks)`, now.UTC(), now.UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errDeadLetterNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_dead_letters WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type webhookDelivery struct {
+	id        int64
+	webhookID int64
+	url       string
+	secret    string
+	eventType string
+	payload   string
+	attempts  int
+}
+
+type webhookDispatcher struct {
+	db          *sql.DB
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	wakeup      chan struct{}
+	// clock tells the time of an attempt, from which its retry is scheduled.
+	clock func() time.Time
+
+	mu sync.Mutex
+	// busy holds the webhooks with a batch still being sent.
+	busy    map[int64]bool
+	sending sync.WaitGroup
+}
+
+// newWebhookDispatcher sets up delivery of the queued webhooks. Unless allowPrivate is set,
+// connections to loopback, private and link-local addresses are refused.
+func newWebhookDispatcher(db *sql.DB, maxAttempts int, backoff time.Duration, allowPrivate bool) *webhookDispatcher {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddressAllowed(net.ParseIP(host), allowPrivate) {
+				return errWebhookAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &webhookDispatcher{
+		db:          db,
+		client:      &http.Client{Timeout: webhookTimeout, Transport: transport},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		wakeup:      make(chan struct{}, 1),
+		clock:       time.Now,
+		busy:        map[int64]bool{},
+	}
+}
+
+// notify makes the dispatcher look for new deliveries without waiting for the next poll.
+func (d *webhookDispatcher) notify() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.deliverDue(time.Now()); err != nil {
+			log.Printf("Failed to deliver webhooks: %v", err)
+		}
+		select {
+		case <-d.wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue starts sending the due deliveries of every webhook that is not still busy with an
+// earlier batch. Each webhook's deliveries go out in order on a goroutine of its own, so a slow or
+// dead endpoint only holds up its own queue. The first failure ends a webhook's batch and its
+// later deliveries wait until the failed one is retried: failed deliveries are rescheduled with
+// exponential backoff and moved to the dead letters after maxAttempts.
+func (d *webhookDispatcher) deliverDue(now time.Time) error {
+	rows, err := d.db.Query(`SELECT DISTINCT d.webhook_id FROM webhook_deliveries d
+		WHERE d.next_attempt_at <= ? AND NOT EXISTS (SELECT 1 FROM webhook_deliveries f
+			WHERE f.webhook_id = d.webhook_id AND f.attempts > 0 AND f.next_attempt_at > ?)
+		ORDER BY d.webhook_id`, now.UTC(), now.UTC())
+	if err != nil {
+		return err
+	}
+	var webhookIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		webhookIDs = append(webhookIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, webhookID := range webhookIDs {
+		// The webhook is claimed before its batch is read, so that deliveries a finishing batch
+		// has just sent are never read again.
+		d.mu.Lock()
+		busy := d.busy[webhookID]
+		d.busy[webhookID] = true
+		d.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		d.sending.Add(1)
+		go func(webhookID int64) {
+			defer d.sending.Done()
+			batch, err := d.dueBatch(webhookID, now)
+			if err == nil {
+				err = d.deliverBatch(batch)
+			}
+			if err != nil {
+				log.Printf("Failed to deliver webhooks: %v", err)
+			}
+			d.mu.Lock()
+			delete(d.busy, webhookID)
+			d.mu.Unlock()
+		}(webhookID)
+	}
+	return nil
+}
+
+// dueBatch returns the first deliveries of a webhook in the order they were queued, unless one of
+// them waits for a retry.
+func (d *webhookDispatcher) dueBatch(webhookID int64, now time.Time) ([]webhookDelivery, error) {
+	rows, err := d.db.Query(`SELECT d.id, d.webhook_id, w.url, w.secret, d.event_type, d.payload, d.attempts
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.webhook_id = ? AND d.next_attempt_at <= ? AND NOT EXISTS (SELECT 1 FROM webhook_deliveries f
+			WHERE f.webhook_id = d.webhook_id AND f.attempts > 0 AND f.next_attempt_at > ?)
+		ORDER BY d.id LIMIT ?`, webhookID, now.UTC(), now.UTC(), webhookBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []webhookDelivery
+	for rows.Next() {
+		var delivery webhookDelivery
+		if err := rows.Scan(&delivery.id, &delivery.webhookID, &delivery.url, &delivery.secret, &delivery.eventType,
+			&delivery.payload, &delivery.attempts); err != nil {
+			return nil, err
+		}
+		batch = append(batch, delivery)
+	}
+	return batch, rows.Err()
+}
+
+// wait blocks until the batches deliverDue started have been sent.
+func (d *webhookDispatcher) wait() {
+	d.sending.Wait()
+}
+
+// deliverBatch sends the deliveries of one webhook in order, up to the first that fails.
+func (d *webhookDispatcher) deliverBatch(batch []webhookDelivery) error {
+	for _, delivery := range batch {
+		sendErr := d.send(delivery)
+		now := d.clock()
+		if sendErr == nil {
+			if _, err := d.db.Exec("DELETE FROM webhook_deliveries WHERE id = ?", delivery.id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := delivery.attempts + 1
+		log.Printf("Webhook delivery %d to %s failed (attempt %d): %v", delivery.id, delivery.url, attempts, sendErr)
+		if attempts < d.maxAttempts {
+			_, err := d.db.Exec("UPDATE webhook_deliveries SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+				attempts, now.Add(retryDelay(d.backoff, attempts)).UTC(), sendErr.Error(), delivery.id)
+			return err
+		}
+		return d.deadLetter(delivery, attempts, sendErr, now)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) send(delivery webhookDelivery) error {
+	body := []byte(delivery.payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.eventType)
+	req.Header.Set(webhookDeliveryHeader, fmt.Sprint(delivery.id))
+	req.Header.Set(webhookSignatureHeader, signWebhook(delivery.secret, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) deadLetter(delivery webhookDelivery, attempts int, sendErr error, now time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO webhook_dead_letters (webhook_id, event_type, payload, attempts, last_error, failed_at) VALUES (?, ?, ?, ?, ?, ?)",
+		delivery.webhookID, delivery.eventType, delivery.payload, attempts, sendErr.Error(), now.UTC())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE id = ?", delivery.id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func CreateWebhookHandler(c *gin.Context, db *sql.DB) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWebhookURL(req.URL, webhookAllowPrivate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w, err := createWebhook(db, req, time.Now())
+	if err != nil {
+		respondError(c, err, "create webhook")
+		return
+	}
+	// The secret is only returned when the webhook is created.
+	c.JSON(http.StatusCreated, w)
+}
+
+func ListWebhooksHandler(c *gin.Context, db *sql.DB) {
+	list, err := listWebhooks(db)
+	if err != nil {
+		respondError(c, err, "list webhooks")
+		return
+	}
+	for i := range list {
+		list[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": list})
+}
+
+func DeleteWebhookHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleteWebhook(db, uri.ID); err != nil {
+		respondError(c, err, "delete webhook")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "webhook deleted"})
+}
+
+func ListDeadLettersHandler(c *gin.Context, db *sql.DB) {
+	var req DeadLettersRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	letters, err := listDeadLetters(db, req)
+	if err != nil {
+		respondError(c, err, "list dead letters")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dead_letters": letters})
+}
+
+func RedeliverDeadLetterHandler(c *gin.Context, db *sql.DB) {
+	var uri IDURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := redeliverDeadLetter(db, uri.ID, time.Now()); err != nil {
+		respondError(c, err, "redeliver dead letter")
+		return
+	}
+	webhooks.notify()
+	c.JSON(http.StatusOK, gin.H{"status": "dead letter queued for redelivery"})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/vzivanovic/GOLANG_FOR_STUDENTS/proto"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	var received []*http.Request
+	var bodies [][]byte
+	failing := true
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	hook, err := createWebhook(testDB, WebhookRequest{URL: target.URL, EventTypes: []string{EventLocationUpdated}, Usernames: []string{"testuser"}}, now)
+	assert.NoError(t, err)
+	assert.Len(t, hook.Secret, 64)
+
+	events := []webhookEvent{
+		{Type: EventLocationUpdated, Usernames: []string{"testuser"}, Data: LocationEvent{Username: "testuser", Latitude: 45.2671, Longitude: 19.8335}},
+		{Type: EventLocationUpdated, Usernames: []string{"otheruser"}, Data: LocationEvent{Username: "otheruser"}},
+		{Type: "geofence.enter", Usernames: []string{"testuser"}, Data: GeofenceEvent{Username: "testuser"}},
+	}
+	assert.NoError(t, enqueueWebhookEvents(testDB, events, now))
+
+	d := newWebhookDispatcher(testDB, 3, time.Minute, true)
+	deliver := func(at time.Time) {
+		d.clock = func() time.Time { return at }
+		assert.NoError(t, d.deliverDue(at))
+		d.wait()
+	}
+
+	// Attempts are retried after 1 and 2 minutes and then dead-lettered
+	deliver(now)
+	deliver(now.Add(30 * time.Second))
+	assert.Len(t, received, 1)
+	deliver(now.Add(time.Minute))
+	deliver(now.Add(3 * time.Minute))
+	assert.Len(t, received, 3)
+
+	letters, err := listDeadLetters(testDB, DeadLettersRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, 3, letters[0].Attempts)
+		assert.Contains(t, letters[0].LastError, "503")
+	}
+
+	failing = false
+	assert.NoError(t, redeliverDeadLetter(testDB, letters[0].ID, now.Add(time.Hour)))
+	deliver(now.Add(time.Hour))
+	assert.Len(t, received, 4)
+
+	last := received[3]
+	assert.Equal(t, EventLocationUpdated, last.Header.Get(webhookEventHeader))
+	assert.Equal(t, signWebhook(hook.Secret, bodies[3]), last.Header.Get(webhookSignatureHeader))
+	assert.Contains(t, string(bodies[3]), `"username":"testuser"`)
+
+	letters, err = listDeadLetters(testDB, DeadLettersRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestWebhookBatches(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	var mu sync.Mutex
+	var healthyCount, deadCount int
+	healthyDone := make(chan struct{})
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if healthyCount++; healthyCount == 3 {
+			close(healthyDone)
+		}
+	}))
+	defer healthy.Close()
+	// The dead endpoint only answers once the healthy one got its whole batch.
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-healthyDone:
+		case <-time.After(5 * time.Second):
+		}
+		mu.Lock()
+		deadCount++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer dead.Close()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	for _, target := range []string{dead.URL, healthy.URL} {
+		_, err := createWebhook(testDB, WebhookRequest{URL: target}, now)
+		assert.NoError(t, err)
+	}
+	var events []webhookEvent
+	for i := 0; i < 3; i++ {
+		events = append(events, webhookEvent{Type: EventLocationUpdated, Usernames: []string{"testuser"}, Data: LocationEvent{Username: "testuser"}})
+	}
+	assert.NoError(t, enqueueWebhookEvents(testDB, events, now))
+
+	d := newWebhookDispatcher(testDB, 3, time.Minute, true)
+	deliver := func(at time.Time) {
+		d.clock = func() time.Time { return at }
+		assert.NoError(t, d.deliverDue(at))
+		d.wait()
+	}
+	began := time.Now()
+	deliver(now)
+	assert.Less(t, time.Since(began), 5*time.Second)
+	assert.Equal(t, 3, healthyCount)
+	// The dead endpoint's batch ends at its first failure, and the rest waits for its retry.
+	assert.Equal(t, 1, deadCount)
+	deliver(now.Add(30 * time.Second))
+	assert.Equal(t, 1, deadCount)
+	deliver(now.Add(time.Minute))
+	assert.Equal(t, 2, deadCount)
+
+	var pending int
+	assert.NoError(t, testDB.QueryRow("SELECT COUNT(*) FROM webhook_deliveries").Scan(&pending))
+	assert.Equal(t, 3, pending)
+}
+
+func TestWebhookOrder(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	var mu sync.Mutex
+	var sent []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, r.Header.Get(webhookDeliveryHeader))
+		if len(sent) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	_, err := createWebhook(testDB, WebhookRequest{URL: target.URL}, now)
+	assert.NoError(t, err)
+	var events []webhookEvent
+	for i := 0; i < 3; i++ {
+		events = append(events, webhookEvent{Type: EventLocationUpdated, Usernames: []string{"testuser"}, Data: LocationEvent{Username: "testuser"}})
+	}
+	assert.NoError(t, enqueueWebhookEvents(testDB, events, now))
+
+	d := newWebhookDispatcher(testDB, 3, time.Minute, true)
+	for _, at := range []time.Time{now, now.Add(time.Minute)} {
+		d.clock = func() time.Time { return at }
+		assert.NoError(t, d.deliverDue(at))
+		d.wait()
+	}
+	// The retried delivery still goes out before the ones queued after it.
+	assert.Equal(t, []string{"1", "1", "2", "3"}, sent)
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	assert.NoError(t, validateWebhookURL("https://hooks.example.com/location", false))
+	assert.NoError(t, validateWebhookURL("http://93.184.216.34:8080/", false))
+	for _, url := range []string{"http://127.0.0.1:9000/", "http://localhost/hook", "http://10.1.2.3/", "http://[::1]/",
+		"http://169.254.169.254/latest/meta-data", "http://192.168.0.10/", "http://0.0.0.0/"} {
+		assert.ErrorIs(t, validateWebhookURL(url, false), errWebhookAddress, url)
+		assert.NoError(t, validateWebhookURL(url, true), url)
+	}
+	assert.Error(t, validateWebhookURL("ftp://hooks.example.com/", true))
+
+	// Names are checked once resolved, when the dispatcher connects.
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	d := newWebhookDispatcher(nil, 3, time.Minute, false)
+	err := d.send(webhookDelivery{url: strings.Replace(target.URL, "127.0.0.1", "localhost", 1), payload: "{}"})
+	assert.ErrorIs(t, err, errWebhookAddress)
+}
+
+// alertService serves the alerts after the requested id.
+type alertService struct {
+	pb.UnimplementedLocationServiceServer
+	mu     sync.Mutex
+	alerts []*pb.Alert
+	listed int
+}
+
+func (s *alertService) LastAlertId(ctx context.Context, req *emptypb.Empty) (*pb.AlertId, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := &pb.AlertId{}
+	for _, alert := range s.alerts {
+		last.Id = max(last.Id, alert.Id)
+	}
+	return last, nil
+}
+
+func (s *alertService) ListAlerts(ctx context.Context, req *pb.AlertsRequest) (*pb.Alerts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed++
+	res := &pb.Alerts{}
+	for _, alert := range s.alerts {
+		if alert.Id > req.AfterId {
+			res.Alerts = append(res.Alerts, alert)
+		}
+	}
+	return res, nil
+}
+
+func (s *alertService) raise(alert *pb.Alert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alerts = append(s.alerts, alert)
+}
+
+func TestForwardAlerts(t *testing.T) {
+	setupTestDB()
+	defer teardownTestDB()
+
+	now := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	service := &alertService{}
+	service.raise(&pb.Alert{Id: 4, RuleId: 1, Username: "testuser", Message: "raised before", CreatedAt: timestamppb.New(now)})
+	hostname := startTestLocationHistory(t, service)
+	_, err := createWebhook(testDB, WebhookRequest{URL: "https://hooks.example.com/", EventTypes: []string{EventAlertTriggered}, Usernames: []string{"testuser"}}, now)
+	assert.NoError(t, err)
+	payloads := func() []string {
+		rows, err := testDB.Query("SELECT payload FROM webhook_deliveries WHERE event_type = ? ORDER BY id", EventAlertTriggered)
+		assert.NoError(t, err)
+		defer rows.Close()
+		var payloads []string
+		for rows.Next() {
+			var payload string
+			assert.NoError(t, rows.Scan(&payload))
+			payloads = append(payloads, payload)
+		}
+		return payloads
+	}
+
+	// Alerts raised before the first run are skipped without being read,
+	assert.NoError(t, forwardNewAlerts(hostname, testDB, now))
+	assert.Empty(t, payloads())
+	assert.Zero(t, service.listed)
+
+	// and later ones are forwarded once each to the webhooks of their users.
+	service.raise(&pb.Alert{Id: 5, RuleId: 2, Username: "testuser", Message: "no update for 30 minutes", CreatedAt: timestamppb.New(now)})
+	service.raise(&pb.Alert{Id: 6, RuleId: 2, Username: "otheruser", Message: "no update for 30 minutes", CreatedAt: timestamppb.New(now)})
+	assert.NoError(t, forwardNewAlerts(hostname, testDB, now.Add(time.Minute)))
+	assert.NoError(t, forwardNewAlerts(hostname, testDB, now.Add(2*time.Minute)))
+	if sent := payloads(); assert.Len(t, sent, 1) {
+		assert.Contains(t, sent[0], `"event":"alert.triggered"`)
+		assert.Contains(t, sent[0], `"message":"no update for 30 minutes"`)
+		assert.Contains(t, sent[0], `"id":5`)
+	}
+
+	cursor := func() int64 {
+		var position int64
+		assert.NoError(t, testDB.QueryRow("SELECT position FROM webhook_cursors WHERE name = ?", alertsCursor).Scan(&position))
+		return position
+	}
+	assert.Equal(t, int64(6), cursor())
+
+	// The cursor only moves when the deliveries are stored.
+	service.raise(&pb.Alert{Id: 7, RuleId: 2, Username: "testuser", Message: "no update for an hour", CreatedAt: timestamppb.New(now)})
+	_, err = testDB.Exec("ALTER TABLE webhook_deliveries RENAME TO webhook_deliveries_moved")
+	assert.NoError(t, err)
+	assert.Error(t, forwardNewAlerts(hostname, testDB, now.Add(3*time.Minute)))
+	assert.Equal(t, int64(6), cursor())
+	_, err = testDB.Exec("ALTER TABLE webhook_deliveries_moved RENAME TO webhook_deliveries")
+	assert.NoError(t, err)
+	assert.NoError(t, forwardNewAlerts(hostname, testDB, now.Add(4*time.Minute)))
+	assert.Len(t, payloads(), 2)
+	assert.Equal(t, int64(7), cursor())
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryDelay(5*time.Second, 1))
+	assert.Equal(t, 20*time.Second, retryDelay(5*time.Second, 3))
+	assert.Equal(t, maxWebhookBackoff, retryDelay(5*time.Second, 40))
+}
@@ -20,8 +20,19 @@ import (
 const _ = grpc.SupportPackageIsVersion8
 
 const (
-	LocationService_UpdateLocation_FullMethodName = "/location.LocationService/UpdateLocation"
-	LocationService_GetDistance_FullMethodName    = "/location.LocationService/GetDistance"
+	LocationService_UpdateLocation_FullMethodName  = "/location.LocationService/UpdateLocation"
+	LocationService_GetDistance_FullMethodName     = "/location.LocationService/GetDistance"
+	LocationService_GetTrack_FullMethodName        = "/location.LocationService/GetTrack"
+	LocationService_ReadChanges_FullMethodName     = "/location.LocationService/ReadChanges"
+	LocationService_CreateAlertRule_FullMethodName = "/location.LocationService/CreateAlertRule"
+	LocationService_ListAlertRules_FullMethodName  = "/location.LocationService/ListAlertRules"
+	LocationService_DeleteAlertRule_FullMethodName = "/location.LocationService/DeleteAlertRule"
+	LocationService_ListAlerts_FullMethodName      = "/location.LocationService/ListAlerts"
+	LocationService_LastAlertId_FullMethodName     = "/location.LocationService/LastAlertId"
+	LocationService_ImportTrack_FullMethodName     = "/location.LocationService/ImportTrack"
+	LocationService_ImportLocations_FullMethodName = "/location.LocationService/ImportLocations"
+	LocationService_ExportHistory_FullMethodName   = "/location.LocationService/ExportHistory"
+	LocationService_GetHeatmap_FullMethodName      = "/location.LocationService/GetHeatmap"
 )
 
 // LocationServiceClient is the client API for LocationService service.
@@ -30,6 +41,17 @@ const (
 type LocationServiceClient interface {
 	UpdateLocation(ctx context.Context, in *LocationUpdate, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	GetDistance(ctx context.Context, in *DistanceRequest, opts ...grpc.CallOption) (*DistanceResponse, error)
+	GetTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (LocationService_GetTrackClient, error)
+	ReadChanges(ctx context.Context, in *ChangesRequest, opts ...grpc.CallOption) (LocationService_ReadChangesClient, error)
+	CreateAlertRule(ctx context.Context, in *AlertRule, opts ...grpc.CallOption) (*AlertRule, error)
+	ListAlertRules(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*AlertRules, error)
+	DeleteAlertRule(ctx context.Context, in *AlertRuleId, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListAlerts(ctx context.Context, in *AlertsRequest, opts ...grpc.CallOption) (*Alerts, error)
+	LastAlertId(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*AlertId, error)
+	ImportTrack(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportSummary, error)
+	ImportLocations(ctx context.Context, in *ImportLocationsRequest, opts ...grpc.CallOption) (*ImportSummary, error)
+	ExportHistory(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (LocationService_ExportHistoryClient, error)
+	GetHeatmap(ctx context.Context, in *HeatmapRequest, opts ...grpc.CallOption) (*Heatmap, error)
 }
 
 type locationServiceClient struct {
@@ -60,12 +82,202 @@ func (c *locationServiceClient) GetDistance(ctx context.Context, in *DistanceReq
 	return out, nil
 }
 
+func (c *locationServiceClient) GetTrack(ctx context.Context, in *TrackRequest, opts ...grpc.CallOption) (LocationService_GetTrackClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LocationService_ServiceDesc.Streams[0], LocationService_GetTrack_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &locationServiceGetTrackClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LocationService_GetTrackClient interface {
+	Recv() (*TrackPoint, error)
+	grpc.ClientStream
+}
+
+type locationServiceGetTrackClient struct {
+	grpc.ClientStream
+}
+
+func (x *locationServiceGetTrackClient) Recv() (*TrackPoint, error) {
+	m := new(TrackPoint)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *locationServiceClient) ReadChanges(ctx context.Context, in *ChangesRequest, opts ...grpc.CallOption) (LocationService_ReadChangesClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LocationService_ServiceDesc.Streams[1], LocationService_ReadChanges_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &locationServiceReadChangesClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LocationService_ReadChangesClient interface {
+	Recv() (*LocationChange, error)
+	grpc.ClientStream
+}
+
+type locationServiceReadChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *locationServiceReadChangesClient) Recv() (*LocationChange, error) {
+	m := new(LocationChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *locationServiceClient) CreateAlertRule(ctx context.Context, in *AlertRule, opts ...grpc.CallOption) (*AlertRule, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AlertRule)
+	err := c.cc.Invoke(ctx, LocationService_CreateAlertRule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) ListAlertRules(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*AlertRules, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AlertRules)
+	err := c.cc.Invoke(ctx, LocationService_ListAlertRules_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) DeleteAlertRule(ctx context.Context, in *AlertRuleId, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, LocationService_DeleteAlertRule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) ListAlerts(ctx context.Context, in *AlertsRequest, opts ...grpc.CallOption) (*Alerts, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Alerts)
+	err := c.cc.Invoke(ctx, LocationService_ListAlerts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) LastAlertId(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*AlertId, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AlertId)
+	err := c.cc.Invoke(ctx, LocationService_LastAlertId_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) ImportTrack(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportSummary, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ImportSummary)
+	err := c.cc.Invoke(ctx, LocationService_ImportTrack_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) ImportLocations(ctx context.Context, in *ImportLocationsRequest, opts ...grpc.CallOption) (*ImportSummary, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ImportSummary)
+	err := c.cc.Invoke(ctx, LocationService_ImportLocations_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *locationServiceClient) ExportHistory(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (LocationService_ExportHistoryClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LocationService_ServiceDesc.Streams[2], LocationService_ExportHistory_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &locationServiceExportHistoryClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LocationService_ExportHistoryClient interface {
+	Recv() (*ExportChunk, error)
+	grpc.ClientStream
+}
+
+type locationServiceExportHistoryClient struct {
+	grpc.ClientStream
+}
+
+func (x *locationServiceExportHistoryClient) Recv() (*ExportChunk, error) {
+	m := new(ExportChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *locationServiceClient) GetHeatmap(ctx context.Context, in *HeatmapRequest, opts ...grpc.CallOption) (*Heatmap, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Heatmap)
+	err := c.cc.Invoke(ctx, LocationService_GetHeatmap_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LocationServiceServer is the server API for LocationService service.
 // All implementations must embed UnimplementedLocationServiceServer
 // for forward compatibility
 type LocationServiceServer interface {
 	UpdateLocation(context.Context, *LocationUpdate) (*emptypb.Empty, error)
 	GetDistance(context.Context, *DistanceRequest) (*DistanceResponse, error)
+	GetTrack(*TrackRequest, LocationService_GetTrackServer) error
+	ReadChanges(*ChangesRequest, LocationService_ReadChangesServer) error
+	CreateAlertRule(context.Context, *AlertRule) (*AlertRule, error)
+	ListAlertRules(context.Context, *emptypb.Empty) (*AlertRules, error)
+	DeleteAlertRule(context.Context, *AlertRuleId) (*emptypb.Empty, error)
+	ListAlerts(context.Context, *AlertsRequest) (*Alerts, error)
+	LastAlertId(context.Context, *emptypb.Empty) (*AlertId, error)
+	ImportTrack(context.Context, *ImportRequest) (*ImportSummary, error)
+	ImportLocations(context.Context, *ImportLocationsRequest) (*ImportSummary, error)
+	ExportHistory(*ExportRequest, LocationService_ExportHistoryServer) error
+	GetHeatmap(context.Context, *HeatmapRequest) (*Heatmap, error)
 	mustEmbedUnimplementedLocationServiceServer()
 }
 
@@ -79,6 +291,39 @@ func (UnimplementedLocationServiceServer) UpdateLocation(context.Context, *Locat
 func (UnimplementedLocationServiceServer) GetDistance(context.Context, *DistanceRequest) (*DistanceResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetDistance not implemented")
 }
+func (UnimplementedLocationServiceServer) GetTrack(*TrackRequest, LocationService_GetTrackServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetTrack not implemented")
+}
+func (UnimplementedLocationServiceServer) ReadChanges(*ChangesRequest, LocationService_ReadChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method ReadChanges not implemented")
+}
+func (UnimplementedLocationServiceServer) CreateAlertRule(context.Context, *AlertRule) (*AlertRule, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAlertRule not implemented")
+}
+func (UnimplementedLocationServiceServer) ListAlertRules(context.Context, *emptypb.Empty) (*AlertRules, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAlertRules not implemented")
+}
+func (UnimplementedLocationServiceServer) DeleteAlertRule(context.Context, *AlertRuleId) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAlertRule not implemented")
+}
+func (UnimplementedLocationServiceServer) ListAlerts(context.Context, *AlertsRequest) (*Alerts, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAlerts not implemented")
+}
+func (UnimplementedLocationServiceServer) LastAlertId(context.Context, *emptypb.Empty) (*AlertId, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LastAlertId not implemented")
+}
+func (UnimplementedLocationServiceServer) ImportTrack(context.Context, *ImportRequest) (*ImportSummary, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportTrack not implemented")
+}
+func (UnimplementedLocationServiceServer) ImportLocations(context.Context, *ImportLocationsRequest) (*ImportSummary, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportLocations not implemented")
+}
+func (UnimplementedLocationServiceServer) ExportHistory(*ExportRequest, LocationService_ExportHistoryServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportHistory not implemented")
+}
+func (UnimplementedLocationServiceServer) GetHeatmap(context.Context, *HeatmapRequest) (*Heatmap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHeatmap not implemented")
+}
 func (UnimplementedLocationServiceServer) mustEmbedUnimplementedLocationServiceServer() {}
 
 // UnsafeLocationServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -128,6 +373,213 @@ func _LocationService_GetDistance_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LocationService_GetTrack_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TrackRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LocationServiceServer).GetTrack(m, &locationServiceGetTrackServer{ServerStream: stream})
+}
+
+type LocationService_GetTrackServer interface {
+	Send(*TrackPoint) error
+	grpc.ServerStream
+}
+
+type locationServiceGetTrackServer struct {
+	grpc.ServerStream
+}
+
+func (x *locationServiceGetTrackServer) Send(m *TrackPoint) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LocationService_ReadChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LocationServiceServer).ReadChanges(m, &locationServiceReadChangesServer{ServerStream: stream})
+}
+
+type LocationService_ReadChangesServer interface {
+	Send(*LocationChange) error
+	grpc.ServerStream
+}
+
+type locationServiceReadChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *locationServiceReadChangesServer) Send(m *LocationChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LocationService_CreateAlertRule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AlertRule)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).CreateAlertRule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_CreateAlertRule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).CreateAlertRule(ctx, req.(*AlertRule))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_ListAlertRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).ListAlertRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_ListAlertRules_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).ListAlertRules(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_DeleteAlertRule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AlertRuleId)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).DeleteAlertRule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_DeleteAlertRule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).DeleteAlertRule(ctx, req.(*AlertRuleId))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_ListAlerts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AlertsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).ListAlerts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_ListAlerts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).ListAlerts(ctx, req.(*AlertsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_LastAlertId_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).LastAlertId(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_LastAlertId_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).LastAlertId(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_ImportTrack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).ImportTrack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_ImportTrack_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).ImportTrack(ctx, req.(*ImportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_ImportLocations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportLocationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).ImportLocations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_ImportLocations_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).ImportLocations(ctx, req.(*ImportLocationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LocationService_ExportHistory_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LocationServiceServer).ExportHistory(m, &locationServiceExportHistoryServer{ServerStream: stream})
+}
+
+type LocationService_ExportHistoryServer interface {
+	Send(*ExportChunk) error
+	grpc.ServerStream
+}
+
+type locationServiceExportHistoryServer struct {
+	grpc.ServerStream
+}
+
+func (x *locationServiceExportHistoryServer) Send(m *ExportChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LocationService_GetHeatmap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeatmapRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationServiceServer).GetHeatmap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationService_GetHeatmap_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationServiceServer).GetHeatmap(ctx, req.(*HeatmapRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LocationService_ServiceDesc is the grpc.ServiceDesc for LocationService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -143,7 +595,55 @@ var LocationService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetDistance",
 			Handler:    _LocationService_GetDistance_Handler,
 		},
+		{
+			MethodName: "CreateAlertRule",
+			Handler:    _LocationService_CreateAlertRule_Handler,
+		},
+		{
+			MethodName: "ListAlertRules",
+			Handler:    _LocationService_ListAlertRules_Handler,
+		},
+		{
+			MethodName: "DeleteAlertRule",
+			Handler:    _LocationService_DeleteAlertRule_Handler,
+		},
+		{
+			MethodName: "ListAlerts",
+			Handler:    _LocationService_ListAlerts_Handler,
+		},
+		{
+			MethodName: "LastAlertId",
+			Handler:    _LocationService_LastAlertId_Handler,
+		},
+		{
+			MethodName: "ImportTrack",
+			Handler:    _LocationService_ImportTrack_Handler,
+		},
+		{
+			MethodName: "ImportLocations",
+			Handler:    _LocationService_ImportLocations_Handler,
+		},
+		{
+			MethodName: "GetHeatmap",
+			Handler:    _LocationService_GetHeatmap_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetTrack",
+			Handler:       _LocationService_GetTrack_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ReadChanges",
+			Handler:       _LocationService_ReadChanges_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ExportHistory",
+			Handler:       _LocationService_ExportHistory_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/location.proto",
 }